@@ -2,45 +2,89 @@ package blockchain
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"encoding/gob"
 	"log"
+	"math/big"
+	"time"
 )
 
+const BlockVersion = 1
+
 type Block struct {
+	Version      int
+	Height       int
+	Timestamp    int64
 	Hash         []byte
 	Transactions []*Transaction
 	PrevHash     []byte
-	Nonce        int
+	TxRoot       []byte
+	// Target is the big endian number the block hash must be below, under
+	// proof of work.
+	Target []byte
+	Nonce  uint32
+	// Signature is the signature of the sealer over the block hash, under
+	// proof of authority.
+	Signature []byte
 }
 
-func (b *Block) HashTransactions() []byte {
-	var txHashes [][]byte
+func (b *Block) txIDs() [][]byte {
+	var txIDs [][]byte
 
 	for _, tx := range b.Transactions {
-		txHashes = append(txHashes, tx.ID)
+		txIDs = append(txIDs, tx.ID)
 	}
 
-	txHash := sha256.Sum256(bytes.Join(txHashes, []byte{}))
+	return txIDs
+}
+
+func (b *Block) HashTransactions() []byte {
+	return NewMerkleTree(b.txIDs()).RootHash()
+}
 
-	return txHash[:]
+// MerkleProof proves that the transaction is part of the block, against
+// the block's TxRoot.
+func (b *Block) MerkleProof(txID []byte) (MerkleProof, error) {
+	return NewMerkleTree(b.txIDs()).MerkleProof(txID)
 }
 
- func CreateBlock(txs []*Transaction, prevHash []byte) *Block {
-	block := &Block{[]byte{}, txs, prevHash, 0}
-	pow := NewProofOfWork(block)
-	nonce, hash := pow.Run()
+func (b *Block) TargetInt() *big.Int {
+	return new(big.Int).SetBytes(b.Target)
+}
 
-	block.Hash = hash
-	block.Nonce = nonce
+// CreateBlock builds a block with the transactions on top of prevHash. The
+// block still has to be prepared and sealed by a consensus engine.
+func CreateBlock(txs []*Transaction, prevHash []byte, height int) *Block {
+	block := &Block{
+		Version:      BlockVersion,
+		Height:       height,
+		Timestamp:    time.Now().Unix(),
+		Hash:         []byte{},
+		Transactions: txs,
+		PrevHash:     prevHash,
+	}
+	block.TxRoot = block.HashTransactions()
 
 	return block
 }
 
+// rollExtraNonce bumps the extra nonce of the coinbase, which changes its ID
+// and so the TxRoot of the block.
+func (b *Block) rollExtraNonce() {
+	if len(b.Transactions) == 0 || !b.Transactions[0].IsCoinbase() {
+		return
+	}
+
+	coinbase := b.Transactions[0]
+	coinbase.Inputs[0].ExtraNonce++
+	coinbase.ID = coinbase.Hash()
+}
+
 func Genesis(coinbase *Transaction) *Block {
-	return CreateBlock([]*Transaction{coinbase}, []byte{})
+	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0)
 }
 
+// Serialize panics if the block can't be encoded, which only happens on a
+// programming error since every field of Block is gob encodable.
 func (b *Block) Serialize() []byte {
 	var res bytes.Buffer
 	encoder := gob.NewEncoder(&res)
@@ -51,12 +95,12 @@ func (b *Block) Serialize() []byte {
 	return res.Bytes()
 }
 
-func Deserialize(b []byte) *Block {
+func Deserialize(b []byte) (*Block, error) {
 	var block Block
 	decoder := gob.NewDecoder(bytes.NewReader(b))
 	err := decoder.Decode(&block)
 	if err != nil {
-		log.Panicln("decoder.Decode failed on Deserialize: ", err)
+		return nil, err
 	}
-	return &block
+	return &block, nil
 }
@@ -2,6 +2,7 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
@@ -9,18 +10,69 @@ import (
 	"github.com/dgraph-io/badger/v3"
 	"log"
 	"os"
-	"runtime"
+	"path/filepath"
 )
 
 const (
-	dbPath         = "./tmp/blockchain"
-	dbManifestPath = "./tmp/blockchain/MANIFEST"
+	defaultDataDir = "./tmp"
 	defaultKey     = "lh"
 )
 
+var (
+	blockPrefix = []byte("b-")
+	// blockKeysKey is set once the blocks are stored under blockPrefix.
+	// Older databases kept them under their bare hash, which could start
+	// like the prefix of an index and be scanned or dropped with it.
+	blockKeysKey = []byte("blockkeys")
+)
+
+var (
+	ErrChainExists     = errors.New("blockchain already exists")
+	ErrNoChain         = errors.New("no existing blockchain found, create one")
+	ErrBlockNotFound   = errors.New("block does not exist")
+	ErrGenesisMismatch = errors.New("genesis block does not match the configured one")
+)
+
+// Options configures where the chain is stored, the rules it follows and how
+// its blocks are sealed.
+type Options struct {
+	// DataDir holds the chain database, in its "blockchain" subdirectory.
+	DataDir string
+	Params  ChainParams
+	// Genesis configures a chain created by InitBlockChain.
+	Genesis GenesisConfig
+	// CheckGenesis makes ContinueBlockChain refuse a chain created with
+	// another genesis configuration than Genesis.
+	CheckGenesis bool
+	// Consensus seals and verifies the blocks. When nil, the engine comes
+	// from the genesis configuration of the chain, and proof of work is
+	// tuned by Mining.
+	Consensus Consensus
+	Mining    MiningOptions
+}
+
+// DefaultOptions are the options of a mainnet chain in the default data
+// directory.
+func DefaultOptions() Options {
+	return Options{DataDir: defaultDataDir, Params: DefaultChainParams, Genesis: Mainnet.Genesis}
+}
+
+func (opts Options) consensus(config GenesisConfig) (Consensus, error) {
+	if opts.Consensus != nil {
+		return opts.Consensus, nil
+	}
+	return config.Consensus.engine(opts.Mining)
+}
+
+func (opts Options) dbPath() string {
+	return filepath.Join(opts.DataDir, "blockchain")
+}
+
 type BlockChain struct {
-	LastHash []byte
-	Database *badger.DB
+	LastHash  []byte
+	Database  *badger.DB
+	Params    ChainParams
+	Consensus Consensus
 }
 
 type BlockChainIterator struct {
@@ -28,299 +80,609 @@ type BlockChainIterator struct {
 	Database    *badger.DB
 }
 
-func DBExists() bool {
-	if _, err := os.Stat(dbManifestPath); os.IsNotExist(err) {
+func DBExists(opts Options) bool {
+	if _, err := os.Stat(filepath.Join(opts.dbPath(), "MANIFEST")); os.IsNotExist(err) {
 		return false
 	}
 	return true
 }
 
-func InitBlockChain(address string) *BlockChain {
-	var lastHash []byte
-
-	if DBExists() {
-		fmt.Println("Blockchain already exists")
-		runtime.Goexit()
+func InitBlockChain(address string, opts Options) (*BlockChain, error) {
+	if DBExists(opts) {
+		return nil, ErrChainExists
 	}
 
-	opts := badger.DefaultOptions(dbPath)
+	params := opts.Genesis.params(opts.Params)
 
-	db, err := badger.Open(opts)
+	coinbase, err := opts.Genesis.coinbase(address, params)
 	if err != nil {
-		log.Panicln("badger.Open failed on InitBlockChain: ", err)
+		return nil, err
 	}
 
-	lastHashKey := []byte(defaultKey)
+	genesis := Genesis(coinbase)
+	if opts.Genesis.Timestamp != 0 {
+		genesis.Timestamp = opts.Genesis.Timestamp
+	}
 
-	err = db.Update(func(txn *badger.Txn) error {
+	engine, err := opts.consensus(opts.Genesis)
+	if err != nil {
+		return nil, err
+	}
 
-		_, err := txn.Get(lastHashKey)
+	db, err := badger.Open(badger.DefaultOptions(opts.dbPath()))
+	if err != nil {
+		return nil, fmt.Errorf("opening database: %w", err)
+	}
 
-		if err == badger.ErrKeyNotFound {
+	// A chain that could not be created leaves no database behind, or every
+	// later attempt would find one without a tip.
+	created := false
+	defer func() {
+		if !created {
+			db.Close()
+			os.RemoveAll(opts.dbPath())
+		}
+	}()
 
-			coinbase := CoinbaseTx(address, "First Transaction from Genesis")
-			genesis := Genesis(coinbase)
-			fmt.Println("Genesis created")
+	chain := &BlockChain{nil, db, params, engine}
 
-			err = txn.Set(genesis.Hash, genesis.Serialize())
-			if err != nil {
-				return err
-			}
+	err = chain.Consensus.Prepare(chain, genesis, nil)
+	if err == nil {
+		err = chain.Consensus.Seal(context.Background(), genesis)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sealing genesis block: %w", err)
+	}
 
-			lastHash = genesis.Hash
+	err = opts.Genesis.checkHash(genesis.Hash)
+	if err != nil {
+		return nil, err
+	}
 
-			return txn.Set(lastHashKey, genesis.Hash)
+	err = db.Update(func(txn *badger.Txn) error {
+		_, err := storeBlock(txn, genesis)
+		if err != nil {
+			return err
 		}
 
-		item, err := txn.Get(lastHashKey)
+		err = storeGenesisConfig(txn, opts.Genesis)
 		if err != nil {
-			log.Panicln("txn.Get failed on db.Update: ", err)
+			return err
 		}
 
-		return item.Value(func(lh []byte) error {
-			lastHash = lh
-			return nil
-		})
+		err = txn.Set(blockKeysKey, []byte{})
+		if err != nil {
+			return err
+		}
 
+		return chain.connectBlock(txn, genesis)
 	})
 
 	if err != nil {
-		log.Panicln("db.Update failed on InitBlockChain: ", err)
+		return nil, fmt.Errorf("storing genesis block: %w", err)
 	}
 
-	return &BlockChain{lastHash, db}
+	chain.LastHash = genesis.Hash
+	created = true
+
+	return chain, nil
 }
 
-func ContinueBlockChain(address string) *BlockChain {
-	if !DBExists() {
-		fmt.Println("No existing blockchain found, create one!")
-		runtime.Goexit()
+func ContinueBlockChain(address string, opts Options) (*BlockChain, error) {
+	if !DBExists(opts) {
+		return nil, ErrNoChain
 	}
 
-	opts := badger.DefaultOptions(dbPath)
-
-	db, err := badger.Open(opts)
+	db, err := badger.Open(badger.DefaultOptions(opts.dbPath()))
 	if err != nil {
-		log.Panicln("badger.Open failed on ContinueBlockChain: ", err)
+		return nil, fmt.Errorf("opening database: %w", err)
 	}
 
 	var lastHash []byte
 	lastHashKey := []byte(defaultKey)
 
-	err = db.Update(func(txn *badger.Txn) error {
+	err = db.View(func(txn *badger.Txn) error {
 		item, err := txn.Get(lastHashKey)
 		if err != nil {
 			return err
 		}
-		return item.Value(func(lh []byte) error {
-			lastHash = lh
-			return nil
-		})
+		lastHash, err = item.ValueCopy(nil)
+		return err
 	})
 
 	if err != nil {
-		log.Panicln("db.Update failed on ContinueBlockChain: ", err)
+		db.Close()
+		return nil, fmt.Errorf("reading last hash: %w", err)
 	}
 
-	return &BlockChain{lastHash, db}
-}
+	config, err := loadGenesisConfig(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("reading genesis config: %w", err)
+	}
 
-func (bc *BlockChain) AddBlock(transactions []*Transaction) {
-	var lastHash []byte
+	engine, err := opts.consensus(config)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
-	lastHashKey := []byte(defaultKey)
+	chain := &BlockChain{lastHash, db, config.params(opts.Params), engine}
 
+	err = chain.migrateBlockKeys()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("moving blocks under their prefix: %w", err)
+	}
+
+	genesisHash, err := chain.GetBlockHashByHeight(0)
+	if err == nil {
+		err = opts.Genesis.checkHash(genesisHash)
+	}
+	if err == nil && opts.CheckGenesis {
+		err = opts.Genesis.checkConfig(config)
+	}
+	if err == nil {
+		err = chain.finishReindex()
+	}
+	if err == nil {
+		err = chain.finishReorganization()
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return chain, nil
+}
+
+// reindexing tells if a rebuild marked by the key was cut short.
+func (bc *BlockChain) reindexing(key []byte) (bool, error) {
 	err := bc.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(key)
+		return err
+	})
 
-		item, err := txn.Get(lastHashKey)
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// finishReindex rebuilds again the transaction index and the UTXO set when
+// their last rebuild was cut short, which left them incomplete.
+func (bc *BlockChain) finishReindex() error {
+	pending, err := bc.reindexing(txReindexKey)
+	if err != nil {
+		return err
+	}
+	if pending {
+		log.Println("Finishing the interrupted rebuild of the transaction index")
+		err = bc.ReindexTransactions()
 		if err != nil {
-			return err
+			return fmt.Errorf("reindexing transactions: %w", err)
 		}
+	}
 
-		err = item.Value(func(lh []byte) error {
-			lastHash = lh
-			return nil
-		})
+	pending, err = bc.reindexing(utxoReindexKey)
+	if err != nil {
+		return err
+	}
+	if pending {
+		log.Println("Finishing the interrupted rebuild of the UTXO set")
+		err = UTXOSet{bc}.Reindex()
+		if err != nil {
+			return fmt.Errorf("reindexing UTXO set: %w", err)
+		}
+	}
 
+	return nil
+}
+
+// migrateBlockKeys moves the blocks of an older database, stored under
+// their bare hash, to blockKey. Every stored block has a chain work entry,
+// which gives the hashes to move. Each block moves in a transaction of its
+// own, and a move cut short is taken up again when the chain is opened.
+func (bc *BlockChain) migrateBlockKeys() error {
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(blockKeysKey)
 		return err
 	})
+	if err != badger.ErrKeyNotFound {
+		return err
+	}
+
+	log.Println("Moving the blocks under their prefix")
+
+	var hashes [][]byte
+	err = bc.Database.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = chainWorkPrefix
+		opts.PrefetchValues = false
 
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			hashes = append(hashes, it.Item().KeyCopy(nil)[len(chainWorkPrefix):])
+		}
+		return nil
+	})
 	if err != nil {
-		log.Panicln("chain.Database.View failed on AddBlock: ", err)
+		return err
+	}
+
+	for _, hash := range hashes {
+		err = bc.Database.Update(func(txn *badger.Txn) error {
+			item, err := txn.Get(hash)
+			if err == badger.ErrKeyNotFound {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			data, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			err = txn.Set(blockKey(hash), data)
+			if err != nil {
+				return err
+			}
+			return txn.Delete(hash)
+		})
+		if err != nil {
+			return err
+		}
 	}
 
-	newBlock := CreateBlock(transactions, lastHash)
+	return bc.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set(blockKeysKey, []byte{})
+	})
+}
+
+// AddBlock validates the transactions, seals a block with them on top of the
+// tip and stores it. The first transaction must be the coinbase. Invalid
+// transactions are rejected with a *TxValidationError and nothing is written.
+// Sealing stops with the context error once ctx is done.
+func (bc *BlockChain) AddBlock(ctx context.Context, transactions []*Transaction) (*Block, error) {
+	return bc.addBlock(ctx, bc.Consensus, transactions)
+}
+
+// addBlock is AddBlock sealing with the engine.
+func (bc *BlockChain) addBlock(ctx context.Context, engine Consensus, transactions []*Transaction) (*Block, error) {
+	newBlock, err := bc.sealBlock(ctx, engine, transactions)
+	if err != nil {
+		return nil, err
+	}
 
 	err = bc.Database.Update(func(txn *badger.Txn) error {
-		err := txn.Set(newBlock.Hash, newBlock.Serialize())
+		item, err := txn.Get([]byte(defaultKey))
+		if err != nil {
+			return err
+		}
+
+		tip, err := item.ValueCopy(nil)
 		if err != nil {
 			return err
 		}
-		return txn.Set(lastHashKey, newBlock.Hash)
+
+		if !bytes.Equal(tip, newBlock.PrevHash) {
+			return errors.New("the tip of the chain changed while mining")
+		}
+
+		_, err = storeBlock(txn, newBlock)
+		if err != nil {
+			return err
+		}
+
+		return bc.connectBlock(txn, newBlock)
 	})
 
 	if err != nil {
-		log.Panicln("chain.Database.Update failed on AddBlock: ", err)
+		return nil, err
 	}
 
 	bc.LastHash = newBlock.Hash
-}
 
-func (bc *BlockChain) Iterator() *BlockChainIterator {
-	return &BlockChainIterator{bc.LastHash, bc.Database}
+	return newBlock, nil
 }
 
-func (iter *BlockChainIterator) Next() *Block {
-	var block *Block
+// sealBlock validates the transactions and seals a block with them on top of
+// the tip with the engine, without storing it.
+func (bc *BlockChain) sealBlock(ctx context.Context, engine Consensus, transactions []*Transaction) (*Block, error) {
+	var lastBlock *Block
+	var median int64
 
-	err := iter.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(iter.CurrentHash)
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		var err error
+		lastBlock, err = getTip(txn)
 		if err != nil {
 			return err
 		}
-		return item.Value(func(b []byte) error {
-			block = Deserialize(b)
-			return nil
-		})
+
+		median, err = medianTimePast(txn, lastBlock)
+		if err != nil {
+			return err
+		}
+
+		return bc.validateTransactions(txn, transactions, lastBlock.Height+1)
 	})
 
 	if err != nil {
-		log.Panicln("iter.Database.View failed on Next: ", err)
+		return nil, err
 	}
 
-	iter.CurrentHash = block.PrevHash
+	newBlock := CreateBlock(transactions, lastBlock.Hash, lastBlock.Height+1)
+
+	// Blocks mined within the same second would not be later than the
+	// median time past.
+	if newBlock.Timestamp <= median {
+		newBlock.Timestamp = median + 1
+	}
+
+	err = engine.Prepare(bc, newBlock, lastBlock)
+	if err != nil {
+		return nil, err
+	}
 
-	return block
+	err = engine.Seal(ctx, newBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	return newBlock, nil
 }
 
-func (bc *BlockChain) FindUnspentTransactions(pubKeyHash []byte) []Transaction {
-	var unspentTxs []Transaction
+// MineBlock mines the transactions into a new block, with a coinbase
+// transaction paying the subsidy plus the fees of the transactions to the miner.
+func (bc *BlockChain) MineBlock(ctx context.Context, minerAddress string, transactions []*Transaction) (*Block, error) {
+	transactions, err := bc.withCoinbase(minerAddress, transactions)
+	if err != nil {
+		return nil, err
+	}
 
-	spentTXOs := make(map[string][]int)
+	return bc.AddBlock(ctx, transactions)
+}
 
-	iter := bc.Iterator()
+// MineBlockSignedBy is MineBlock for a chain shared by callers signing with
+// their own keys: under proof of authority the block is sealed with the key,
+// not with the signer of the engine. Proof of work does not use the key.
+func (bc *BlockChain) MineBlockSignedBy(ctx context.Context, key *ecdsa.PrivateKey, minerAddress string, transactions []*Transaction) (*Block, error) {
+	engine := bc.Consensus
+	if poa, ok := engine.(*PoAEngine); ok {
+		engine = poa.WithSigner(key)
+	}
 
-	for {
-		block := iter.Next()
+	transactions, err := bc.withCoinbase(minerAddress, transactions)
+	if err != nil {
+		return nil, err
+	}
 
-		for _, tx := range block.Transactions {
-			txID := hex.EncodeToString(tx.ID)
+	return bc.addBlock(ctx, engine, transactions)
+}
 
-		Outputs:
-			for outIdx, out := range tx.Outputs {
-				if spentTXOs[txID] != nil {
-					for _, spentOut := range spentTXOs[txID] {
-						if spentOut == outIdx {
-							continue Outputs
-						}
-					}
-				}
-				if out.IsLockedWithKey(pubKeyHash) {
-					unspentTxs = append(unspentTxs, *tx)
-				}
-			}
+// SealBlock mines the transactions into a new block on top of the tip like
+// MineBlock, but leaves storing it to ProcessBlock. The chain may change while
+// the block is sealed: the block then ends up on a side branch.
+func (bc *BlockChain) SealBlock(ctx context.Context, minerAddress string, transactions []*Transaction) (*Block, error) {
+	transactions, err := bc.withCoinbase(minerAddress, transactions)
+	if err != nil {
+		return nil, err
+	}
 
-			if tx.IsCoinbase() == false {
-				for _, in := range tx.Inputs {
-					if in.UsesKey(pubKeyHash) {
-						inTxID := hex.EncodeToString(in.ID)
-						spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Out)
-					}
-				}
-			}
-		}
+	return bc.sealBlock(ctx, bc.Consensus, transactions)
+}
+
+// withCoinbase puts before the transactions a coinbase transaction paying the
+// subsidy of the next block plus their fees to the miner.
+func (bc *BlockChain) withCoinbase(minerAddress string, transactions []*Transaction) ([]*Transaction, error) {
+	var fees, height int
 
-		if len(block.PrevHash) == 0 {
-			break
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		lastBlock, err := getTip(txn)
+		if err != nil {
+			return err
 		}
+		height = lastBlock.Height + 1
+
+		fees, err = checkBlockTransactions(txn, transactions, 1)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
 	}
 
-	return unspentTxs
+	coinbase, err := CoinbaseTx(minerAddress, "", bc.Params.Subsidy(height)+fees, bc.Params.AddressVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]*Transaction{coinbase}, transactions...), nil
 }
 
-func (bc *BlockChain) FindUTXO(pubKeyHash []byte) []TxOutput {
-	var UTXOs []TxOutput
-	unspentTransactions := bc.FindUnspentTransactions(pubKeyHash)
+// connectBlock makes the stored block, whose parent is the tip, the new tip.
+// Its transactions update the UTXO set, the indexes and the mempool.
+func (bc *BlockChain) connectBlock(txn *badger.Txn, block *Block) error {
+	err := UTXOSet{bc}.update(txn, block)
+	if err != nil {
+		return err
+	}
 
-	for _, tx := range unspentTransactions {
-		for _, out := range tx.Outputs {
-			if out.IsLockedWithKey(pubKeyHash) {
-				UTXOs = append(UTXOs, out)
-			}
-		}
+	err = indexTransactions(txn, block)
+	if err != nil {
+		return err
+	}
+
+	err = indexHeight(txn, block)
+	if err != nil {
+		return err
+	}
+
+	err = Mempool{bc}.removeConfirmed(txn, block)
+	if err != nil {
+		return err
 	}
 
-	return UTXOs
+	return txn.Set([]byte(defaultKey), block.Hash)
 }
 
-func (bc *BlockChain) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
-	unspentOuts := make(map[string][]int)
-	unspentTxs := bc.FindUnspentTransactions(pubKeyHash)
-	accumulated := 0
+// disconnectBlock undoes connectBlock for the tip, making its parent the tip.
+// The block itself stays stored.
+func (bc *BlockChain) disconnectBlock(txn *badger.Txn, block *Block) error {
+	err := UTXOSet{bc}.undo(txn, block)
+	if err != nil {
+		return err
+	}
 
-Work:
-	for _, tx := range unspentTxs {
-		txID := hex.EncodeToString(tx.ID)
+	err = unindexTransactions(txn, block)
+	if err != nil {
+		return err
+	}
 
-		for outIdx, out := range tx.Outputs {
-			if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
-				accumulated += out.Value
-				unspentOuts[txID] = append(unspentOuts[txID], outIdx)
+	err = unindexHeight(txn, block)
+	if err != nil {
+		return err
+	}
 
-				if accumulated >= amount {
-					break Work
-				}
-			}
+	return txn.Set([]byte(defaultKey), block.PrevHash)
+}
+
+func (bc *BlockChain) Iterator() *BlockChainIterator {
+	return &BlockChainIterator{bc.LastHash, bc.Database}
+}
+
+// TipIterator iterates from the tip stored in the database. Unlike Iterator,
+// it is safe to call while another goroutine adds blocks.
+func (bc *BlockChain) TipIterator() (*BlockChainIterator, error) {
+	var lastHash []byte
+
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(defaultKey))
+		if err != nil {
+			return err
 		}
+		lastHash, err = item.ValueCopy(nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return accumulated, unspentOuts
+	return &BlockChainIterator{lastHash, bc.Database}, nil
 }
 
-func (bc *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
-	iter := bc.Iterator()
+func (iter *BlockChainIterator) Next() (*Block, error) {
+	var block *Block
 
-	for {
-		block  := iter.Next()
+	err := iter.Database.View(func(txn *badger.Txn) error {
+		var err error
+		block, err = getBlock(txn, iter.CurrentHash)
+		return err
+	})
 
-		for _, tx := range block.Transactions {
-			if bytes.Compare(tx.ID, ID) == 0 {
-				return *tx, nil
-			}
-		}
+	if err != nil {
+		return nil, err
+	}
 
-		if len(block.PrevHash) == 0 {
-			break
-		}
+	iter.CurrentHash = block.PrevHash
+
+	return block, nil
+}
+
+func (bc *BlockChain) GetBlock(hash []byte) (*Block, error) {
+	var block *Block
+
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		var err error
+		block, err = getBlock(txn, hash)
+		return err
+	})
+
+	return block, err
+}
+
+// getTip returns the last block of the chain.
+func getTip(txn *badger.Txn) (*Block, error) {
+	item, err := txn.Get([]byte(defaultKey))
+	if err != nil {
+		return nil, err
+	}
+
+	lastHash, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
 	}
 
-	return Transaction{}, errors.New("transaction does not exist")
+	return getBlock(txn, lastHash)
 }
 
-func (bc *BlockChain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
-	prevTXs := make(map[string]Transaction)
+func blockKey(hash []byte) []byte {
+	return append(append([]byte{}, blockPrefix...), hash...)
+}
 
-	for _, in := range tx.Inputs {
-		prevTX, err := bc.FindTransaction(in.ID)
-		if err != nil {
-			log.Panicln("bc.FindTransaction failed on SignTransaction:", err)
-		}
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+func getBlock(txn *badger.Txn, hash []byte) (*Block, error) {
+	var block *Block
+
+	item, err := txn.Get(blockKey(hash))
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrBlockNotFound
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = item.Value(func(b []byte) error {
+		block, err = Deserialize(b)
+		return err
+	})
+
+	return block, err
+}
+
+func (bc *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
+	var tx Transaction
+
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		var err error
+		tx, err = getTransaction(txn, ID)
+		return err
+	})
 
-	tx.Sign(privKey, prevTXs)
+	return tx, err
 }
 
-func (bc *BlockChain) VerifyTransaction(tx *Transaction) bool {
+func (bc *BlockChain) findPrevTransactions(tx *Transaction) (map[string]Transaction, error) {
 	prevTXs := make(map[string]Transaction)
 
 	for _, in := range tx.Inputs {
 		prevTX, err := bc.FindTransaction(in.ID)
 		if err != nil {
-			log.Panicln("bc.FindTransaction failed on VerifyTransaction:", err)
+			return nil, err
 		}
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
 
-	return tx.Verify(prevTXs)
-}
\ No newline at end of file
+	return prevTXs, nil
+}
+
+func (bc *BlockChain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) error {
+	prevTXs, err := bc.findPrevTransactions(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Sign(privKey, prevTXs)
+}
+
+func (bc *BlockChain) VerifyTransaction(tx *Transaction) (bool, error) {
+	prevTXs, err := bc.findPrevTransactions(tx)
+	if err != nil {
+		return false, err
+	}
+
+	return tx.Verify(prevTXs), nil
+}
@@ -0,0 +1,80 @@
+package blockchain
+
+import (
+	"github.com/dgraph-io/badger/v3"
+	"testing"
+)
+
+// TestBlocksAreMovedUnderTheirPrefix opens a database that stores the
+// blocks under their bare hash, as older ones do.
+func TestBlocksAreMovedUnderTheirPrefix(t *testing.T) {
+	w, address := newTestWallet(t)
+	_, other := newTestWallet(t)
+	opts := testOptions(t)
+	chain := newTestChainWithOptions(t, address, opts)
+
+	mineBlocks(t, chain, address, 2)
+	tx := send(t, chain, w, other, 10, 0)
+	mineBlocks(t, chain, address, 1, tx)
+
+	var hashes [][]byte
+	iter := chain.Iterator()
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, block.Hash)
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		for _, hash := range hashes {
+			item, err := txn.Get(blockKey(hash))
+			if err != nil {
+				return err
+			}
+			data, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			err = txn.Set(hash, data)
+			if err != nil {
+				return err
+			}
+			err = txn.Delete(blockKey(hash))
+			if err != nil {
+				return err
+			}
+		}
+		return txn.Delete(blockKeysKey)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain = reopen(t, chain, opts)
+
+	for _, hash := range hashes {
+		_, err := chain.GetBlock(hash)
+		if err != nil {
+			t.Errorf("block %x: %v", hash, err)
+		}
+	}
+
+	err = chain.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(hashes[0])
+		return err
+	})
+	if err != badger.ErrKeyNotFound {
+		t.Errorf("block %x still stored under its bare hash: %v", hashes[0], err)
+	}
+
+	_, err = chain.FindTransaction(tx.ID)
+	if err != nil {
+		t.Errorf("transaction %x: %v", tx.ID, err)
+	}
+}
@@ -0,0 +1,43 @@
+package blockchain
+
+import "context"
+
+// Consensus decides who may add blocks to the chain and how they prove it.
+// A block is built by CreateBlock, then the engine prepares and seals it.
+// When a block is checked, the engine verifies its header against the
+// parent and then its seal.
+type Consensus interface {
+	// Prepare sets the consensus fields of a block about to be sealed on
+	// top of parent. parent is nil for the genesis block.
+	Prepare(chain *BlockChain, block, parent *Block) error
+	// VerifyHeader checks the consensus fields of the block against the
+	// ones expected on top of parent, which is nil for the genesis block.
+	VerifyHeader(chain *BlockChain, block, parent *Block) error
+	// Seal finishes the block, setting its hash. It stops with the context
+	// error once ctx is done.
+	Seal(ctx context.Context, block *Block) error
+	// VerifySeal checks the seal of the block on its own. It only looks at
+	// the header, so it also checks headers without their transactions.
+	VerifySeal(block *Block) error
+}
+
+// CheckSeal verifies the header of the block against its parent, and its
+// seal, with the consensus engine of the chain.
+func (bc *BlockChain) CheckSeal(block *Block) error {
+	var parent *Block
+
+	if len(block.PrevHash) != 0 {
+		var err error
+		parent, err = bc.GetBlock(block.PrevHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := bc.Consensus.VerifyHeader(bc, block, parent)
+	if err != nil {
+		return err
+	}
+
+	return bc.Consensus.VerifySeal(block)
+}
@@ -0,0 +1,89 @@
+package blockchain
+
+import (
+	"github.com/dgraph-io/badger/v3"
+	"math/big"
+)
+
+// NextTarget returns the target the block on top of prev must meet.
+func (bc *BlockChain) NextTarget(prev *Block) (*big.Int, error) {
+	var target *big.Int
+
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		var err error
+		target, err = bc.nextTarget(txn, prev)
+		return err
+	})
+
+	return target, err
+}
+
+// nextTarget keeps the target of prev, except on the first block of every
+// retarget interval. There the target is scaled by the time the previous
+// interval took over the time it should have taken, bounded by the
+// maximum adjustment factor and never easier than PowLimit.
+func (bc *BlockChain) nextTarget(txn *badger.Txn, prev *Block) (*big.Int, error) {
+	params := bc.Params
+	height := prev.Height + 1
+
+	if params.RetargetInterval <= 0 || height%params.RetargetInterval != 0 {
+		return prev.TargetInt(), nil
+	}
+
+	firstHeight := height - 1 - params.RetargetInterval
+	if firstHeight < 0 {
+		firstHeight = 0
+	}
+
+	first, err := getAncestor(txn, prev, firstHeight)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := int64(prev.Height-first.Height) * params.TargetBlockTime
+	actual := prev.Timestamp - first.Timestamp
+	if expected <= 0 {
+		return prev.TargetInt(), nil
+	}
+	if actual < 0 {
+		actual = 0
+	}
+
+	target := prev.TargetInt()
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+
+	if params.MaxAdjustmentFactor > 0 {
+		factor := big.NewInt(params.MaxAdjustmentFactor)
+
+		if minTarget := new(big.Int).Div(prev.TargetInt(), factor); target.Cmp(minTarget) < 0 {
+			target = minTarget
+		}
+		if maxTarget := new(big.Int).Mul(prev.TargetInt(), factor); target.Cmp(maxTarget) > 0 {
+			target = maxTarget
+		}
+	}
+
+	if target.Cmp(params.PowLimit) > 0 {
+		target.Set(params.PowLimit)
+	}
+	if target.Sign() == 0 {
+		target.SetInt64(1)
+	}
+
+	return target, nil
+}
+
+// getAncestor walks back from the block to its ancestor at the height,
+// through stored blocks or headers.
+func getAncestor(txn *badger.Txn, block *Block, height int) (*Block, error) {
+	for block.Height > height {
+		var err error
+		block, err = getHeader(txn, block.PrevHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return block, nil
+}
@@ -0,0 +1,202 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"github.com/dgraph-io/badger/v3"
+	"math/big"
+	"testing"
+)
+
+var retargetParams = ChainParams{
+	AddressVersion:      RegtestChainParams.AddressVersion,
+	PowLimit:            TargetForBits(8),
+	RetargetInterval:    10,
+	TargetBlockTime:     10,
+	MaxAdjustmentFactor: 4,
+}
+
+// storeHeaders stores a chain of bare headers on top of the genesis block of
+// the chain, one per timestamp, all with the target. It returns the last
+// one.
+func storeHeaders(t *testing.T, chain *BlockChain, target *big.Int, timestamps ...int64) *Block {
+	t.Helper()
+
+	prev, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = chain.Database.Update(func(txn *badger.Txn) error {
+		for _, timestamp := range timestamps {
+			header := &BlockHeader{
+				Version:   BlockVersion,
+				Height:    prev.Height + 1,
+				Timestamp: timestamp,
+				PrevHash:  prev.Hash,
+				Target:    target.Bytes(),
+			}
+			hash := sha256.Sum256(header.Serialize())
+			header.Hash = hash[:]
+
+			err := txn.Set(headerKey(header.Hash), header.Serialize())
+			if err != nil {
+				return err
+			}
+			prev = header.block()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return prev
+}
+
+// evenTimestamps returns n timestamps after start, step seconds apart.
+func evenTimestamps(start int64, n int, step int64) []int64 {
+	var timestamps []int64
+	for i := 1; i <= n; i++ {
+		timestamps = append(timestamps, start+int64(i)*step)
+	}
+	return timestamps
+}
+
+func TestNextTarget(t *testing.T) {
+	limit := retargetParams.PowLimit
+	quarter := new(big.Int).Div(limit, big.NewInt(4))
+	sixteenth := new(big.Int).Div(limit, big.NewInt(16))
+
+	tests := []struct {
+		name   string
+		params func(*ChainParams)
+		target *big.Int
+		// timestamps of the blocks after the genesis block.
+		timestamps []int64
+		want       *big.Int
+	}{
+		{
+			name:       "no retarget before the interval ends",
+			target:     quarter,
+			timestamps: evenTimestamps(testGenesisTimestamp, 8, 1000),
+			want:       quarter,
+		},
+		{
+			name:       "no retarget in the middle of an interval",
+			target:     quarter,
+			timestamps: evenTimestamps(testGenesisTimestamp, 14, 1),
+			want:       quarter,
+		},
+		{
+			name:       "blocks on time keep the target",
+			target:     quarter,
+			timestamps: evenTimestamps(testGenesisTimestamp, 9, 10),
+			want:       quarter,
+		},
+		{
+			name:       "blocks twice as fast halve the target",
+			target:     quarter,
+			timestamps: evenTimestamps(testGenesisTimestamp, 9, 5),
+			want:       new(big.Int).Div(quarter, big.NewInt(2)),
+		},
+		{
+			name:       "blocks twice as slow double the target",
+			target:     sixteenth,
+			timestamps: evenTimestamps(testGenesisTimestamp, 9, 20),
+			want:       new(big.Int).Mul(sixteenth, big.NewInt(2)),
+		},
+		{
+			name:       "instant blocks are clamped to the factor",
+			target:     quarter,
+			timestamps: evenTimestamps(testGenesisTimestamp, 9, 0),
+			want:       new(big.Int).Div(quarter, big.NewInt(4)),
+		},
+		{
+			name:       "timestamps going back are clamped to the factor",
+			target:     quarter,
+			timestamps: evenTimestamps(testGenesisTimestamp, 9, -10),
+			want:       new(big.Int).Div(quarter, big.NewInt(4)),
+		},
+		{
+			name:       "slow blocks are clamped to the factor",
+			target:     new(big.Int).Div(limit, big.NewInt(64)),
+			timestamps: evenTimestamps(testGenesisTimestamp, 9, 1000),
+			want:       sixteenth,
+		},
+		{
+			name:       "slow blocks never go above the limit",
+			target:     quarter,
+			timestamps: evenTimestamps(testGenesisTimestamp, 9, 1000),
+			want:       limit,
+		},
+		{
+			name:       "the second interval starts after the first",
+			target:     quarter,
+			timestamps: append(evenTimestamps(testGenesisTimestamp, 9, 1000), evenTimestamps(testGenesisTimestamp+9000, 10, 5)...),
+			want:       new(big.Int).Div(quarter, big.NewInt(2)),
+		},
+		{
+			name:       "without retargeting the target never changes",
+			params:     func(p *ChainParams) { p.RetargetInterval = 0 },
+			target:     quarter,
+			timestamps: evenTimestamps(testGenesisTimestamp, 9, 0),
+			want:       quarter,
+		},
+		{
+			name:       "without a factor the adjustment is not clamped",
+			params:     func(p *ChainParams) { p.MaxAdjustmentFactor = 0 },
+			target:     quarter,
+			timestamps: evenTimestamps(testGenesisTimestamp, 9, 1),
+			want:       new(big.Int).Div(quarter, big.NewInt(10)),
+		},
+		{
+			name:       "the target never reaches zero",
+			target:     big.NewInt(1),
+			timestamps: evenTimestamps(testGenesisTimestamp, 9, 0),
+			want:       big.NewInt(1),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, address := newTestWallet(t)
+			chain := newTestChain(t, address)
+
+			chain.Params = retargetParams
+			if test.params != nil {
+				test.params(&chain.Params)
+			}
+
+			prev := storeHeaders(t, chain, test.target, test.timestamps...)
+
+			got, err := chain.NextTarget(prev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Cmp(test.want) != 0 {
+				t.Errorf("NextTarget() = %x, want %x", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDifficulty(t *testing.T) {
+	limit := retargetParams.PowLimit
+
+	tests := []struct {
+		target *big.Int
+		want   float64
+	}{
+		{limit, 1},
+		{new(big.Int).Div(limit, big.NewInt(4)), 4},
+		{new(big.Int).Mul(limit, big.NewInt(2)), 0.5},
+		{big.NewInt(0), 0},
+		{big.NewInt(-1), 0},
+	}
+
+	for _, test := range tests {
+		if got := retargetParams.Difficulty(test.target); got != test.want {
+			t.Errorf("Difficulty(%x) = %v, want %v", test.target, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,594 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"github.com/dgraph-io/badger/v3"
+	"log"
+	"math/big"
+	"sort"
+)
+
+var (
+	chainWorkPrefix    = []byte("work-")
+	chainTipPrefix     = []byte("tip-")
+	invalidBlockPrefix = []byte("invalid-")
+	// reorgKey holds the tip a reorganization is moving the chain onto,
+	// while it runs.
+	reorgKey = []byte("reorg")
+
+	ErrBlockKnown    = errors.New("block is already stored")
+	ErrUnknownParent = errors.New("parent block is not stored")
+	ErrInvalidBranch = errors.New("block descends from an invalid block")
+)
+
+// Statuses of a ChainTip.
+const (
+	// TipActive is the tip of the active chain.
+	TipActive = "active"
+	// TipValidFork ends a side branch whose headers and seals are valid. Its
+	// transactions are only checked if it becomes the active chain.
+	TipValidFork = "valid-fork"
+	// TipInvalid ends a side branch with an invalid block.
+	TipInvalid = "invalid"
+)
+
+// ChainTip is the last block of a branch of the stored blocks.
+type ChainTip struct {
+	Hash   []byte
+	Height int
+	// BranchLen is the number of blocks of the branch out of the active
+	// chain, zero for the active tip.
+	BranchLen int
+	// Work is the total work of the chain from genesis to the tip.
+	Work   *big.Int
+	Status string
+}
+
+func chainWorkKey(hash []byte) []byte {
+	return append(append([]byte{}, chainWorkPrefix...), hash...)
+}
+
+func chainTipKey(hash []byte) []byte {
+	return append(append([]byte{}, chainTipPrefix...), hash...)
+}
+
+func invalidBlockKey(hash []byte) []byte {
+	return append(append([]byte{}, invalidBlockPrefix...), hash...)
+}
+
+// blockWork is the expected number of hashes needed to meet the target of
+// the block. Blocks without a target, sealed by proof of authority, count as
+// one, so the longest chain has the most work.
+func blockWork(block *Block) *big.Int {
+	if len(block.Target) == 0 {
+		return big.NewInt(1)
+	}
+
+	work := new(big.Int).Lsh(big.NewInt(1), 256)
+	return work.Div(work, new(big.Int).Add(block.TargetInt(), big.NewInt(1)))
+}
+
+// chainWork returns the total work of the chain ending at the block or
+// header. Blocks stored before their work was recorded get it summed from
+// their ancestors.
+func chainWork(txn *badger.Txn, block *Block) (*big.Int, error) {
+	work := new(big.Int)
+
+	for {
+		item, err := txn.Get(chainWorkKey(block.Hash))
+		if err == nil {
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return nil, err
+			}
+			return work.Add(work, new(big.Int).SetBytes(v)), nil
+		}
+		if err != badger.ErrKeyNotFound {
+			return nil, err
+		}
+
+		work.Add(work, blockWork(block))
+		if len(block.PrevHash) == 0 {
+			return work, nil
+		}
+
+		block, err = getHeader(txn, block.PrevHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// storeBlock writes the block, with the total work of its chain, and makes
+// it the tip of its branch in place of its parent. It returns that work.
+func storeBlock(txn *badger.Txn, block *Block) (*big.Int, error) {
+	work := blockWork(block)
+
+	if len(block.PrevHash) != 0 {
+		parent, err := getBlock(txn, block.PrevHash)
+		if err != nil {
+			return nil, err
+		}
+
+		parentWork, err := chainWork(txn, parent)
+		if err != nil {
+			return nil, err
+		}
+		work.Add(work, parentWork)
+
+		err = txn.Delete(chainTipKey(parent.Hash))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := txn.Set(blockKey(block.Hash), block.Serialize())
+	if err != nil {
+		return nil, err
+	}
+
+	err = txn.Set(chainWorkKey(block.Hash), work.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	// The block replaces its header, when it was downloaded first.
+	err = txn.Delete(headerKey(block.Hash))
+	if err != nil {
+		return nil, err
+	}
+
+	err = updateHeaderTip(txn, block, work)
+	if err != nil {
+		return nil, err
+	}
+
+	return work, txn.Set(chainTipKey(block.Hash), []byte{})
+}
+
+func isInvalidBlock(txn *badger.Txn, hash []byte) (bool, error) {
+	_, err := txn.Get(invalidBlockKey(hash))
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// inActiveChain tells if the block is part of the chain ending at the tip.
+func inActiveChain(txn *badger.Txn, block *Block) (bool, error) {
+	item, err := txn.Get(heightIndexKey(block.Height))
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	hash, err := item.ValueCopy(nil)
+	return bytes.Equal(hash, block.Hash), err
+}
+
+// ProcessBlock stores a sealed block built elsewhere, on top of any stored
+// block. When its branch ends up with more work than the active chain, the
+// chain is reorganized onto it: the blocks of the old branch are
+// disconnected down to the fork point and the ones of the new branch
+// connected, their transactions validated against the UTXO set. The block
+// is stored first, so it is kept even when the reorganization fails. A
+// branch with an invalid block is kept out of the active chain and the error
+// is a *ChainVerifyError for that block.
+func (bc *BlockChain) ProcessBlock(block *Block) error {
+	var parent *Block
+
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(blockKey(block.Hash))
+		if err == nil {
+			return ErrBlockKnown
+		}
+		if err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		// Every chain starts at its own genesis block, so a block without a
+		// parent is never accepted.
+		parent, err = getBlock(txn, block.PrevHash)
+		if err == ErrBlockNotFound {
+			return ErrUnknownParent
+		}
+		if err != nil {
+			return err
+		}
+
+		invalid, err := isInvalidBlock(txn, parent.Hash)
+		if err == nil && invalid {
+			err = ErrInvalidBranch
+		}
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	err = bc.checkHeader(block, parent)
+	if err != nil {
+		return &ChainVerifyError{block.Hash, block.Height, err}
+	}
+
+	reorg := false
+
+	err = bc.Database.Update(func(txn *badger.Txn) error {
+		tip, err := getTip(txn)
+		if err != nil {
+			return err
+		}
+
+		tipWork, err := chainWork(txn, tip)
+		if err != nil {
+			return err
+		}
+
+		work, err := storeBlock(txn, block)
+		if err != nil {
+			return err
+		}
+
+		if work.Cmp(tipWork) <= 0 {
+			return nil
+		}
+
+		reorg = true
+		return txn.Set(reorgKey, block.Hash)
+	})
+
+	if err != nil || !reorg {
+		return err
+	}
+
+	return bc.reorganize(block.Hash)
+}
+
+// reorgPath returns the blocks to disconnect from the tip down to the fork
+// point with the branch of target, the tip first, and the ones to connect
+// from there up to target.
+func reorgPath(txn *badger.Txn, target []byte) ([]*Block, []*Block, error) {
+	var disconnect, connect []*Block
+
+	old, err := getTip(txn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	branch, err := getBlock(txn, target)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for !bytes.Equal(old.Hash, branch.Hash) {
+		if branch.Height > old.Height {
+			connect = append([]*Block{branch}, connect...)
+			branch, err = getBlock(txn, branch.PrevHash)
+		} else {
+			disconnect = append(disconnect, old)
+			old, err = getBlock(txn, old.PrevHash)
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return disconnect, connect, nil
+}
+
+// reorganize moves the tip of the chain onto target. The blocks of the old
+// branch are disconnected down to the fork point, then the ones of the new
+// branch are validated and connected, each block in its own database
+// transaction so that deep reorganizations fit in badger's limits. reorgKey
+// holds the target meanwhile, and a reorganization cut short is finished
+// when the chain is opened again.
+//
+// An invalid block of the new branch is marked, and the chain moves back to
+// the valid branch with the most work. The error is then a
+// *ChainVerifyError for that block. The transactions of the disconnected
+// blocks go back to the mempool when still valid.
+func (bc *BlockChain) reorganize(target []byte) error {
+	var disconnected []*Transaction
+	var verifyErr error
+
+	// The chain goes back to where it was when the new branch is invalid,
+	// unless another valid branch has more work.
+	var start []byte
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		tip, err := getTip(txn)
+		if err != nil {
+			return err
+		}
+		start = tip.Hash
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		var disconnect, connect []*Block
+
+		err := bc.Database.View(func(txn *badger.Txn) error {
+			var err error
+			disconnect, connect, err = reorgPath(txn, target)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, block := range disconnect {
+			err := bc.Database.Update(func(txn *badger.Txn) error {
+				return bc.disconnectBlock(txn, block)
+			})
+			if err != nil {
+				return err
+			}
+
+			bc.LastHash = block.PrevHash
+			disconnected = append(append([]*Transaction{}, block.Transactions...), disconnected...)
+		}
+
+		err = bc.connectBranch(connect)
+
+		var invalid *ChainVerifyError
+		if !errors.As(err, &invalid) {
+			if err != nil {
+				return err
+			}
+			break
+		}
+
+		if verifyErr == nil {
+			verifyErr = err
+		}
+
+		err = bc.Database.Update(func(txn *badger.Txn) error {
+			err := txn.Set(invalidBlockKey(invalid.BlockHash), []byte{})
+			if err != nil {
+				return err
+			}
+
+			target, err = bestValidTip(txn, start)
+			if err != nil {
+				return err
+			}
+			return txn.Set(reorgKey, target)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = bc.Database.Update(func(txn *badger.Txn) error {
+		if verifyErr != nil {
+			err := resetHeaderTip(txn)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(disconnected) > 0 {
+			err := Mempool{bc}.reset(txn, disconnected)
+			if err != nil {
+				return err
+			}
+		}
+
+		return txn.Delete(reorgKey)
+	})
+	if err != nil {
+		return err
+	}
+
+	return verifyErr
+}
+
+// connectBranch validates and connects the blocks on top of the tip, in
+// order. A *ChainVerifyError reports the first invalid one.
+func (bc *BlockChain) connectBranch(blocks []*Block) error {
+	for _, block := range blocks {
+		err := bc.Database.Update(func(txn *badger.Txn) error {
+			invalid, err := isInvalidBlock(txn, block.Hash)
+			if err != nil {
+				return err
+			}
+			if invalid {
+				return &ChainVerifyError{block.Hash, block.Height, ErrInvalidBranch}
+			}
+
+			err = bc.validateTransactions(txn, block.Transactions, block.Height)
+			if err != nil {
+				return &ChainVerifyError{block.Hash, block.Height, err}
+			}
+
+			return bc.connectBlock(txn, block)
+		})
+		if err != nil {
+			return err
+		}
+
+		bc.LastHash = block.Hash
+	}
+
+	return nil
+}
+
+// bestValidTip returns the block with the most work among preferred, the
+// current tip and the tips of the branches without an invalid block.
+// preferred wins a tie, like the active chain does against a new branch.
+func bestValidTip(txn *badger.Txn, preferred []byte) ([]byte, error) {
+	tip, err := getTip(txn)
+	if err != nil {
+		return nil, err
+	}
+
+	best := preferred
+	block, err := getBlock(txn, preferred)
+	if err != nil {
+		return nil, err
+	}
+	bestWork, err := chainWork(txn, block)
+	if err != nil {
+		return nil, err
+	}
+
+	tipWork, err := chainWork(txn, tip)
+	if err != nil {
+		return nil, err
+	}
+	if tipWork.Cmp(bestWork) > 0 {
+		best, bestWork = tip.Hash, tipWork
+	}
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = chainTipPrefix
+	opts.PrefetchValues = false
+
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		candidate, err := chainTip(txn, it.Item().KeyCopy(nil)[len(chainTipPrefix):])
+		if err != nil {
+			return nil, err
+		}
+
+		if candidate.Status != TipInvalid && candidate.Work.Cmp(bestWork) > 0 {
+			best, bestWork = candidate.Hash, candidate.Work
+		}
+	}
+
+	return best, nil
+}
+
+// finishReorganization moves the chain onto the target of a reorganization
+// cut short, which left the tip between two branches.
+func (bc *BlockChain) finishReorganization() error {
+	var target []byte
+
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(reorgKey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target, err = item.ValueCopy(nil)
+		return err
+	})
+	if err != nil || target == nil {
+		return err
+	}
+
+	log.Println("Finishing the interrupted reorganization of the chain")
+
+	err = bc.reorganize(target)
+
+	var verifyErr *ChainVerifyError
+	if errors.As(err, &verifyErr) {
+		log.Printf("Reorganization stopped at an invalid block: %v", err)
+		return nil
+	}
+	return err
+}
+
+// ChainTips lists the tip of every branch of the stored blocks, the active
+// one first and then by height.
+func (bc *BlockChain) ChainTips() ([]ChainTip, error) {
+	var tips []ChainTip
+
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		active, err := getTip(txn)
+		if err != nil {
+			return err
+		}
+
+		hashes := [][]byte{active.Hash}
+
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = chainTipPrefix
+		opts.PrefetchValues = false
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			hash := it.Item().KeyCopy(nil)[len(chainTipPrefix):]
+			if !bytes.Equal(hash, active.Hash) {
+				hashes = append(hashes, hash)
+			}
+		}
+
+		for _, hash := range hashes {
+			tip, err := chainTip(txn, hash)
+			if err != nil {
+				return err
+			}
+			tips = append(tips, tip)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(tips[1:], func(i, j int) bool {
+		return tips[1+i].Height > tips[1+j].Height
+	})
+
+	return tips, nil
+}
+
+func chainTip(txn *badger.Txn, hash []byte) (ChainTip, error) {
+	tip := ChainTip{Hash: hash, Status: TipActive}
+
+	block, err := getBlock(txn, hash)
+	if err != nil {
+		return tip, err
+	}
+	tip.Height = block.Height
+
+	tip.Work, err = chainWork(txn, block)
+	if err != nil {
+		return tip, err
+	}
+
+	for {
+		active, err := inActiveChain(txn, block)
+		if err != nil {
+			return tip, err
+		}
+		if active {
+			return tip, nil
+		}
+
+		tip.BranchLen++
+		if tip.Status == TipActive {
+			tip.Status = TipValidFork
+		}
+
+		invalid, err := isInvalidBlock(txn, block.Hash)
+		if err != nil {
+			return tip, err
+		}
+		if invalid {
+			tip.Status = TipInvalid
+		}
+
+		block, err = getBlock(txn, block.PrevHash)
+		if err != nil {
+			return tip, err
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/dgraph-io/badger/v3"
+	"go-blockchain/wallet"
+	"testing"
+)
+
+// forkChains returns two chains with the same genesis block, paying the
+// wallet, whose later blocks will differ: side mines to another address.
+func forkChains(t *testing.T) (*wallet.Wallet, string, *BlockChain, *BlockChain, string) {
+	t.Helper()
+
+	w, address := newTestWallet(t)
+	_, other := newTestWallet(t)
+
+	chain := newTestChain(t, address)
+	side := newTestChain(t, address)
+	if !bytes.Equal(chain.LastHash, side.LastHash) {
+		t.Fatal("the chains have different genesis blocks")
+	}
+
+	return w, address, chain, side, other
+}
+
+func processBlocks(t *testing.T, chain *BlockChain, blocks []*Block) {
+	t.Helper()
+
+	for _, block := range blocks {
+		err := chain.ProcessBlock(block)
+		if err != nil {
+			t.Fatalf("ProcessBlock(%d) = %v", block.Height, err)
+		}
+	}
+}
+
+// checkActiveChain checks that the blocks are the active chain from height
+// 1, up to the tip.
+func checkActiveChain(t *testing.T, chain *BlockChain, blocks []*Block) {
+	t.Helper()
+
+	tip := blocks[len(blocks)-1]
+	if !bytes.Equal(chain.LastHash, tip.Hash) {
+		t.Fatalf("tip is %x, want %x", chain.LastHash, tip.Hash)
+	}
+
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height != tip.Height {
+		t.Errorf("best height is %d, want %d", height, tip.Height)
+	}
+
+	for _, block := range blocks {
+		hash, err := chain.GetBlockHashByHeight(block.Height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(hash, block.Hash) {
+			t.Errorf("block at height %d is %x, want %x", block.Height, hash, block.Hash)
+		}
+
+		for _, tx := range block.Transactions {
+			loc, err := chain.FindTransactionLocation(tx.ID)
+			if err != nil {
+				t.Fatalf("transaction %x of block %d: %v", tx.ID, block.Height, err)
+			}
+			if !bytes.Equal(loc.BlockHash, block.Hash) {
+				t.Errorf("transaction %x is indexed in block %x, want %x", tx.ID, loc.BlockHash, block.Hash)
+			}
+		}
+	}
+}
+
+// checkUTXOSetIsReindexed checks that the UTXO set is the one Reindex
+// rebuilds from the active chain.
+func checkUTXOSetIsReindexed(t *testing.T, chain *BlockChain) {
+	t.Helper()
+
+	before := utxoSnapshot(t, chain)
+
+	err := UTXOSet{chain}.Reindex()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := utxoSnapshot(t, chain)
+	if len(before) != len(after) {
+		t.Fatalf("UTXO set has %d outputs, %d after reindexing", len(before), len(after))
+	}
+	for key, value := range after {
+		if before[key] != value {
+			t.Errorf("output %x is %d, %d after reindexing", key, before[key], value)
+		}
+	}
+}
+
+func TestProcessBlockFollowsTheMostWork(t *testing.T) {
+	_, address, chain, side, other := forkChains(t)
+
+	mainBlocks := mineBlocks(t, chain, address, 2)
+	sideBlocks := mineBlocks(t, side, other, 3)
+
+	// A branch with less or the same work stays on the side.
+	processBlocks(t, chain, sideBlocks[:2])
+	checkActiveChain(t, chain, mainBlocks)
+
+	tips, err := chain.ChainTips()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tips) != 2 || tips[1].Status != TipValidFork || !bytes.Equal(tips[1].Hash, sideBlocks[1].Hash) {
+		t.Fatalf("ChainTips() = %+v, want the side branch as a valid fork", tips)
+	}
+	if tips[0].Work.Cmp(tips[1].Work) != 0 {
+		t.Errorf("branches of the same length have work %v and %v", tips[0].Work, tips[1].Work)
+	}
+
+	// One more block gives the side branch the most work.
+	processBlocks(t, chain, sideBlocks[2:])
+	checkActiveChain(t, chain, sideBlocks)
+
+	for _, block := range mainBlocks {
+		_, err := chain.FindTransactionLocation(block.Transactions[0].ID)
+		if !errors.Is(err, ErrTxNotFound) {
+			t.Errorf("coinbase of the disconnected block %d: %v, want %v", block.Height, err, ErrTxNotFound)
+		}
+	}
+
+	tips, err = chain.ChainTips()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tips) != 2 || !bytes.Equal(tips[0].Hash, sideBlocks[2].Hash) || tips[1].BranchLen != 2 {
+		t.Errorf("ChainTips() = %+v, want the old chain as a fork of 2 blocks", tips)
+	}
+
+	checkUTXOSetIsReindexed(t, chain)
+
+	// Mining goes on from the new tip, and the whole chain stays valid.
+	mineBlocks(t, chain, address, 1)
+	if err := chain.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReorganizationMovesTransactionsBackToTheMempool(t *testing.T) {
+	w, address, chain, side, other := forkChains(t)
+
+	tx := send(t, chain, w, other, 30, 2)
+	mainBlocks := mineBlocks(t, chain, address, 1, tx)
+
+	sideBlocks := mineBlocks(t, side, other, 2)
+	processBlocks(t, chain, sideBlocks)
+	checkActiveChain(t, chain, sideBlocks)
+
+	_, err := chain.FindTransactionLocation(tx.ID)
+	if !errors.Is(err, ErrTxNotFound) {
+		t.Errorf("FindTransactionLocation() = %v, want %v", err, ErrTxNotFound)
+	}
+
+	pending, err := Mempool{chain}.Transactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || !bytes.Equal(pending[0].ID, tx.ID) {
+		t.Fatalf("mempool holds %d transactions, want the one of the disconnected block", len(pending))
+	}
+
+	// The coinbase of the disconnected block can't be mined again.
+	_, err = Mempool{chain}.Get(mainBlocks[0].Transactions[0].ID)
+	if err == nil {
+		t.Error("the disconnected coinbase is in the mempool")
+	}
+
+	checkUTXOSetIsReindexed(t, chain)
+
+	// The transaction is mined again on the new chain.
+	block := mineBlocks(t, chain, address, 1, pending...)[0]
+	loc, err := chain.FindTransactionLocation(tx.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loc.BlockHash, block.Hash) {
+		t.Errorf("transaction mined in %x, want %x", loc.BlockHash, block.Hash)
+	}
+}
+
+// TestReorganizationDropsTransactionsSpentByTheNewChain checks that a
+// transaction of the old chain does not go back to the mempool when the new
+// chain spends its inputs.
+func TestReorganizationDropsTransactionsSpentByTheNewChain(t *testing.T) {
+	w, address, chain, side, other := forkChains(t)
+
+	first := send(t, chain, w, other, 30, 0)
+	mineBlocks(t, chain, address, 1, first)
+
+	second := send(t, side, w, address, 40, 0)
+	sideBlocks := mineBlocks(t, side, other, 2, second)
+
+	processBlocks(t, chain, sideBlocks)
+	checkActiveChain(t, chain, sideBlocks)
+
+	count, err := Mempool{chain}.Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("mempool holds %d transactions, want none", count)
+	}
+
+	checkUTXOSetIsReindexed(t, chain)
+}
+
+// TestReorganizationToAnInvalidBranchIsUndone checks that a branch with the
+// most work but an invalid transaction leaves the chain as it was.
+func TestReorganizationToAnInvalidBranchIsUndone(t *testing.T) {
+	w, address, chain, side, other := forkChains(t)
+
+	tx := send(t, chain, w, other, 30, 2)
+	mainBlocks := mineBlocks(t, chain, address, 1, tx)
+	before := utxoSnapshot(t, chain)
+
+	// The side branch spends an output that does not exist, which only
+	// shows when its transactions are connected.
+	sideBlocks := mineBlocks(t, side, other, 1)
+	bad := send(t, side, w, other, 10, 0)
+	bad.Inputs[0].Out = 7
+	bad.ID = bad.unsignedHash()
+
+	block, tip := nextBlock(t, side, other, bad)
+	sealBlock(t, side, block, tip)
+	sideBlocks = append(sideBlocks, block)
+
+	processBlocks(t, chain, sideBlocks[:1])
+
+	err := chain.ProcessBlock(block)
+	var verifyErr *ChainVerifyError
+	if !errors.As(err, &verifyErr) || !errors.Is(err, ErrUnknownInput) {
+		t.Fatalf("ProcessBlock() = %v, want a *ChainVerifyError for %v", err, ErrUnknownInput)
+	}
+	if !bytes.Equal(verifyErr.BlockHash, block.Hash) {
+		t.Errorf("ProcessBlock() reported %x, want %x", verifyErr.BlockHash, block.Hash)
+	}
+
+	checkActiveChain(t, chain, mainBlocks)
+
+	after := utxoSnapshot(t, chain)
+	if len(before) != len(after) {
+		t.Errorf("UTXO set has %d outputs, %d before", len(after), len(before))
+	}
+	for key, value := range before {
+		if after[key] != value {
+			t.Errorf("output %x is %d, %d before", key, after[key], value)
+		}
+	}
+
+	tips, err := chain.ChainTips()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tips) != 2 || tips[1].Status != TipInvalid {
+		t.Errorf("ChainTips() = %+v, want the side branch as invalid", tips)
+	}
+
+	// Blocks on top of the invalid one are refused at once.
+	next, _ := nextBlock(t, side, other)
+	next.PrevHash, next.Height = block.Hash, block.Height+1
+	sealBlock(t, side, next, block)
+	err = chain.ProcessBlock(next)
+	if !errors.Is(err, ErrInvalidBranch) {
+		t.Errorf("ProcessBlock() on the invalid branch = %v, want %v", err, ErrInvalidBranch)
+	}
+}
+
+// TestDeepReorganization checks that a reorganization larger than a single
+// database transaction may hold goes through.
+func TestDeepReorganization(t *testing.T) {
+	_, address, chain, side, other := forkChains(t)
+
+	// Transactions of a small memtable hold about a hundred writes, less
+	// than the whole reorganization makes.
+	dir := chain.Database.Opts().Dir
+	err := chain.Database.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.Database, err = badger.Open(badger.DefaultOptions(dir).WithMemTableSize(1 << 16).WithValueThreshold(1 << 10).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mineBlocks(t, chain, address, 40)
+	sideBlocks := mineBlocks(t, side, other, 41)
+	processBlocks(t, chain, sideBlocks)
+
+	checkActiveChain(t, chain, sideBlocks)
+	checkUTXOSetIsReindexed(t, chain)
+	if err := chain.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestInterruptedReorganizationIsFinished checks that a chain left between
+// two branches is moved onto the new one when it is opened again.
+func TestInterruptedReorganizationIsFinished(t *testing.T) {
+	_, address := newTestWallet(t)
+	_, other := newTestWallet(t)
+	opts := testOptions(t)
+	chain := newTestChainWithOptions(t, address, opts)
+	side := newTestChain(t, address)
+
+	mainBlocks := mineBlocks(t, chain, address, 2)
+	sideBlocks := mineBlocks(t, side, other, 3)
+	processBlocks(t, chain, sideBlocks[:2])
+
+	// The last block was stored and one block of the old branch
+	// disconnected when the node stopped.
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		_, err := storeBlock(txn, sideBlocks[2])
+		if err != nil {
+			return err
+		}
+		err = txn.Set(reorgKey, sideBlocks[2].Hash)
+		if err != nil {
+			return err
+		}
+		return chain.disconnectBlock(txn, mainBlocks[1])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain = reopen(t, chain, opts)
+	checkActiveChain(t, chain, sideBlocks)
+	checkUTXOSetIsReindexed(t, chain)
+
+	err = chain.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(reorgKey)
+		return err
+	})
+	if err != badger.ErrKeyNotFound {
+		t.Errorf("reorganization marker after finishing it: %v, want %v", err, badger.ErrKeyNotFound)
+	}
+}
+
+func TestProcessBlockRejectsKnownAndOrphanBlocks(t *testing.T) {
+	_, address, chain, side, other := forkChains(t)
+
+	blocks := mineBlocks(t, chain, address, 1)
+	err := chain.ProcessBlock(blocks[0])
+	if !errors.Is(err, ErrBlockKnown) {
+		t.Errorf("ProcessBlock() of a known block = %v, want %v", err, ErrBlockKnown)
+	}
+
+	sideBlocks := mineBlocks(t, side, other, 2)
+	err = chain.ProcessBlock(sideBlocks[1])
+	if !errors.Is(err, ErrUnknownParent) {
+		t.Errorf("ProcessBlock() of an orphan = %v, want %v", err, ErrUnknownParent)
+	}
+}
+
+// TestSealedBlockAfterTheTipChanged checks that a block sealed by SealBlock
+// while another block became the tip ends up on a side branch.
+func TestSealedBlockAfterTheTipChanged(t *testing.T) {
+	_, address := newTestWallet(t)
+	chain := newTestChain(t, address)
+
+	block, err := chain.SealBlock(context.Background(), address, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.GetBlock(block.Hash); !errors.Is(err, ErrBlockNotFound) {
+		t.Fatalf("GetBlock() of a sealed block = %v, want %v", err, ErrBlockNotFound)
+	}
+
+	mined := mineBlocks(t, chain, address, 1)
+
+	processBlocks(t, chain, []*Block{block})
+	checkActiveChain(t, chain, mined)
+
+	tips, err := chain.ChainTips()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tips) != 2 || !bytes.Equal(tips[1].Hash, block.Hash) {
+		t.Errorf("ChainTips() = %+v, want the sealed block as a fork", tips)
+	}
+}
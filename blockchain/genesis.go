@@ -0,0 +1,246 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/dgraph-io/badger/v3"
+	"io/ioutil"
+)
+
+const (
+	genesisConfigKey      = "genesis-config"
+	defaultGenesisMessage = "First Transaction from Genesis"
+
+	EnginePoW = "pow"
+	EnginePoA = "poa"
+)
+
+// GenesisConfig describes how a new chain starts. It is stored with the
+// chain, so every later run follows the same rules.
+type GenesisConfig struct {
+	// Hash is the hex encoded hash the genesis block must have. Chains with
+	// another genesis block are refused. The same configuration, address and
+	// Timestamp always give the same genesis block.
+	Hash string `json:"hash,omitempty"`
+	// Address receives the subsidy of the genesis block. When empty, the
+	// address given to InitBlockChain receives it.
+	Address string `json:"address,omitempty"`
+	// Message is the data of the genesis coinbase transaction.
+	Message string `json:"message,omitempty"`
+	// Timestamp of the genesis block, in Unix seconds. Zero uses the time the
+	// chain is created.
+	Timestamp int64 `json:"timestamp,omitempty"`
+	// Difficulty is the number of leading zero bits of the genesis target,
+	// which becomes the PowLimit of the chain. Zero keeps the one of the
+	// network.
+	Difficulty int `json:"difficulty,omitempty"`
+	// Allocations premine coins in the genesis coinbase, besides the subsidy.
+	// They are not bounded by the MaxSupply of the network.
+	Allocations []Allocation    `json:"allocations,omitempty"`
+	Consensus   ConsensusConfig `json:"consensus"`
+}
+
+type Allocation struct {
+	Address string `json:"address"`
+	Value   int    `json:"value"`
+}
+
+type ConsensusConfig struct {
+	// Engine is EnginePoW, the default, or EnginePoA.
+	Engine string `json:"engine,omitempty"`
+	// Signers are the hex encoded wallet public keys allowed to seal blocks
+	// under proof of authority, in turn order.
+	Signers []string `json:"signers,omitempty"`
+	// The proof of work retargeting rules. Zero keeps the ones of the
+	// network.
+	RetargetInterval    int   `json:"retargetInterval,omitempty"`
+	TargetBlockTime     int64 `json:"targetBlockTime,omitempty"`
+	MaxAdjustmentFactor int64 `json:"maxAdjustmentFactor,omitempty"`
+}
+
+// LoadGenesisConfig reads a JSON genesis configuration file.
+func LoadGenesisConfig(path string) (GenesisConfig, error) {
+	var config GenesisConfig
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return config, fmt.Errorf("parsing genesis config: %w", err)
+	}
+
+	return config, config.validate()
+}
+
+func (c GenesisConfig) validate() error {
+	if _, err := hex.DecodeString(c.Hash); err != nil {
+		return fmt.Errorf("invalid genesis hash %q: %v", c.Hash, err)
+	}
+
+	if c.Difficulty < 0 || c.Difficulty > 255 {
+		return fmt.Errorf("invalid genesis difficulty %d", c.Difficulty)
+	}
+
+	for _, alloc := range c.Allocations {
+		if alloc.Value <= 0 || alloc.Value > MaxMoney {
+			return fmt.Errorf("allocation to %s: %w", alloc.Address, ErrInvalidOutputValue)
+		}
+	}
+
+	_, err := c.Consensus.engine(MiningOptions{})
+	return err
+}
+
+// params applies the configuration on top of the parameters of the network.
+func (c GenesisConfig) params(params ChainParams) ChainParams {
+	if c.Difficulty > 0 {
+		params.PowLimit = TargetForBits(c.Difficulty)
+	}
+	if c.Consensus.RetargetInterval > 0 {
+		params.RetargetInterval = c.Consensus.RetargetInterval
+	}
+	if c.Consensus.TargetBlockTime > 0 {
+		params.TargetBlockTime = c.Consensus.TargetBlockTime
+	}
+	if c.Consensus.MaxAdjustmentFactor > 0 {
+		params.MaxAdjustmentFactor = c.Consensus.MaxAdjustmentFactor
+	}
+	return params
+}
+
+// coinbase pays the genesis subsidy to the address, unless the
+// configuration sets one, and the allocations.
+func (c GenesisConfig) coinbase(address string, params ChainParams) (*Transaction, error) {
+	if c.Address != "" {
+		address = c.Address
+	}
+
+	message := c.Message
+	if message == "" {
+		message = defaultGenesisMessage
+	}
+
+	tx, err := CoinbaseTx(address, message, params.Subsidy(0), params.AddressVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, alloc := range c.Allocations {
+		out, err := NewTXOutput(alloc.Value, alloc.Address, params.AddressVersion)
+		if err != nil {
+			return nil, fmt.Errorf("allocation to %s: %w", alloc.Address, err)
+		}
+		tx.Outputs = append(tx.Outputs, *out)
+	}
+
+	// The allocations together must not exceed MaxMoney either.
+	err = checkOutputs(tx)
+	if err != nil {
+		return nil, fmt.Errorf("genesis allocations: %w", err)
+	}
+
+	tx.ID = tx.Hash()
+	return tx, nil
+}
+
+// checkHash returns ErrGenesisMismatch if the configuration sets a genesis
+// hash other than hash.
+func (c GenesisConfig) checkHash(hash []byte) error {
+	if c.Hash == "" {
+		return nil
+	}
+
+	expected, err := hex.DecodeString(c.Hash)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(expected, hash) {
+		return fmt.Errorf("%w: got %x, want %x", ErrGenesisMismatch, hash, expected)
+	}
+	return nil
+}
+
+// checkConfig returns ErrGenesisMismatch if the chain was created with
+// another configuration than c. The hash is left out, since it only pins the
+// block the rest of the configuration gives.
+func (c GenesisConfig) checkConfig(stored GenesisConfig) error {
+	c.Hash, stored.Hash = "", ""
+
+	want, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	got, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(want, got) {
+		return fmt.Errorf("%w: the chain was created with the configuration %s", ErrGenesisMismatch, got)
+	}
+	return nil
+}
+
+// engine builds the consensus engine the configuration asks for.
+func (c ConsensusConfig) engine(mining MiningOptions) (Consensus, error) {
+	switch c.Engine {
+	case "", EnginePoW:
+		return NewPowEngine(mining), nil
+
+	case EnginePoA:
+		var signers [][]byte
+		for _, signer := range c.Signers {
+			pubKey, err := hex.DecodeString(signer)
+			if err != nil {
+				return nil, fmt.Errorf("invalid signer public key %q: %v", signer, err)
+			}
+			signers = append(signers, pubKey)
+		}
+
+		engine, err := NewPoAEngine(signers)
+		if err != nil {
+			return nil, err
+		}
+		return engine, nil
+
+	default:
+		return nil, fmt.Errorf("unknown consensus engine %q", c.Engine)
+	}
+}
+
+func storeGenesisConfig(txn *badger.Txn, config GenesisConfig) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(genesisConfigKey), data)
+}
+
+// loadGenesisConfig reads the configuration the chain was created with.
+// Chains created before it was stored use proof of work.
+func loadGenesisConfig(db *badger.DB) (GenesisConfig, error) {
+	var config GenesisConfig
+
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(genesisConfigKey))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(data []byte) error {
+			return json.Unmarshal(data, &config)
+		})
+	})
+
+	return config, err
+}
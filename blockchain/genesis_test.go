@@ -0,0 +1,133 @@
+package blockchain
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestContinueBlockChainChecksTheGenesisConfig(t *testing.T) {
+	_, address := newTestWallet(t)
+	opts := testOptions(t)
+	opts.Genesis.Message = "created"
+
+	chain := newTestChainWithOptions(t, address, opts)
+	genesisHash := hex.EncodeToString(chain.LastHash)
+	t.Cleanup(func() { chain.Database.Close() })
+
+	tests := []struct {
+		name   string
+		change func(opts *Options)
+		want   error
+	}{
+		{"same configuration", func(opts *Options) {}, nil},
+		{"same configuration with its hash", func(opts *Options) { opts.Genesis.Hash = genesisHash }, nil},
+		{"another message", func(opts *Options) { opts.Genesis.Message = "another" }, ErrGenesisMismatch},
+		{"another timestamp", func(opts *Options) { opts.Genesis.Timestamp++ }, ErrGenesisMismatch},
+		{"another recipient", func(opts *Options) { opts.Genesis.Address = address }, ErrGenesisMismatch},
+		{"an allocation", func(opts *Options) {
+			opts.Genesis.Allocations = []Allocation{{address, 10}}
+		}, ErrGenesisMismatch},
+		{"another hash", func(opts *Options) { opts.Genesis.Hash = hex.EncodeToString(make([]byte, 32)) }, ErrGenesisMismatch},
+		{"not checked", func(opts *Options) {
+			opts.Genesis.Message = "another"
+			opts.CheckGenesis = false
+		}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reopened := opts
+			reopened.CheckGenesis = true
+			test.change(&reopened)
+
+			err := chain.Database.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			chain, err = ContinueBlockChain("", reopened)
+			if !errors.Is(err, test.want) {
+				t.Fatalf("ContinueBlockChain() = %v, want %v", err, test.want)
+			}
+
+			if err != nil {
+				chain, err = ContinueBlockChain("", opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestInitBlockChainBoundsTheAllocations(t *testing.T) {
+	_, address := newTestWallet(t)
+
+	tests := []struct {
+		name        string
+		allocations []Allocation
+	}{
+		{"above MaxMoney", []Allocation{{address, MaxMoney + 1}}},
+		{"adding up to more than MaxMoney", []Allocation{{address, MaxMoney}, {address, MaxMoney}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := testOptions(t)
+			opts.Genesis.Allocations = test.allocations
+
+			chain, err := InitBlockChain(address, opts)
+			if err == nil {
+				chain.Database.Close()
+			}
+			if !errors.Is(err, ErrInvalidOutputValue) {
+				t.Fatalf("InitBlockChain() = %v, want %v", err, ErrInvalidOutputValue)
+			}
+		})
+	}
+}
+
+// failingEngine seals no block.
+type failingEngine struct {
+	Consensus
+}
+
+func (e failingEngine) Seal(ctx context.Context, block *Block) error {
+	return errors.New("no seal")
+}
+
+// TestFailedInitBlockChainLeavesNoDatabase checks that a chain can be
+// created again after a first attempt failed.
+func TestFailedInitBlockChainLeavesNoDatabase(t *testing.T) {
+	_, address := newTestWallet(t)
+
+	tests := []struct {
+		name   string
+		change func(opts *Options)
+	}{
+		{"sealing fails", func(opts *Options) {
+			opts.Consensus = failingEngine{NewPowEngine(MiningOptions{Workers: 1})}
+		}},
+		{"another genesis hash", func(opts *Options) { opts.Genesis.Hash = hex.EncodeToString(make([]byte, 32)) }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := testOptions(t)
+			failing := opts
+			test.change(&failing)
+
+			_, err := InitBlockChain(address, failing)
+			if err == nil {
+				t.Fatal("InitBlockChain() succeeded")
+			}
+			if DBExists(opts) {
+				t.Fatal("the failed chain left its database")
+			}
+
+			newTestChainWithOptions(t, address, opts)
+		})
+	}
+}
@@ -0,0 +1,429 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/dgraph-io/badger/v3"
+	"log"
+	"math/big"
+)
+
+var (
+	headerPrefix = []byte("hdr-")
+	headerTipKey = []byte("lhdr")
+)
+
+// BlockHeader is a block without its transactions, which it commits to
+// through TxRoot. Nodes download the chain of headers first and check it
+// before downloading the blocks.
+type BlockHeader struct {
+	Version   int
+	Height    int
+	Timestamp int64
+	Hash      []byte
+	PrevHash  []byte
+	TxRoot    []byte
+	Target    []byte
+	Nonce     uint32
+	Signature []byte
+}
+
+func (b *Block) Header() *BlockHeader {
+	return &BlockHeader{b.Version, b.Height, b.Timestamp, b.Hash, b.PrevHash, b.TxRoot, b.Target, b.Nonce, b.Signature}
+}
+
+// block returns a block with the header and no transactions, for the checks
+// that only look at the header.
+func (h *BlockHeader) block() *Block {
+	return &Block{
+		Version:   h.Version,
+		Height:    h.Height,
+		Timestamp: h.Timestamp,
+		Hash:      h.Hash,
+		PrevHash:  h.PrevHash,
+		TxRoot:    h.TxRoot,
+		Target:    h.Target,
+		Nonce:     h.Nonce,
+		Signature: h.Signature,
+	}
+}
+
+// Serialize panics if the header can't be encoded, which only happens on a
+// programming error.
+func (h *BlockHeader) Serialize() []byte {
+	var res bytes.Buffer
+	encoder := gob.NewEncoder(&res)
+	err := encoder.Encode(h)
+	if err != nil {
+		log.Panicln("encoder.Encode failed on BlockHeader.Serialize:", err)
+	}
+	return res.Bytes()
+}
+
+func DeserializeHeader(data []byte) (*BlockHeader, error) {
+	var header BlockHeader
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&header)
+	if err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
+
+func headerKey(hash []byte) []byte {
+	return append(append([]byte{}, headerPrefix...), hash...)
+}
+
+// getHeader returns the block with the hash or, when only its header is
+// stored, a block with the header and no transactions.
+func getHeader(txn *badger.Txn, hash []byte) (*Block, error) {
+	block, err := getBlock(txn, hash)
+	if err != ErrBlockNotFound {
+		return block, err
+	}
+
+	item, err := txn.Get(headerKey(hash))
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrBlockNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var header *BlockHeader
+	err = item.Value(func(v []byte) error {
+		header, err = DeserializeHeader(v)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return header.block(), nil
+}
+
+// headerTip returns the last header of the chain of headers with the most
+// work, which may be ahead of the blocks. Chains stored before headers were
+// tracked start from the tip of the blocks.
+func headerTip(txn *badger.Txn) (*Block, error) {
+	item, err := txn.Get(headerTipKey)
+	if err == badger.ErrKeyNotFound {
+		return getTip(txn)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return getHeader(txn, hash)
+}
+
+// updateHeaderTip makes the stored block or header the header tip when its
+// chain has more work, or when it is the genesis block.
+func updateHeaderTip(txn *badger.Txn, block *Block, work *big.Int) error {
+	tip, err := headerTip(txn)
+	if err == badger.ErrKeyNotFound {
+		return txn.Set(headerTipKey, block.Hash)
+	}
+	if err != nil {
+		return err
+	}
+
+	tipWork, err := chainWork(txn, tip)
+	if err != nil {
+		return err
+	}
+
+	if work.Cmp(tipWork) <= 0 {
+		return nil
+	}
+
+	return txn.Set(headerTipKey, block.Hash)
+}
+
+// resetHeaderTip moves the header tip back to the tip of the blocks, after
+// the chain of headers turned out to be invalid.
+func resetHeaderTip(txn *badger.Txn) error {
+	tip, err := getTip(txn)
+	if err != nil {
+		return err
+	}
+
+	return txn.Set(headerTipKey, tip.Hash)
+}
+
+// storeHeader writes the header, with the total work of its chain.
+func storeHeader(txn *badger.Txn, header *BlockHeader) error {
+	block := header.block()
+
+	parent, err := getHeader(txn, header.PrevHash)
+	if err != nil {
+		return err
+	}
+
+	work, err := chainWork(txn, parent)
+	if err != nil {
+		return err
+	}
+	work.Add(work, blockWork(block))
+
+	err = txn.Set(headerKey(header.Hash), header.Serialize())
+	if err != nil {
+		return err
+	}
+
+	err = txn.Set(chainWorkKey(header.Hash), work.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return updateHeaderTip(txn, block, work)
+}
+
+// AddHeaders checks and stores headers received from a peer, in order. Each
+// header must follow a stored block or header: its PrevHash, height,
+// consensus fields and seal are checked, but not its transactions, which
+// are checked when the block arrives. Headers already stored are skipped.
+// ErrUnknownParent is returned for a header whose parent is missing, and a
+// *ChainVerifyError for an invalid one.
+func (bc *BlockChain) AddHeaders(headers []*BlockHeader) error {
+	for _, header := range headers {
+		err := bc.addHeader(header)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (bc *BlockChain) addHeader(header *BlockHeader) error {
+	var parent *Block
+	known := false
+
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		_, err := getHeader(txn, header.Hash)
+		if err == nil {
+			known = true
+			return nil
+		}
+		if err != ErrBlockNotFound {
+			return err
+		}
+
+		parent, err = getHeader(txn, header.PrevHash)
+		if err == ErrBlockNotFound {
+			return ErrUnknownParent
+		}
+		if err != nil {
+			return err
+		}
+
+		invalid, err := isInvalidBlock(txn, parent.Hash)
+		if err == nil && invalid {
+			err = ErrInvalidBranch
+		}
+		return err
+	})
+
+	if err != nil || known {
+		return err
+	}
+
+	err = bc.checkBlockHeader(header.block(), parent)
+	if err != nil {
+		return &ChainVerifyError{header.Hash, header.Height, err}
+	}
+
+	return bc.Database.Update(func(txn *badger.Txn) error {
+		return storeHeader(txn, header)
+	})
+}
+
+// HeaderTip returns the last header of the chain of headers with the most
+// work. Its block may not be stored yet.
+func (bc *BlockChain) HeaderTip() (*BlockHeader, error) {
+	var tip *Block
+
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		var err error
+		tip, err = headerTip(txn)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return tip.Header(), nil
+}
+
+// HasHeader tells if the header, or the whole block, with the hash is
+// stored.
+func (bc *BlockChain) HasHeader(hash []byte) (bool, error) {
+	found := false
+
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		_, err := getHeader(txn, hash)
+		if err == ErrBlockNotFound {
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+
+	return found, err
+}
+
+// MissingBlocks returns the headers of the chain ending at the header tip
+// whose blocks are not stored yet, lowest first.
+func (bc *BlockChain) MissingBlocks() ([]*BlockHeader, error) {
+	var missing []*BlockHeader
+
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		block, err := headerTip(txn)
+		if err != nil {
+			return err
+		}
+
+		// Every stored block has a coinbase, only bare headers have no
+		// transactions.
+		for len(block.Transactions) == 0 {
+			missing = append(missing, block.Header())
+
+			block, err = getHeader(txn, block.PrevHash)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	for i, j := 0, len(missing)-1; i < j; i, j = i+1, j-1 {
+		missing[i], missing[j] = missing[j], missing[i]
+	}
+
+	return missing, err
+}
+
+// Locator lists hashes from the header tip back to genesis, so a peer can
+// find the last block it shares with us: the headers ahead of the active
+// chain, up to ten, then the blocks of the active chain, the ten last ones
+// and then further apart each time.
+func (bc *BlockChain) Locator() ([][]byte, error) {
+	var locator [][]byte
+
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		block, err := headerTip(txn)
+		if err != nil {
+			return err
+		}
+
+		for len(locator) < 10 {
+			active, err := inActiveChain(txn, block)
+			if err != nil || active {
+				return err
+			}
+
+			locator = append(locator, block.Hash)
+
+			block, err = getHeader(txn, block.PrevHash)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	height, err := bc.GetBestHeight()
+	if err != nil {
+		return nil, err
+	}
+
+	step := 1
+	count := 0
+
+	for h := height; ; h -= step {
+		if h < 0 {
+			h = 0
+		}
+
+		hash, err := bc.GetBlockHashByHeight(h)
+		if err != nil {
+			return nil, err
+		}
+		locator = append(locator, hash)
+
+		if h == 0 {
+			return locator, nil
+		}
+
+		count++
+		if count >= 10 {
+			step *= 2
+		}
+	}
+}
+
+// HeadersAfter returns up to max headers of the active chain after the
+// first hash of the locator in it, or after genesis when there is none.
+func (bc *BlockChain) HeadersAfter(locator [][]byte, max int) ([]*BlockHeader, error) {
+	var headers []*BlockHeader
+
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		start := 0
+
+		for _, hash := range locator {
+			block, err := getBlock(txn, hash)
+			if err == ErrBlockNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			active, err := inActiveChain(txn, block)
+			if err != nil {
+				return err
+			}
+			if active {
+				start = block.Height
+				break
+			}
+		}
+
+		for h := start + 1; len(headers) < max; h++ {
+			item, err := txn.Get(heightIndexKey(h))
+			if err == badger.ErrKeyNotFound {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			hash, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			block, err := getBlock(txn, hash)
+			if err != nil {
+				return err
+			}
+			headers = append(headers, block.Header())
+		}
+
+		return nil
+	})
+
+	return headers, err
+}
@@ -0,0 +1,192 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func headersOf(blocks []*Block) []*BlockHeader {
+	var headers []*BlockHeader
+	for _, block := range blocks {
+		headers = append(headers, block.Header())
+	}
+	return headers
+}
+
+func hashesOfHeaders(headers []*BlockHeader) [][]byte {
+	var hashes [][]byte
+	for _, header := range headers {
+		hashes = append(hashes, header.Hash)
+	}
+	return hashes
+}
+
+func checkHashes(t *testing.T, what string, got, want [][]byte) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("%s has %d hashes, want %d", what, len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("%s[%d] = %x, want %x", what, i, got[i], want[i])
+		}
+	}
+}
+
+func hashesAt(t *testing.T, chain *BlockChain, heights ...int) [][]byte {
+	t.Helper()
+
+	var hashes [][]byte
+	for _, height := range heights {
+		hash, err := chain.GetBlockHashByHeight(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+func TestLocator(t *testing.T) {
+	_, address, chain, other, _ := forkChains(t)
+	blocks := mineBlocks(t, chain, address, 30)
+
+	// The ten last blocks, then further apart each time down to genesis.
+	locator, err := chain.Locator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHashes(t, "Locator()", locator, hashesAt(t, chain, 30, 29, 28, 27, 26, 25, 24, 23, 22, 21, 19, 15, 7, 0))
+
+	// Up to ten headers ahead of the blocks come first.
+	err = other.AddHeaders(headersOf(blocks))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locator, err = other.Locator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHashes(t, "Locator() with headers", locator, hashesAt(t, chain, 30, 29, 28, 27, 26, 25, 24, 23, 22, 21, 0))
+
+	// A chain of the genesis block alone.
+	_, address = newTestWallet(t)
+	single := newTestChain(t, address)
+	locator, err = single.Locator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHashes(t, "Locator() of genesis", locator, [][]byte{single.LastHash})
+}
+
+func TestHeadersAfter(t *testing.T) {
+	_, address, chain, side, other := forkChains(t)
+	blocks := mineBlocks(t, chain, address, 12)
+
+	sideBlocks := mineBlocks(t, side, other, 1)
+	processBlocks(t, chain, sideBlocks)
+
+	tests := []struct {
+		name    string
+		locator [][]byte
+		max     int
+		want    []*Block
+	}{
+		{"no locator starts after genesis", nil, 100, blocks},
+		{"the first active hash", hashesAt(t, chain, 8, 3), 100, blocks[8:]},
+		{"unknown hashes are skipped", [][]byte{[]byte("unknown"), blocks[4].Hash}, 100, blocks[5:]},
+		{"side branches are skipped", [][]byte{sideBlocks[0].Hash, blocks[2].Hash}, 100, blocks[3:]},
+		{"up to max", hashesAt(t, chain, 0), 5, blocks[:5]},
+		{"nothing after the tip", [][]byte{chain.LastHash}, 100, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			headers, err := chain.HeadersAfter(test.locator, test.max)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got, want [][]byte
+			for _, header := range headers {
+				got = append(got, header.Hash)
+			}
+			for _, block := range test.want {
+				want = append(want, block.Hash)
+			}
+			checkHashes(t, "HeadersAfter()", got, want)
+		})
+	}
+}
+
+func TestAddHeaders(t *testing.T) {
+	_, address, chain, other, _ := forkChains(t)
+	blocks := mineBlocks(t, chain, address, 6)
+	headers := headersOf(blocks)
+
+	// A header whose parent is not stored is refused, with the ones after
+	// it.
+	err := other.AddHeaders(headers[1:])
+	if !errors.Is(err, ErrUnknownParent) {
+		t.Fatalf("AddHeaders() without the parent = %v, want %v", err, ErrUnknownParent)
+	}
+	tip, err := other.HeaderTip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tip.Height != 0 {
+		t.Errorf("header tip at height %d after a refused header, want 0", tip.Height)
+	}
+
+	err = other.AddHeaders(headers[:4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Headers already stored are skipped.
+	err = other.AddHeaders(headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tip, err = other.HeaderTip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tip.Hash, chain.LastHash) {
+		t.Errorf("header tip is %x, want %x", tip.Hash, chain.LastHash)
+	}
+	if height, _ := other.GetBestHeight(); height != 0 {
+		t.Errorf("best height is %d with headers only, want 0", height)
+	}
+
+	missing, err := other.MissingBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHashes(t, "MissingBlocks()", hashesOfHeaders(missing), hashesOfHeaders(headers))
+
+	processBlocks(t, other, blocks[:2])
+	missing, err = other.MissingBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHashes(t, "MissingBlocks() after two blocks", hashesOfHeaders(missing), hashesOfHeaders(headers[2:]))
+
+	// A header that connects but does not follow its parent is invalid.
+	next, tipBlock := nextBlock(t, chain, address)
+	next.Height++
+	sealBlock(t, chain, next, tipBlock)
+	bad := next.Header()
+
+	err = other.AddHeaders([]*BlockHeader{bad})
+	var verifyErr *ChainVerifyError
+	if !errors.As(err, &verifyErr) || !errors.Is(err, ErrInvalidHeight) {
+		t.Errorf("AddHeaders() with a wrong height = %v, want a *ChainVerifyError for %v", err, ErrInvalidHeight)
+	}
+	if found, _ := other.HasHeader(bad.Hash); found {
+		t.Error("the invalid header is stored")
+	}
+}
@@ -0,0 +1,67 @@
+package blockchain
+
+import (
+	"github.com/dgraph-io/badger/v3"
+)
+
+var heightIndexPrefix = []byte("h-")
+
+func heightIndexKey(height int) []byte {
+	return append(append([]byte{}, heightIndexPrefix...), ToHex(int64(height))...)
+}
+
+func (bc *BlockChain) GetBlockHashByHeight(height int) ([]byte, error) {
+	var hash []byte
+
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(heightIndexKey(height))
+		if err != nil {
+			return err
+		}
+		hash, err = item.ValueCopy(nil)
+		return err
+	})
+
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrBlockNotFound
+	}
+
+	return hash, err
+}
+
+func (bc *BlockChain) GetBlockByHeight(height int) (*Block, error) {
+	hash, err := bc.GetBlockHashByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	return bc.GetBlock(hash)
+}
+
+// GetBestHeight returns the height of the tip stored in the database, which
+// is safe to call while another goroutine adds blocks.
+func (bc *BlockChain) GetBestHeight() (int, error) {
+	var height int
+
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		tip, err := getTip(txn)
+		if err != nil {
+			return err
+		}
+		height = tip.Height
+		return nil
+	})
+
+	return height, err
+}
+
+// indexHeight maps the height of the block to its hash.
+// It must run inside the same transaction that stores the block.
+func indexHeight(txn *badger.Txn, block *Block) error {
+	return txn.Set(heightIndexKey(block.Height), block.Hash)
+}
+
+// unindexHeight forgets the hash of the block at its height.
+// It must run inside the same transaction that disconnects the block.
+func unindexHeight(txn *badger.Txn, block *Block) error {
+	return txn.Delete(heightIndexKey(block.Height))
+}
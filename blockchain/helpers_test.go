@@ -0,0 +1,126 @@
+package blockchain
+
+import (
+	"context"
+	"github.com/dgraph-io/badger/v3"
+	"go-blockchain/wallet"
+	"testing"
+)
+
+const testGenesisTimestamp = 1700000000
+
+// newTestWallet returns a wallet and its regtest address.
+func newTestWallet(t *testing.T) (*wallet.Wallet, string) {
+	t.Helper()
+
+	w, err := wallet.MakeWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, string(w.Address(RegtestChainParams.AddressVersion))
+}
+
+// testOptions are the options of a regtest chain in a temporary directory,
+// whose genesis block pays the address the chain is created with.
+func testOptions(t *testing.T) Options {
+	t.Helper()
+
+	opts := Regtest.Options(t.TempDir())
+	opts.Genesis.Timestamp = testGenesisTimestamp
+	opts.Genesis.Address = ""
+	opts.Mining.Workers = 1
+	return opts
+}
+
+func newTestChainWithOptions(t *testing.T, address string, opts Options) *BlockChain {
+	t.Helper()
+
+	chain, err := InitBlockChain(address, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { chain.Database.Close() })
+	return chain
+}
+
+// newTestChain creates a regtest chain whose genesis pays the address.
+func newTestChain(t *testing.T, address string) *BlockChain {
+	t.Helper()
+	return newTestChainWithOptions(t, address, testOptions(t))
+}
+
+// reopen closes the chain and opens it again with the options.
+func reopen(t *testing.T, chain *BlockChain, opts Options) *BlockChain {
+	t.Helper()
+
+	err := chain.Database.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain, err = ContinueBlockChain("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { chain.Database.Close() })
+	return chain
+}
+
+// mineBlocks mines n blocks paying the address, the first one with the
+// transactions.
+func mineBlocks(t *testing.T, chain *BlockChain, address string, n int, txs ...*Transaction) []*Block {
+	t.Helper()
+
+	var blocks []*Block
+	for i := 0; i < n; i++ {
+		block, err := chain.MineBlock(context.Background(), address, txs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block)
+		txs = nil
+	}
+	return blocks
+}
+
+// send makes a transaction paying amount from the wallet to the address.
+func send(t *testing.T, chain *BlockChain, from *wallet.Wallet, to string, amount, fee int) *Transaction {
+	t.Helper()
+
+	tx, err := NewTransaction(from, to, amount, fee, &UTXOSet{chain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+// utxoSnapshot maps the key of every unspent output to its value.
+func utxoSnapshot(t *testing.T, chain *BlockChain) map[string]int {
+	t.Helper()
+
+	snapshot := make(map[string]int)
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = utxoPrefix
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			v, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			out, err := DeserializeOutput(v)
+			if err != nil {
+				return err
+			}
+			snapshot[string(it.Item().KeyCopy(nil))] = out.Value
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snapshot
+}
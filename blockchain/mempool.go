@@ -0,0 +1,257 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"github.com/dgraph-io/badger/v3"
+)
+
+var (
+	mempoolTxPrefix    = []byte("mempool-tx-")
+	mempoolSpentPrefix = []byte("mempool-spent-")
+
+	ErrMempoolConflict = errors.New("transaction spends an output already spent by a pending transaction")
+	ErrAlreadyPending  = errors.New("transaction is already in the mempool")
+)
+
+// Mempool keeps validated transactions waiting to be mined. It is stored in
+// the chain database, next to a record of every output its transactions
+// spend, so two pending transactions never spend the same output.
+type Mempool struct {
+	Blockchain *BlockChain
+}
+
+func mempoolTxKey(txID []byte) []byte {
+	return append(append([]byte{}, mempoolTxPrefix...), txID...)
+}
+
+func mempoolSpentKey(txID []byte, outIdx int) []byte {
+	return bytes.Join([][]byte{mempoolSpentPrefix, txID, ToHex(int64(outIdx))}, []byte{})
+}
+
+// Add validates the transaction against the UTXO set and queues it. A
+// transaction may only spend confirmed outputs that no pending transaction
+// spends already.
+func (m Mempool) Add(tx *Transaction) error {
+	return m.Blockchain.Database.Update(func(txn *badger.Txn) error {
+		return m.add(txn, tx)
+	})
+}
+
+func (m Mempool) add(txn *badger.Txn, tx *Transaction) error {
+	_, err := txn.Get(mempoolTxKey(tx.ID))
+	if err == nil {
+		return ErrAlreadyPending
+	}
+	if err != badger.ErrKeyNotFound {
+		return err
+	}
+
+	for _, in := range tx.Inputs {
+		_, err := txn.Get(mempoolSpentKey(in.ID, in.Out))
+		if err == nil {
+			return &TxValidationError{tx.ID, ErrMempoolConflict}
+		}
+		if err != badger.ErrKeyNotFound {
+			return err
+		}
+	}
+
+	// A pending transaction is never the first of a block, so coinbase
+	// transactions are rejected as misplaced.
+	_, err = validateTransaction(txn, tx, 1, make(map[string]bool), make(map[string]Transaction))
+	if err != nil {
+		return &TxValidationError{tx.ID, err}
+	}
+
+	for _, in := range tx.Inputs {
+		err := txn.Set(mempoolSpentKey(in.ID, in.Out), tx.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return txn.Set(mempoolTxKey(tx.ID), tx.Serialize())
+}
+
+func (m Mempool) Transactions() ([]*Transaction, error) {
+	var txs []*Transaction
+
+	err := m.Blockchain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		txs, err = pendingTransactions(txn)
+		return err
+	})
+
+	return txs, err
+}
+
+func pendingTransactions(txn *badger.Txn) ([]*Transaction, error) {
+	var txs []*Transaction
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = mempoolTxPrefix
+
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		v, err := it.Item().ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+
+		tx, err := DeserializeTransaction(v)
+		if err != nil {
+			return nil, err
+		}
+
+		txs = append(txs, tx)
+	}
+
+	return txs, nil
+}
+
+// Get returns the pending transaction with the ID, or ErrTxNotFound.
+func (m Mempool) Get(ID []byte) (*Transaction, error) {
+	var tx *Transaction
+
+	err := m.Blockchain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(mempoolTxKey(ID))
+		if err == badger.ErrKeyNotFound {
+			return ErrTxNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(v []byte) error {
+			tx, err = DeserializeTransaction(v)
+			return err
+		})
+	})
+
+	return tx, err
+}
+
+func (m Mempool) Count() (int, error) {
+	counter := 0
+
+	err := m.Blockchain.Database.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = mempoolTxPrefix
+		opts.PrefetchValues = false
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			counter++
+		}
+
+		return nil
+	})
+
+	return counter, err
+}
+
+// removeConfirmed drops from the mempool the transactions of the block, and
+// the pending transactions that spend an output the block spends.
+// It must run inside the same transaction that stores the block.
+func (m Mempool) removeConfirmed(txn *badger.Txn, block *Block) error {
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		for _, in := range tx.Inputs {
+			item, err := txn.Get(mempoolSpentKey(in.ID, in.Out))
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			pendingID, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			err = m.remove(txn, pendingID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// reset empties the mempool after a reorganization and queues again the
+// transactions still valid against the new UTXO set: first txs, taken from
+// the blocks that left the chain, then the ones that were pending.
+func (m Mempool) reset(txn *badger.Txn, txs []*Transaction) error {
+	pending, err := pendingTransactions(txn)
+	if err != nil {
+		return err
+	}
+
+	for _, tx := range pending {
+		err := m.remove(txn, tx.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, tx := range append(txs, pending...) {
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		var txErr *TxValidationError
+		err := m.add(txn, tx)
+		if err != nil && err != ErrAlreadyPending && !errors.As(err, &txErr) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m Mempool) remove(txn *badger.Txn, txID []byte) error {
+	item, err := txn.Get(mempoolTxKey(txID))
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	v, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+
+	tx, err := DeserializeTransaction(v)
+	if err != nil {
+		return err
+	}
+
+	for _, in := range tx.Inputs {
+		err := txn.Delete(mempoolSpentKey(in.ID, in.Out))
+		if err != nil {
+			return err
+		}
+	}
+
+	return txn.Delete(mempoolTxKey(txID))
+}
+
+func isSpentInMempool(txn *badger.Txn, txID []byte, outIdx int) (bool, error) {
+	_, err := txn.Get(mempoolSpentKey(txID, outIdx))
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,166 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Leaves and inner nodes are hashed with different prefixes, so an inner node
+// can never be presented as a leaf of the tree.
+const (
+	merkleLeafPrefix = byte(0x00)
+	merkleNodePrefix = byte(0x01)
+)
+
+// MerkleTree keeps every level of the tree, from the leaves (Levels[0]) up to
+// the root. A level with an odd number of nodes pairs its last node with itself.
+type MerkleTree struct {
+	Levels [][][]byte
+}
+
+// MerkleProofStep is the sibling hash needed to climb one level of the tree.
+// Left tells whether the sibling is on the left side of the pair.
+type MerkleProofStep struct {
+	Hash []byte
+	Left bool
+}
+
+type MerkleProof []MerkleProofStep
+
+func merkleLeafHash(data []byte) []byte {
+	hash := sha256.Sum256(append([]byte{merkleLeafPrefix}, data...))
+	return hash[:]
+}
+
+func merkleNodeHash(left, right []byte) []byte {
+	hash := sha256.Sum256(bytes.Join([][]byte{{merkleNodePrefix}, left, right}, []byte{}))
+	return hash[:]
+}
+
+func NewMerkleTree(data [][]byte) *MerkleTree {
+	var leaves [][]byte
+
+	for _, datum := range data {
+		leaves = append(leaves, merkleLeafHash(datum))
+	}
+
+	if len(leaves) == 0 {
+		leaves = append(leaves, merkleLeafHash([]byte{}))
+	}
+
+	tree := MerkleTree{[][][]byte{leaves}}
+
+	for level := leaves; len(level) > 1; {
+		var next [][]byte
+
+		for i := 0; i < len(level); i += 2 {
+			right := level[i]
+			if i+1 < len(level) {
+				right = level[i+1]
+			}
+			next = append(next, merkleNodeHash(level[i], right))
+		}
+
+		tree.Levels = append(tree.Levels, next)
+		level = next
+	}
+
+	return &tree
+}
+
+func (t *MerkleTree) RootHash() []byte {
+	return t.Levels[len(t.Levels)-1][0]
+}
+
+// MerkleProof returns the sibling hashes that link the leaf holding data to
+// the root of the tree.
+func (t *MerkleTree) MerkleProof(data []byte) (MerkleProof, error) {
+	leaf := merkleLeafHash(data)
+	index := -1
+
+	for i, hash := range t.Levels[0] {
+		if bytes.Equal(hash, leaf) {
+			index = i
+			break
+		}
+	}
+
+	if index < 0 {
+		return nil, errors.New("data is not a leaf of the merkle tree")
+	}
+
+	var proof MerkleProof
+
+	for _, level := range t.Levels[:len(t.Levels)-1] {
+		if index%2 == 0 {
+			sibling := level[index]
+			if index+1 < len(level) {
+				sibling = level[index+1]
+			}
+			proof = append(proof, MerkleProofStep{sibling, false})
+		} else {
+			proof = append(proof, MerkleProofStep{level[index-1], true})
+		}
+		index /= 2
+	}
+
+	return proof, nil
+}
+
+func VerifyMerkleProof(root, txID []byte, proof MerkleProof) bool {
+	hash := merkleLeafHash(txID)
+
+	for _, step := range proof {
+		if step.Left {
+			hash = merkleNodeHash(step.Hash, hash)
+		} else {
+			hash = merkleNodeHash(hash, step.Hash)
+		}
+	}
+
+	return bytes.Equal(hash, root)
+}
+
+// String encodes the proof as a comma separated list of "l:HASH" or "r:HASH"
+// steps, which is the format accepted by ParseMerkleProof.
+func (p MerkleProof) String() string {
+	var steps []string
+
+	for _, step := range p {
+		side := "r"
+		if step.Left {
+			side = "l"
+		}
+		steps = append(steps, fmt.Sprintf("%s:%x", side, step.Hash))
+	}
+
+	return strings.Join(steps, ",")
+}
+
+func ParseMerkleProof(s string) (MerkleProof, error) {
+	var proof MerkleProof
+
+	if s == "" {
+		return proof, nil
+	}
+
+	for _, step := range strings.Split(s, ",") {
+		parts := strings.SplitN(step, ":", 2)
+		if len(parts) != 2 || (parts[0] != "l" && parts[0] != "r") {
+			return nil, fmt.Errorf("invalid merkle proof step %q", step)
+		}
+
+		hash, err := hex.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid merkle proof step %q: %v", step, err)
+		}
+
+		proof = append(proof, MerkleProofStep{hash, parts[0] == "l"})
+	}
+
+	return proof, nil
+}
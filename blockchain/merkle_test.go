@@ -0,0 +1,149 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func merkleLeaves(n int) [][]byte {
+	var data [][]byte
+	for i := 0; i < n; i++ {
+		data = append(data, []byte(fmt.Sprintf("tx-%d", i)))
+	}
+	return data
+}
+
+func TestMerkleProofOfEveryLeaf(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 4, 5, 7, 8, 9} {
+		data := merkleLeaves(n)
+		tree := NewMerkleTree(data)
+
+		for i, datum := range data {
+			proof, err := tree.MerkleProof(datum)
+			if err != nil {
+				t.Fatalf("%d leaves, leaf %d: %v", n, i, err)
+			}
+			if !VerifyMerkleProof(tree.RootHash(), datum, proof) {
+				t.Errorf("%d leaves, leaf %d: proof %s does not verify", n, i, proof)
+			}
+		}
+	}
+}
+
+func TestMerkleTreeSingleLeaf(t *testing.T) {
+	datum := []byte("coinbase")
+	tree := NewMerkleTree([][]byte{datum})
+
+	if !bytes.Equal(tree.RootHash(), merkleLeafHash(datum)) {
+		t.Errorf("root = %x, want the leaf hash %x", tree.RootHash(), merkleLeafHash(datum))
+	}
+
+	proof, err := tree.MerkleProof(datum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proof) != 0 {
+		t.Errorf("proof = %s, want no steps", proof)
+	}
+	if !VerifyMerkleProof(tree.RootHash(), datum, proof) {
+		t.Error("empty proof of the single leaf does not verify")
+	}
+}
+
+func TestMerkleTreeOddLeavesDuplicateTheLast(t *testing.T) {
+	data := merkleLeaves(3)
+	tree := NewMerkleTree(data)
+
+	a, b, c := merkleLeafHash(data[0]), merkleLeafHash(data[1]), merkleLeafHash(data[2])
+	want := merkleNodeHash(merkleNodeHash(a, b), merkleNodeHash(c, c))
+	if !bytes.Equal(tree.RootHash(), want) {
+		t.Errorf("root = %x, want %x", tree.RootHash(), want)
+	}
+
+	proof, err := tree.MerkleProof(data[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(proof[0].Hash, c) || proof[0].Left {
+		t.Errorf("first step = %x left=%v, want the leaf itself on the right", proof[0].Hash, proof[0].Left)
+	}
+}
+
+func TestMerkleProofRejectsTampering(t *testing.T) {
+	data := merkleLeaves(5)
+	tree := NewMerkleTree(data)
+
+	proof, err := tree.MerkleProof(data[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flipped := append(MerkleProof{}, proof...)
+	flipped[0].Left = !flipped[0].Left
+
+	hash := append([]byte{}, proof[1].Hash...)
+	hash[0] ^= 0xff
+	changed := append(MerkleProof{}, proof...)
+	changed[1] = MerkleProofStep{hash, proof[1].Left}
+
+	tests := []struct {
+		name  string
+		root  []byte
+		datum []byte
+		proof MerkleProof
+	}{
+		{"other leaf", tree.RootHash(), data[2], proof},
+		{"flipped side", tree.RootHash(), data[3], flipped},
+		{"changed hash", tree.RootHash(), data[3], changed},
+		{"missing step", tree.RootHash(), data[3], proof[:len(proof)-1]},
+		{"other root", NewMerkleTree(merkleLeaves(4)).RootHash(), data[3], proof},
+	}
+
+	for _, test := range tests {
+		if VerifyMerkleProof(test.root, test.datum, test.proof) {
+			t.Errorf("%s: tampered proof verifies", test.name)
+		}
+	}
+}
+
+func TestMerkleProofOfUnknownLeaf(t *testing.T) {
+	_, err := NewMerkleTree(merkleLeaves(4)).MerkleProof([]byte("unknown"))
+	if err == nil {
+		t.Error("proof of a datum that is not a leaf, want an error")
+	}
+}
+
+func TestMerkleProofStringRoundTrip(t *testing.T) {
+	data := merkleLeaves(6)
+	tree := NewMerkleTree(data)
+
+	for _, datum := range data {
+		proof, err := tree.MerkleProof(datum)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := ParseMerkleProof(proof.String())
+		if err != nil {
+			t.Fatalf("parsing %q: %v", proof, err)
+		}
+		if !reflect.DeepEqual(parsed, proof) {
+			t.Errorf("parsed %v, want %v", parsed, proof)
+		}
+	}
+
+	empty, err := ParseMerkleProof("")
+	if err != nil || len(empty) != 0 {
+		t.Errorf("ParseMerkleProof(\"\") = %v, %v, want an empty proof", empty, err)
+	}
+}
+
+func TestParseMerkleProofRejectsInvalidSteps(t *testing.T) {
+	for _, s := range []string{"x:00", "l", "l:zz", "r:00,", ":00"} {
+		if _, err := ParseMerkleProof(s); err == nil {
+			t.Errorf("ParseMerkleProof(%q) succeeded, want an error", s)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package blockchain
+
+import (
+	"fmt"
+	"go-blockchain/wallet"
+	"path/filepath"
+)
+
+// genesisTimestamp is the timestamp of the genesis block of every network.
+const genesisTimestamp = 1700000000
+
+// Network bundles everything that sets a chain apart from the others, so
+// nodes, addresses and data directories of different networks never mix.
+type Network struct {
+	Name string
+	// Magic starts every message between nodes of the network.
+	Magic [4]byte
+	// DataDirSuffix is the subdirectory of the data directory the network
+	// is stored in. Mainnet is stored in the data directory itself.
+	DataDirSuffix string
+	Params        ChainParams
+	Genesis       GenesisConfig
+}
+
+// The genesis block of every network has a fixed timestamp and pays an
+// address no key owns, so every node of a network creates the same one.
+var (
+	Mainnet = Network{
+		Name:   "mainnet",
+		Magic:  [4]byte{0xf9, 0xbe, 0xb4, 0xd9},
+		Params: DefaultChainParams,
+		Genesis: GenesisConfig{
+			Message:   defaultGenesisMessage,
+			Timestamp: genesisTimestamp,
+			Address:   UnspendableAddress(DefaultChainParams.AddressVersion),
+		},
+	}
+
+	Testnet = Network{
+		Name:          "testnet",
+		Magic:         [4]byte{0x0b, 0x11, 0x09, 0x07},
+		DataDirSuffix: "testnet",
+		Params:        TestnetChainParams,
+		Genesis: GenesisConfig{
+			Message:   "First Transaction from Testnet Genesis",
+			Timestamp: genesisTimestamp,
+			Address:   UnspendableAddress(TestnetChainParams.AddressVersion),
+		},
+	}
+
+	Regtest = Network{
+		Name:          "regtest",
+		Magic:         [4]byte{0xfa, 0xbf, 0xb5, 0xda},
+		DataDirSuffix: "regtest",
+		Params:        RegtestChainParams,
+		Genesis: GenesisConfig{
+			Message:   "First Transaction from Regtest Genesis",
+			Timestamp: genesisTimestamp,
+			Address:   UnspendableAddress(RegtestChainParams.AddressVersion),
+		},
+	}
+
+	Networks = []Network{Mainnet, Testnet, Regtest}
+)
+
+// UnspendableAddress returns the address of the version whose public key
+// hash is all zeros, which no known key hashes to. Coins sent to it are
+// burned.
+func UnspendableAddress(version byte) string {
+	return wallet.PubKeyHashAddress(make([]byte, 20), version)
+}
+
+func NetworkByName(name string) (Network, error) {
+	for _, network := range Networks {
+		if network.Name == name {
+			return network, nil
+		}
+	}
+	return Network{}, fmt.Errorf("unknown network %q", name)
+}
+
+// DataDir returns where the network is stored inside the data directory.
+func (n Network) DataDir(dataDir string) string {
+	return filepath.Join(dataDir, n.DataDirSuffix)
+}
+
+// Options returns the options of a chain of the network stored in the data
+// directory.
+func (n Network) Options(dataDir string) Options {
+	opts := DefaultOptions()
+	opts.DataDir = n.DataDir(dataDir)
+	opts.Params = n.Params
+	opts.Genesis = n.Genesis
+	return opts
+}
@@ -0,0 +1,56 @@
+package blockchain
+
+import (
+	"bytes"
+	"go-blockchain/wallet"
+	"testing"
+)
+
+// TestNetworkGenesisIsDeterministic creates every network twice, with
+// different addresses, and checks that both give the same genesis block.
+func TestNetworkGenesisIsDeterministic(t *testing.T) {
+	hashes := make(map[string]string)
+
+	for _, network := range Networks {
+		t.Run(network.Name, func(t *testing.T) {
+			var genesis [][]byte
+
+			for i := 0; i < 2; i++ {
+				w, err := wallet.MakeWallet()
+				if err != nil {
+					t.Fatal(err)
+				}
+				address := string(w.Address(network.Params.AddressVersion))
+
+				chain := newTestChainWithOptions(t, address, network.Options(t.TempDir()))
+				genesis = append(genesis, chain.LastHash)
+
+				block, err := chain.GetBlock(chain.LastHash)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if block.Timestamp != genesisTimestamp {
+					t.Errorf("genesis timestamp = %d, want %d", block.Timestamp, genesisTimestamp)
+				}
+
+				burned := UnspendableAddress(network.Params.AddressVersion)
+				pubKeyHash, err := wallet.AddressPubKeyHash(burned, network.Params.AddressVersion)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if out := block.Transactions[0].Outputs[0]; !out.IsLockedWithKey(pubKeyHash) {
+					t.Errorf("genesis pays %x, want %s", out.PubKeyHash, burned)
+				}
+			}
+
+			if !bytes.Equal(genesis[0], genesis[1]) {
+				t.Errorf("genesis blocks %x and %x differ", genesis[0], genesis[1])
+			}
+
+			if other, ok := hashes[string(genesis[0])]; ok {
+				t.Errorf("%s has the genesis block of %s", network.Name, other)
+			}
+			hashes[string(genesis[0])] = network.Name
+		})
+	}
+}
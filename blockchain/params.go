@@ -0,0 +1,148 @@
+package blockchain
+
+import (
+	"go-blockchain/wallet"
+	"math/big"
+)
+
+// ChainParams holds the address version, monetary and proof of work rules of
+// a chain.
+type ChainParams struct {
+	// AddressVersion is the version byte of the addresses outputs may be
+	// locked to.
+	AddressVersion byte
+
+	// InitialSubsidy is the amount of new coins paid to the miner of each
+	// block until the first halving.
+	InitialSubsidy int
+	// HalvingInterval is the number of blocks after which the subsidy is
+	// halved. Zero disables halving.
+	HalvingInterval int
+	// MaxSupply caps the amount of coins ever created by subsidies. Zero
+	// means no cap. The allocations of the genesis configuration are not
+	// counted: they are chosen per chain, while the subsidies are a rule of
+	// the network, so a chain may hold MaxSupply plus its premine.
+	MaxSupply int
+
+	// PowLimit is the easiest target a block may have, and the target of
+	// the genesis block.
+	PowLimit *big.Int
+	// RetargetInterval is the number of blocks between target adjustments.
+	// Zero keeps PowLimit forever.
+	RetargetInterval int
+	// TargetBlockTime is the wanted time between blocks, in seconds.
+	TargetBlockTime int64
+	// MaxAdjustmentFactor bounds how much a single adjustment may multiply
+	// or divide the target.
+	MaxAdjustmentFactor int64
+}
+
+var DefaultChainParams = ChainParams{
+	AddressVersion:      wallet.MainnetVersion,
+	InitialSubsidy:      100,
+	HalvingInterval:     210000,
+	MaxSupply:           42000000,
+	PowLimit:            TargetForBits(12),
+	RetargetInterval:    10,
+	TargetBlockTime:     10,
+	MaxAdjustmentFactor: 4,
+}
+
+// TestnetChainParams follow the mainnet rules with an easier proof of work.
+var TestnetChainParams = ChainParams{
+	AddressVersion:      wallet.TestnetVersion,
+	InitialSubsidy:      100,
+	HalvingInterval:     210000,
+	MaxSupply:           42000000,
+	PowLimit:            TargetForBits(8),
+	RetargetInterval:    10,
+	TargetBlockTime:     10,
+	MaxAdjustmentFactor: 4,
+}
+
+// RegtestChainParams make blocks instant to mine, for local tests: the
+// target is met by half of the hashes and never changes.
+var RegtestChainParams = ChainParams{
+	AddressVersion:  wallet.RegtestVersion,
+	InitialSubsidy:  100,
+	HalvingInterval: 150,
+	MaxSupply:       30000,
+	PowLimit:        TargetForBits(1),
+}
+
+// rawSubsidy is the subsidy at the height, before the supply cap.
+func (p ChainParams) rawSubsidy(height int) int {
+	if p.HalvingInterval <= 0 {
+		return p.InitialSubsidy
+	}
+
+	halvings := height / p.HalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+
+	return p.InitialSubsidy >> uint(halvings)
+}
+
+// rawIssued is the sum of the subsidies of every block below the height,
+// before the supply cap.
+func (p ChainParams) rawIssued(height int) int {
+	if p.HalvingInterval <= 0 {
+		return height * p.InitialSubsidy
+	}
+
+	issued := 0
+
+	for start := 0; start < height; start += p.HalvingInterval {
+		subsidy := p.rawSubsidy(start)
+		if subsidy == 0 {
+			break
+		}
+
+		end := start + p.HalvingInterval
+		if end > height {
+			end = height
+		}
+
+		issued += (end - start) * subsidy
+	}
+
+	return issued
+}
+
+// Subsidy returns the amount of new coins the miner of the block at the
+// height may claim, besides the fees.
+func (p ChainParams) Subsidy(height int) int {
+	subsidy := p.rawSubsidy(height)
+
+	if p.MaxSupply > 0 {
+		issued := p.IssuedSupply(height)
+		if issued+subsidy > p.MaxSupply {
+			subsidy = p.MaxSupply - issued
+		}
+	}
+
+	return subsidy
+}
+
+// IssuedSupply returns the amount of coins that the blocks below the height
+// may have created.
+func (p ChainParams) IssuedSupply(height int) int {
+	issued := p.rawIssued(height)
+
+	if p.MaxSupply > 0 && issued > p.MaxSupply {
+		return p.MaxSupply
+	}
+
+	return issued
+}
+
+// Difficulty tells how many times harder than PowLimit the target is.
+func (p ChainParams) Difficulty(target *big.Int) float64 {
+	if target.Sign() <= 0 {
+		return 0
+	}
+
+	difficulty, _ := new(big.Float).Quo(new(big.Float).SetInt(p.PowLimit), new(big.Float).SetInt(target)).Float64()
+	return difficulty
+}
@@ -0,0 +1,128 @@
+package blockchain
+
+import "testing"
+
+func TestSubsidy(t *testing.T) {
+	tests := []struct {
+		name   string
+		params ChainParams
+		height int
+		want   int
+	}{
+		{"mainnet genesis", DefaultChainParams, 0, 100},
+		{"mainnet before the first halving", DefaultChainParams, 209999, 100},
+		{"mainnet first halving", DefaultChainParams, 210000, 50},
+		{"mainnet second halving", DefaultChainParams, 420000, 25},
+		{"mainnet last paid era", DefaultChainParams, 1469999, 1},
+		{"mainnet subsidy ran out", DefaultChainParams, 1470000, 0},
+		{"testnet before the first halving", TestnetChainParams, 209999, 100},
+		{"testnet first halving", TestnetChainParams, 210000, 50},
+		{"testnet subsidy ran out", TestnetChainParams, 1470000, 0},
+		{"regtest before the first halving", RegtestChainParams, 149, 100},
+		{"regtest first halving", RegtestChainParams, 150, 50},
+		{"regtest third halving", RegtestChainParams, 450, 12},
+		{"regtest last paid block", RegtestChainParams, 1049, 1},
+		{"regtest subsidy ran out", RegtestChainParams, 1050, 0},
+		{"regtest far after the last halving", RegtestChainParams, 1 << 20, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.params.Subsidy(test.height); got != test.want {
+				t.Errorf("Subsidy(%d) = %d, want %d", test.height, got, test.want)
+			}
+		})
+	}
+}
+
+func TestIssuedSupply(t *testing.T) {
+	tests := []struct {
+		name   string
+		params ChainParams
+		height int
+		want   int
+	}{
+		{"mainnet nothing mined", DefaultChainParams, 0, 0},
+		{"mainnet genesis", DefaultChainParams, 1, 100},
+		{"mainnet first era", DefaultChainParams, 210000, 21000000},
+		{"mainnet into the second era", DefaultChainParams, 210001, 21000050},
+		{"mainnet every subsidy", DefaultChainParams, 1470000, 41370000},
+		{"mainnet after the last subsidy", DefaultChainParams, 5000000, 41370000},
+		{"testnet first era", TestnetChainParams, 210000, 21000000},
+		{"testnet every subsidy", TestnetChainParams, 1470000, 41370000},
+		{"regtest first era", RegtestChainParams, 150, 15000},
+		{"regtest second era", RegtestChainParams, 300, 22500},
+		{"regtest every subsidy", RegtestChainParams, 1050, 29550},
+		{"regtest after the last subsidy", RegtestChainParams, 1 << 20, 29550},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.params.IssuedSupply(test.height); got != test.want {
+				t.Errorf("IssuedSupply(%d) = %d, want %d", test.height, got, test.want)
+			}
+		})
+	}
+}
+
+// TestSubsidiesAddUpToTheIssuedSupply checks, block by block, that the
+// subsidies never exceed MaxSupply and add up to IssuedSupply.
+func TestSubsidiesAddUpToTheIssuedSupply(t *testing.T) {
+	capped := ChainParams{InitialSubsidy: 100, MaxSupply: 250}
+
+	for _, params := range []ChainParams{RegtestChainParams, capped} {
+		issued := 0
+		for height := 0; height < 1200; height++ {
+			if got := params.IssuedSupply(height); got != issued {
+				t.Fatalf("IssuedSupply(%d) = %d, want %d", height, got, issued)
+			}
+
+			subsidy := params.Subsidy(height)
+			if subsidy < 0 {
+				t.Fatalf("Subsidy(%d) = %d", height, subsidy)
+			}
+			issued += subsidy
+		}
+
+		if params.MaxSupply > 0 && issued > params.MaxSupply {
+			t.Errorf("issued %d, above the max supply %d", issued, params.MaxSupply)
+		}
+	}
+}
+
+func TestSubsidyStopsAtMaxSupply(t *testing.T) {
+	params := ChainParams{InitialSubsidy: 100, MaxSupply: 250}
+
+	for height, want := range []int{100, 100, 50, 0, 0} {
+		if got := params.Subsidy(height); got != want {
+			t.Errorf("Subsidy(%d) = %d, want %d", height, got, want)
+		}
+	}
+
+	if got := params.IssuedSupply(10); got != 250 {
+		t.Errorf("IssuedSupply(10) = %d, want 250", got)
+	}
+}
+
+// TestAllocationsAreNotCountedInTheSupply checks that a premine leaves the
+// subsidies of the network as they are.
+func TestAllocationsAreNotCountedInTheSupply(t *testing.T) {
+	_, address := newTestWallet(t)
+	_, premined := newTestWallet(t)
+
+	opts := testOptions(t)
+	opts.Genesis.Allocations = []Allocation{{premined, RegtestChainParams.MaxSupply}}
+	chain := newTestChainWithOptions(t, address, opts)
+
+	if got, want := chain.Params.Subsidy(1), RegtestChainParams.Subsidy(1); got != want {
+		t.Errorf("Subsidy(1) = %d, want %d", got, want)
+	}
+
+	total, err := UTXOSet{chain}.TotalValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := RegtestChainParams.MaxSupply + RegtestChainParams.Subsidy(0); total != want {
+		t.Errorf("TotalValue() = %d, want %d", total, want)
+	}
+}
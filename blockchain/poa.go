@@ -0,0 +1,170 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"go-blockchain/wallet"
+	"math/big"
+)
+
+var (
+	ErrUnknownSigner   = errors.New("block is not signed by an authorized signer")
+	ErrSignerOutOfTurn = errors.New("block is signed by a signer out of its turn")
+	ErrNotSigner       = errors.New("no signer key to seal blocks with")
+	ErrUnexpectedSeal  = errors.New("block has proof of work fields under proof of authority")
+	ErrInvalidHash     = errors.New("block hash does not match its header")
+	ErrNoSigners       = errors.New("proof of authority needs at least one signer")
+)
+
+// PoAEngine is the proof of authority consensus. The signers take turns:
+// the block at height h must be signed by Signers[h % len(Signers)], with
+// an ECDSA signature over the hash of its header. The genesis block is not
+// signed.
+type PoAEngine struct {
+	// Signers are wallet public keys, in turn order.
+	Signers [][]byte
+	// Signer is the private key this node seals blocks with.
+	Signer *ecdsa.PrivateKey
+}
+
+// NewPoAEngine returns ErrNoSigners without signers, since no block could
+// ever be sealed.
+func NewPoAEngine(signers [][]byte) (*PoAEngine, error) {
+	if len(signers) == 0 {
+		return nil, ErrNoSigners
+	}
+	return &PoAEngine{Signers: signers}, nil
+}
+
+// WithSigner returns a copy of the engine that seals blocks with the key,
+// leaving the engine as it is.
+func (e *PoAEngine) WithSigner(key *ecdsa.PrivateKey) *PoAEngine {
+	engine := *e
+	engine.Signer = key
+	return &engine
+}
+
+// InTurn returns the public key of the signer of the block at the height,
+// or nil when the engine has no signers.
+func (e *PoAEngine) InTurn(height int) []byte {
+	if len(e.Signers) == 0 {
+		return nil
+	}
+	return e.Signers[height%len(e.Signers)]
+}
+
+func (e *PoAEngine) Prepare(chain *BlockChain, block, parent *Block) error {
+	block.Target = nil
+	block.Nonce = 0
+	return nil
+}
+
+func (e *PoAEngine) VerifyHeader(chain *BlockChain, block, parent *Block) error {
+	if len(block.Target) != 0 || block.Nonce != 0 {
+		return ErrUnexpectedSeal
+	}
+	return nil
+}
+
+func (e *PoAEngine) Seal(ctx context.Context, block *Block) error {
+	block.Hash = block.headerHash()
+
+	if block.Height == 0 {
+		return nil
+	}
+
+	if e.Signer == nil {
+		return ErrNotSigner
+	}
+
+	inTurn := e.InTurn(block.Height)
+	if inTurn == nil {
+		return ErrNoSigners
+	}
+
+	if !bytes.Equal(wallet.PublicKeyBytes(e.Signer.PublicKey), inTurn) {
+		return ErrSignerOutOfTurn
+	}
+
+	r, s, err := ecdsa.Sign(rand.Reader, e.Signer, block.Hash)
+	if err != nil {
+		return err
+	}
+	block.Signature = make([]byte, 64)
+	r.FillBytes(block.Signature[:32])
+	s.FillBytes(block.Signature[32:])
+
+	return nil
+}
+
+// VerifySeal checks the hash of the block, and that it was signed by the
+// signer in turn at its height.
+func (e *PoAEngine) VerifySeal(block *Block) error {
+	if !bytes.Equal(block.Hash, block.headerHash()) {
+		return ErrInvalidHash
+	}
+
+	if block.Height == 0 {
+		if len(block.Signature) != 0 {
+			return ErrUnknownSigner
+		}
+		return nil
+	}
+
+	inTurn := e.InTurn(block.Height)
+	if verifyBlockSignature(inTurn, block) {
+		return nil
+	}
+
+	for _, signer := range e.Signers {
+		if verifyBlockSignature(signer, block) {
+			return ErrSignerOutOfTurn
+		}
+	}
+
+	return ErrUnknownSigner
+}
+
+func verifyBlockSignature(pubKey []byte, block *Block) bool {
+	sigLen := len(block.Signature)
+	keyLen := len(pubKey)
+	if sigLen == 0 || keyLen == 0 {
+		return false
+	}
+
+	r := big.Int{}
+	s := big.Int{}
+	r.SetBytes(block.Signature[:(sigLen / 2)])
+	s.SetBytes(block.Signature[(sigLen / 2):])
+
+	x := big.Int{}
+	y := big.Int{}
+	x.SetBytes(pubKey[:(keyLen / 2)])
+	y.SetBytes(pubKey[(keyLen / 2):])
+
+	rawPubKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: &x, Y: &y}
+	return ecdsa.Verify(&rawPubKey, block.Hash, &r, &s)
+}
+
+// headerHash is the hash of the block under proof of authority, which the
+// signer signs.
+func (b *Block) headerHash() []byte {
+	data := bytes.Join(
+		[][]byte{
+			ToHex(int64(b.Version)),
+			b.PrevHash,
+			b.TxRoot,
+			ToHex(b.Timestamp),
+			ToHex(int64(b.Height)),
+		},
+		[]byte{},
+	)
+
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
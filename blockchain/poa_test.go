@@ -0,0 +1,174 @@
+package blockchain
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"go-blockchain/wallet"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// newPoAChain creates a regtest chain sealed in turn by the wallets.
+func newPoAChain(t *testing.T, address string, signers ...*wallet.Wallet) *BlockChain {
+	t.Helper()
+
+	opts := testOptions(t)
+	opts.Genesis.Consensus = ConsensusConfig{Engine: EnginePoA}
+	for _, signer := range signers {
+		opts.Genesis.Consensus.Signers = append(opts.Genesis.Consensus.Signers, hex.EncodeToString(signer.PublicKey))
+	}
+
+	return newTestChainWithOptions(t, address, opts)
+}
+
+func TestPoAEngineNeedsSigners(t *testing.T) {
+	_, err := NewPoAEngine(nil)
+	if !errors.Is(err, ErrNoSigners) {
+		t.Errorf("NewPoAEngine(nil) = %v, want %v", err, ErrNoSigners)
+	}
+
+	_, address := newTestWallet(t)
+	opts := testOptions(t)
+	opts.Genesis.Consensus = ConsensusConfig{Engine: EnginePoA, Signers: []string{}}
+
+	_, err = InitBlockChain(address, opts)
+	if !errors.Is(err, ErrNoSigners) {
+		t.Errorf("InitBlockChain() = %v, want %v", err, ErrNoSigners)
+	}
+
+	path := filepath.Join(t.TempDir(), "genesis.json")
+	err = ioutil.WriteFile(path, []byte(`{"consensus": {"engine": "poa", "signers": []}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadGenesisConfig(path)
+	if !errors.Is(err, ErrNoSigners) {
+		t.Errorf("LoadGenesisConfig() = %v, want %v", err, ErrNoSigners)
+	}
+}
+
+// TestPoAEngineWithoutSigners checks that an engine built by hand without
+// signers refuses blocks instead of panicking.
+func TestPoAEngineWithoutSigners(t *testing.T) {
+	w, _ := newTestWallet(t)
+	engine := &PoAEngine{Signer: &w.PrivateKey}
+
+	if got := engine.InTurn(1); got != nil {
+		t.Errorf("InTurn(1) = %x, want nil", got)
+	}
+
+	block := &Block{Height: 1}
+	if err := engine.Seal(context.Background(), block); !errors.Is(err, ErrNoSigners) {
+		t.Errorf("Seal() = %v, want %v", err, ErrNoSigners)
+	}
+	if err := engine.VerifySeal(block); !errors.Is(err, ErrUnknownSigner) {
+		t.Errorf("VerifySeal() = %v, want %v", err, ErrUnknownSigner)
+	}
+}
+
+func TestPoASignersTakeTurns(t *testing.T) {
+	first, address := newTestWallet(t)
+	second, _ := newTestWallet(t)
+	outsider, _ := newTestWallet(t)
+
+	chain := newPoAChain(t, address, first, second)
+	engine := chain.Consensus.(*PoAEngine)
+
+	engine.Signer = &first.PrivateKey
+	_, err := chain.MineBlock(context.Background(), address, nil)
+	if !errors.Is(err, ErrSignerOutOfTurn) {
+		t.Fatalf("MineBlock() out of turn = %v, want %v", err, ErrSignerOutOfTurn)
+	}
+
+	engine.Signer = &second.PrivateKey
+	block := mineBlocks(t, chain, address, 1)[0]
+
+	engine.Signer = &first.PrivateKey
+	mineBlocks(t, chain, address, 1)
+
+	err = chain.Verify(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		signer *wallet.Wallet
+		want   error
+	}{
+		{"signer in turn", second, nil},
+		{"signer out of turn", first, ErrSignerOutOfTurn},
+		{"not a signer", outsider, ErrUnknownSigner},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signed := *block
+			signer := &PoAEngine{Signers: [][]byte{test.signer.PublicKey}, Signer: &test.signer.PrivateKey}
+			err := signer.Seal(context.Background(), &signed)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = engine.VerifySeal(&signed)
+			if !errors.Is(err, test.want) {
+				t.Errorf("VerifySeal() = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestPowRejectsASignature(t *testing.T) {
+	w, address := newTestWallet(t)
+	chain := newTestChain(t, address)
+
+	block, tip := nextBlock(t, chain, address)
+	sealBlock(t, chain, block, tip)
+
+	// The signature is not hashed, so it would not change the block hash.
+	signer := &PoAEngine{Signers: [][]byte{w.PublicKey}, Signer: &w.PrivateKey}
+	signed := *block
+	err := signer.Seal(context.Background(), &signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block.Signature = signed.Signature
+
+	err = chain.Consensus.VerifySeal(block)
+	if !errors.Is(err, ErrUnexpectedSignature) {
+		t.Errorf("VerifySeal() = %v, want %v", err, ErrUnexpectedSignature)
+	}
+
+	err = chain.ProcessBlock(block)
+	if !errors.Is(err, ErrUnexpectedSignature) {
+		t.Errorf("ProcessBlock() = %v, want %v", err, ErrUnexpectedSignature)
+	}
+}
+
+func TestMineBlockSignedByLeavesTheEngineSigner(t *testing.T) {
+	first, address := newTestWallet(t)
+	second, _ := newTestWallet(t)
+
+	chain := newPoAChain(t, address, first, second)
+	engine := chain.Consensus.(*PoAEngine)
+	engine.Signer = &first.PrivateKey
+
+	block, err := chain.MineBlockSignedBy(context.Background(), &second.PrivateKey, address, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verifyBlockSignature(second.PublicKey, block) {
+		t.Error("block is not signed by the given key")
+	}
+	if engine.Signer != &first.PrivateKey {
+		t.Error("the signer of the engine changed")
+	}
+
+	_, err = chain.MineBlockSignedBy(context.Background(), &second.PrivateKey, address, nil)
+	if !errors.Is(err, ErrSignerOutOfTurn) {
+		t.Errorf("MineBlockSignedBy() out of turn = %v, want %v", err, ErrSignerOutOfTurn)
+	}
+}
@@ -2,81 +2,321 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
-	"fmt"
-	"log"
+	"errors"
 	"math"
 	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-const Difficulty = 12
+var (
+	// ErrNonceExhausted is returned by ProofOfWork.Run when no nonce meets
+	// the target. The block must change, by rolling its extra nonce or
+	// timestamp, before searching again.
+	ErrNonceExhausted      = errors.New("no nonce meets the target")
+	ErrUnexpectedSignature = errors.New("block has a signature under proof of work")
+)
 
+// ProofOfWork checks a block against the target the chain expects for it,
+// which may differ from the target the block claims.
 type ProofOfWork struct {
 	Block  *Block
 	Target *big.Int
+	Mining MiningOptions
+}
+
+func NewProofOfWork(block *Block, target *big.Int) *ProofOfWork {
+	return &ProofOfWork{Block: block, Target: target}
+}
+
+// MiningOptions tunes how blocks are mined. The zero value mines with one
+// goroutine per CPU and reports no progress.
+type MiningOptions struct {
+	// Workers is the number of goroutines searching for a nonce.
+	Workers int
+	// Progress, if set, is called every ProgressInterval while mining.
+	Progress         func(MiningProgress)
+	ProgressInterval time.Duration
+}
+
+type MiningProgress struct {
+	Hashes   uint64
+	Elapsed  time.Duration
+	HashRate float64
+}
+
+func (o MiningOptions) workers() int {
+	if o.Workers > 0 {
+		return o.Workers
+	}
+	return runtime.NumCPU()
 }
 
-func NewProofOfWork(block *Block) *ProofOfWork {
+func (o MiningOptions) reportProgress(ctx context.Context, hashes *uint64) {
+	interval := o.ProgressInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	start := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			elapsed := now.Sub(start)
+			done := atomic.LoadUint64(hashes)
+			o.Progress(MiningProgress{done, elapsed, float64(done) / elapsed.Seconds()})
+		}
+	}
+}
+
+// TargetForBits returns the target of a hash with at least bits leading zero
+// bits.
+func TargetForBits(bits int) *big.Int {
 	target := big.NewInt(1)
-	target.Lsh(target, 256-Difficulty)
-	return &ProofOfWork{block, target}
+	return target.Lsh(target, uint(256-bits))
 }
 
-func (pow *ProofOfWork) InitData(nonce int) []byte {
+func (pow *ProofOfWork) InitData(nonce uint32) []byte {
 	return bytes.Join(
 		[][]byte{
+			ToHex(int64(pow.Block.Version)),
 			pow.Block.PrevHash,
-			pow.Block.HashTransactions(),
+			pow.Block.TxRoot,
+			ToHex(pow.Block.Timestamp),
+			ToHex(int64(pow.Block.Height)),
+			pow.Block.Target,
 			ToHex(int64(nonce)),
-			ToHex(Difficulty),
 		},
 		[]byte{},
 	)
 }
 
-func (pow *ProofOfWork) Run() (int, []byte) {
-	var intHash big.Int
-	var hash [32]byte
+// Run searches for a nonce whose hash meets the target, splitting the nonces
+// between pow.Mining.Workers goroutines. It returns as soon as one of them
+// finds a solution, with the context error once ctx is done, or with
+// ErrNonceExhausted when no nonce meets the target.
+func (pow *ProofOfWork) Run(ctx context.Context) (uint32, []byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
 
-	nonce := 0
+	workers := pow.Mining.workers()
+	found := make(chan powSolution, workers)
+	exhausted := make(chan struct{})
+	var hashes uint64
+	var wg, searchers sync.WaitGroup
 
-	for nonce < math.MaxInt64 {
-		data := pow.InitData(nonce)
-		hash = sha256.Sum256(data)
+	for i := 0; i < workers; i++ {
+		searchers.Add(1)
+		go func(first uint64) {
+			defer searchers.Done()
+			pow.search(ctx, first, uint64(workers), &hashes, found)
+		}(uint64(i))
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		searchers.Wait()
+		close(exhausted)
+	}()
 
-		fmt.Printf("%d/%x\r", nonce, hash)
+	if pow.Mining.Progress != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pow.Mining.reportProgress(ctx, &hashes)
+		}()
+	}
 
-		intHash.SetBytes(hash[:])
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
 
-		if intHash.Cmp(pow.Target) == -1 {
-			break
-		} else {
-			nonce++
+	select {
+	case solution := <-found:
+		return solution.nonce, solution.hash, nil
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	case <-exhausted:
+		// A worker may have found a solution right before the last one
+		// gave up.
+		select {
+		case solution := <-found:
+			return solution.nonce, solution.hash, nil
+		default:
+			return 0, nil, ErrNonceExhausted
 		}
 	}
+}
+
+type powSolution struct {
+	nonce uint32
+	hash  []byte
+}
+
+// powBatchSize is how many hashes a worker computes between two looks at
+// the context.
+const powBatchSize = 1024
+
+// search tries the nonces first, first+step, first+2*step... up to
+// math.MaxUint32, until one meets the target or ctx is done.
+func (pow *ProofOfWork) search(ctx context.Context, first, step uint64, hashes *uint64, found chan<- powSolution) {
+	var intHash big.Int
 
-	fmt.Println("")
+	for nonce := first; nonce <= math.MaxUint32; {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		i := 0
+		for ; i < powBatchSize && nonce <= math.MaxUint32; i++ {
+			hash := sha256.Sum256(pow.InitData(uint32(nonce)))
+			intHash.SetBytes(hash[:])
+
+			if intHash.Cmp(pow.Target) == -1 {
+				atomic.AddUint64(hashes, uint64(i+1))
+				found <- powSolution{uint32(nonce), hash[:]}
+				return
+			}
+
+			nonce += step
+		}
 
-	return nonce, hash[:]
+		atomic.AddUint64(hashes, uint64(i))
+	}
 }
 
 func (pow *ProofOfWork) Validate() bool {
+	if !bytes.Equal(pow.Block.TxRoot, pow.Block.HashTransactions()) {
+		return false
+	}
+
+	return pow.validateHeader()
+}
+
+// validateHeader checks that the hash of the block meets the target without
+// looking at its transactions, so it also works on a bare header.
+func (pow *ProofOfWork) validateHeader() bool {
 	var intHash big.Int
 
+	if pow.Block.TargetInt().Cmp(pow.Target) != 0 {
+		return false
+	}
+
 	data := pow.InitData(pow.Block.Nonce)
 
 	hash := sha256.Sum256(data)
+	if !bytes.Equal(hash[:], pow.Block.Hash) {
+		return false
+	}
+
 	intHash.SetBytes(hash[:])
 
 	return intHash.Cmp(pow.Target) == -1
 }
 
 func ToHex(num int64) []byte {
-	buff := new(bytes.Buffer)
-	err := binary.Write(buff, binary.BigEndian, num)
+	buff := make([]byte, 8)
+	binary.BigEndian.PutUint64(buff, uint64(num))
+	return buff
+}
+
+// PowEngine is the SHA-256 proof of work consensus. The target of every
+// block follows the retargeting rules of the chain parameters.
+type PowEngine struct {
+	Mining MiningOptions
+}
+
+func NewPowEngine(mining MiningOptions) *PowEngine {
+	return &PowEngine{mining}
+}
+
+func (e *PowEngine) expectedTarget(chain *BlockChain, parent *Block) (*big.Int, error) {
+	if parent == nil {
+		return chain.Params.PowLimit, nil
+	}
+	return chain.NextTarget(parent)
+}
+
+func (e *PowEngine) Prepare(chain *BlockChain, block, parent *Block) error {
+	target, err := e.expectedTarget(chain, parent)
+	if err != nil {
+		return err
+	}
+
+	block.Target = target.Bytes()
+	block.Signature = nil
+	return nil
+}
+
+func (e *PowEngine) VerifyHeader(chain *BlockChain, block, parent *Block) error {
+	target, err := e.expectedTarget(chain, parent)
 	if err != nil {
-		log.Panicln("binary.Write failed on ToHex:", err)
+		return err
+	}
+
+	if block.TargetInt().Cmp(target) != 0 {
+		return ErrInvalidProofOfWork
+	}
+	return nil
+}
+
+// Seal searches for a nonce meeting the target of the block. Whenever every
+// nonce fails, the extra nonce of the coinbase, if the block has one, and the
+// timestamp are rolled and the search starts over, never moving the timestamp
+// back. The genesis block is searched by a single worker, so the same
+// genesis configuration always gives the same block.
+func (e *PowEngine) Seal(ctx context.Context, block *Block) error {
+	target := block.TargetInt()
+
+	mining := e.Mining
+	if block.Height == 0 {
+		mining.Workers = 1
+	}
+
+	for {
+		pow := NewProofOfWork(block, target)
+		pow.Mining = mining
+		nonce, hash, err := pow.Run(ctx)
+		if err == nil {
+			block.Hash = hash
+			block.Nonce = nonce
+			return nil
+		}
+		if err != ErrNonceExhausted {
+			return err
+		}
+
+		block.rollExtraNonce()
+		if now := time.Now().Unix(); now > block.Timestamp {
+			block.Timestamp = now
+		}
+		block.TxRoot = block.HashTransactions()
+	}
+}
+
+// VerifySeal checks the proof of work of the block. The signature is not
+// part of the hashed header, so it must be empty.
+func (e *PowEngine) VerifySeal(block *Block) error {
+	if len(block.Signature) != 0 {
+		return ErrUnexpectedSignature
+	}
+
+	if !NewProofOfWork(block, block.TargetInt()).validateHeader() {
+		return ErrInvalidProofOfWork
 	}
-	return buff.Bytes()
+	return nil
 }
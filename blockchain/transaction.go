@@ -8,6 +8,7 @@ import (
 	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"go-blockchain/wallet"
 	"log"
@@ -15,12 +16,19 @@ import (
 	"strings"
 )
 
+var (
+	ErrNotEnoughFunds = errors.New("not enough funds")
+	ErrTxNotFound     = errors.New("transaction does not exist")
+)
+
 type Transaction struct {
 	ID      []byte
 	Inputs  []TxInput
 	Outputs []TxOutput
 }
 
+// Serialize panics if the transaction can't be encoded, which only happens on
+// a programming error.
 func (tx *Transaction) Serialize() []byte {
 	var encoded bytes.Buffer
 	encoder := gob.NewEncoder(&encoded)
@@ -31,6 +39,16 @@ func (tx *Transaction) Serialize() []byte {
 	return encoded.Bytes()
 }
 
+func DeserializeTransaction(data []byte) (*Transaction, error) {
+	var tx Transaction
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&tx)
+	if err != nil {
+		return nil, err
+	}
+	return &tx, nil
+}
+
 func (tx *Transaction) Hash() []byte {
 	var hash [32]byte
 
@@ -42,61 +60,80 @@ func (tx *Transaction) Hash() []byte {
 	return hash[:]
 }
 
-func NewTransaction(from, to string, amount int, chain *BlockChain) *Transaction {
+// unsignedHash is the hash the transaction ID is computed from, before the
+// inputs are signed.
+func (tx *Transaction) unsignedHash() []byte {
+	txCopy := *tx
+	txCopy.Inputs = make([]TxInput, len(tx.Inputs))
+
+	for i, in := range tx.Inputs {
+		txCopy.Inputs[i] = TxInput{in.ID, in.Out, nil, in.PubKey, in.ExtraNonce}
+	}
+
+	return txCopy.Hash()
+}
+
+// NewTransaction sends amount coins from the wallet to the address, leaving
+// fee coins to the miner of the block that includes it.
+func NewTransaction(w *wallet.Wallet, to string, amount, fee int, UTXO *UTXOSet) (*Transaction, error) {
 	var inputs []TxInput
 	var outputs []TxOutput
 
-	wallets, err := wallet.CreateWallets()
-	if err != nil {
-		log.Panicln("wallet.CreateWallets failed on NewTransaction:", err)
-	}
-	w := wallets.GetWallet(from)
 	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
 
-	acc, validOutputs := chain.FindSpendableOutputs(pubKeyHash, amount)
+	acc, validOutputs, err := UTXO.FindSpendableOutputs(pubKeyHash, amount+fee)
+	if err != nil {
+		return nil, err
+	}
 
-	if acc < amount {
-		log.Panicln("Error: not enough funds")
+	if acc < amount+fee {
+		return nil, ErrNotEnoughFunds
 	}
 
 	for txid, outs := range validOutputs {
 		txID, err := hex.DecodeString(txid)
 		if err != nil {
-			log.Panicln("hex.DecodeString failed on NewTransaction:", err)
+			return nil, err
 		}
 
 		for _, out := range outs {
-			input := TxInput{txID, out, nil, w.PublicKey}
+			input := TxInput{txID, out, nil, w.PublicKey, 0}
 			inputs = append(inputs, input)
 		}
 	}
 
-	outputs = append(outputs, *NewTXOutput(amount, to))
+	output, err := NewTXOutput(amount, to, UTXO.Blockchain.Params.AddressVersion)
+	if err != nil {
+		return nil, err
+	}
+	outputs = append(outputs, *output)
 
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from))
+	if acc > amount+fee {
+		outputs = append(outputs, TxOutput{acc - amount - fee, pubKeyHash})
 	}
 
 	tx := Transaction{ID: nil, Inputs: inputs, Outputs: outputs}
 	tx.ID = tx.Hash()
-	chain.SignTransaction(&tx, w.PrivateKey)
 
-	return &tx
+	err = UTXO.Blockchain.SignTransaction(&tx, w.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tx, nil
 }
 
 func (tx *Transaction) IsCoinbase() bool {
 	return len(tx.Inputs) == 1 && len(tx.Inputs[0].ID) == 0 && tx.Inputs[0].Out == -1
 }
 
-func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
+func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) error {
 	if tx.IsCoinbase() {
-		return
+		return nil
 	}
 
-	for _, in := range tx.Inputs {
-		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
-			log.Panicln("ERROR: Previous transaction is not correct")
-		}
+	if !hasPrevOutputs(tx, prevTXs) {
+		return ErrTxNotFound
 	}
 
 	txCopy := tx.TrimmedCopy()
@@ -111,13 +148,29 @@ func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transac
 
 		r, s, err := ecdsa.Sign(rand.Reader, &privKey, txCopy.ID)
 		if err != nil {
-			log.Panicln("ecdsa.Sign failed on tx.Sign:", err)
+			return err
 		}
 
-		signature := append(r.Bytes(), s.Bytes()...)
+		// r and s take 32 bytes each, so Verify splits them back in halves.
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
 
 		tx.Inputs[inId].Signature = signature
 	}
+
+	return nil
+}
+
+// hasPrevOutputs tells whether prevTXs holds every output spent by tx.
+func hasPrevOutputs(tx *Transaction, prevTXs map[string]Transaction) bool {
+	for _, in := range tx.Inputs {
+		prevTX := prevTXs[hex.EncodeToString(in.ID)]
+		if prevTX.ID == nil || in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+			return false
+		}
+	}
+	return true
 }
 
 func (tx *Transaction) TrimmedCopy() Transaction {
@@ -125,7 +178,7 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 	var outputs []TxOutput
 
 	for _, in := range tx.Inputs {
-		inputs = append(inputs, TxInput{in.ID, in.Out, nil, nil})
+		inputs = append(inputs, TxInput{in.ID, in.Out, nil, nil, in.ExtraNonce})
 	}
 
 	for _, out := range tx.Outputs {
@@ -140,10 +193,8 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 		return true
 	}
 
-	for _, in := range tx.Inputs {
-		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
-			log.Panicln("Previous transaction does not exist")
-		}
+	if !hasPrevOutputs(tx, prevTXs) {
+		return false
 	}
 
 	txCopy := tx.TrimmedCopy()
@@ -168,7 +219,7 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 		x.SetBytes(in.PubKey[:(keyLen / 2)])
 		y.SetBytes(in.PubKey[(keyLen / 2):])
 
-		rawPubKey := ecdsa.PublicKey{curve, &x, &y}
+		rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
 		if ecdsa.Verify(&rawPubKey, txCopy.ID, &r, &s) == false {
 			return false
 		}
@@ -187,6 +238,9 @@ func (tx *Transaction) String() string {
 		lines = append(lines, fmt.Sprintf("      Out:       %d", input.Out))
 		lines = append(lines, fmt.Sprintf("      Signature: %x", input.Signature))
 		lines = append(lines, fmt.Sprintf("      PubKey:    %x", input.PubKey))
+		if tx.IsCoinbase() {
+			lines = append(lines, fmt.Sprintf("      Extra nonce: %d", input.ExtraNonce))
+		}
 	}
 
 	for i, output := range tx.Outputs {
@@ -198,16 +252,27 @@ func (tx *Transaction) String() string {
 	return strings.Join(lines, "\n")
 }
 
-func CoinbaseTx(to, data string) *Transaction {
+// CoinbaseTx pays the block reward to the address. When data is empty, it is
+// filled with random bytes so that two coinbase transactions paying the same
+// address never share an ID.
+func CoinbaseTx(to, data string, reward int, version byte) (*Transaction, error) {
 	if data == "" {
-		data = fmt.Sprintf("Coins to %s", to)
+		randData := make([]byte, 24)
+		_, err := rand.Read(randData)
+		if err != nil {
+			return nil, err
+		}
+		data = fmt.Sprintf("%x", randData)
 	}
 
-	txin := TxInput{[]byte{}, -1, nil, []byte(data)}
-	txout := NewTXOutput(100, to)
+	txin := TxInput{[]byte{}, -1, nil, []byte(data), 0}
+	txout, err := NewTXOutput(reward, to, version)
+	if err != nil {
+		return nil, err
+	}
 
 	tx := Transaction{nil, []TxInput{txin}, []TxOutput{*txout}}
 	tx.ID = tx.Hash()
 
-	return &tx
+	return &tx, nil
 }
@@ -0,0 +1,78 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"go-blockchain/wallet"
+	"testing"
+)
+
+// signedSpend returns a transaction spending an output locked to the wallet,
+// and the transaction holding that output.
+func signedSpend(t *testing.T, w *wallet.Wallet) (*Transaction, map[string]Transaction) {
+	t.Helper()
+
+	prevTX := Transaction{
+		ID:      make([]byte, 32),
+		Outputs: []TxOutput{{10, wallet.PublicKeyHash(w.PublicKey)}},
+	}
+	prevTXs := map[string]Transaction{hex.EncodeToString(prevTX.ID): prevTX}
+
+	tx := &Transaction{
+		Inputs:  []TxInput{{ID: prevTX.ID, Out: 0, PubKey: w.PublicKey}},
+		Outputs: []TxOutput{{10, wallet.PublicKeyHash(w.PublicKey)}},
+	}
+	tx.ID = tx.unsignedHash()
+
+	err := tx.Sign(w.PrivateKey, prevTXs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx, prevTXs
+}
+
+// TestSignaturesWithLeadingZeros signs until r or s starts with a zero byte,
+// which used to shorten the signature and break its verification.
+func TestSignaturesWithLeadingZeros(t *testing.T) {
+	w, _ := newTestWallet(t)
+
+	for i := 0; i < 2000; i++ {
+		tx, prevTXs := signedSpend(t, w)
+
+		signature := tx.Inputs[0].Signature
+		if len(signature) != 64 {
+			t.Fatalf("signature has %d bytes, want 64", len(signature))
+		}
+		if !tx.Verify(prevTXs) {
+			t.Fatalf("signature %x does not verify", signature)
+		}
+
+		if signature[0] == 0 || signature[32] == 0 {
+			return
+		}
+	}
+	t.Fatal("no signature started with a zero byte")
+}
+
+// TestPublicKeysWithLeadingZeros makes keys until a coordinate starts with a
+// zero byte, and checks that it still signs valid transactions.
+func TestPublicKeysWithLeadingZeros(t *testing.T) {
+	for i := 0; i < 5000; i++ {
+		w, err := wallet.MakeWallet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(w.PublicKey) != 64 {
+			t.Fatalf("public key has %d bytes, want 64", len(w.PublicKey))
+		}
+		if w.PublicKey[0] != 0 && w.PublicKey[32] != 0 {
+			continue
+		}
+
+		tx, prevTXs := signedSpend(t, w)
+		if !tx.Verify(prevTXs) {
+			t.Fatalf("signature of the key %x does not verify", w.PublicKey)
+		}
+		return
+	}
+	t.Fatal("no public key started with a zero byte")
+}
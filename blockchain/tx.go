@@ -2,7 +2,9 @@ package blockchain
 
 import (
 	"bytes"
+	"encoding/gob"
 	"go-blockchain/wallet"
+	"log"
 )
 
 type TxOutput struct {
@@ -10,27 +12,57 @@ type TxOutput struct {
 	PubKeyHash []byte
 }
 
-func NewTXOutput(value int, address string) *TxOutput {
+// NewTXOutput locks the value to the address, which must have the address
+// version of the network.
+func NewTXOutput(value int, address string, version byte) (*TxOutput, error) {
 	txo := &TxOutput{value, nil}
-	txo.Lock([]byte(address))
-	return txo
+	err := txo.Lock([]byte(address), version)
+	if err != nil {
+		return nil, err
+	}
+	return txo, nil
 }
 
-func (out *TxOutput) Lock(address []byte) {
-	pubKeyHash := wallet.Base58Decode(address)
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
+func (out *TxOutput) Lock(address []byte, version byte) error {
+	pubKeyHash, err := wallet.AddressPubKeyHash(string(address), version)
+	if err != nil {
+		return err
+	}
 	out.PubKeyHash = pubKeyHash
+	return nil
 }
 
 func (out *TxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
 	return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
 }
 
+// Serialize panics if the output can't be encoded, which only happens on a
+// programming error.
+func (out TxOutput) Serialize() []byte {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	err := encoder.Encode(out)
+	if err != nil {
+		log.Panicln("encoder.Encode failed on TxOutput.Serialize:", err)
+	}
+	return buffer.Bytes()
+}
+
+func DeserializeOutput(data []byte) (TxOutput, error) {
+	var out TxOutput
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&out)
+	return out, err
+}
+
 type TxInput struct {
 	ID        []byte
 	Out       int
 	Signature []byte
 	PubKey    []byte
+	// ExtraNonce is rolled by miners in the coinbase input once every
+	// block nonce fails. It is zero in every other input.
+	ExtraNonce uint64
 }
 
 func (in *TxInput) UsesKey(pubKeyHash []byte) bool {
@@ -0,0 +1,182 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/dgraph-io/badger/v3"
+	"log"
+)
+
+var (
+	txIndexPrefix = []byte("tx-")
+	// txReindexKey is set while ReindexTransactions rebuilds the index, so a
+	// rebuild cut short is finished when the chain is opened again.
+	txReindexKey = []byte("reindex-tx")
+)
+
+// TxLocation tells in which block, and at which position, a transaction was mined.
+type TxLocation struct {
+	BlockHash []byte
+	Index     int
+}
+
+func txIndexKey(txID []byte) []byte {
+	return append(append([]byte{}, txIndexPrefix...), txID...)
+}
+
+// Serialize panics if the location can't be encoded, which only happens on a
+// programming error.
+func (loc TxLocation) Serialize() []byte {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	err := encoder.Encode(loc)
+	if err != nil {
+		log.Panicln("encoder.Encode failed on TxLocation.Serialize:", err)
+	}
+	return buffer.Bytes()
+}
+
+func DeserializeTxLocation(data []byte) (TxLocation, error) {
+	var loc TxLocation
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&loc)
+	return loc, err
+}
+
+func (bc *BlockChain) FindTransactionLocation(ID []byte) (TxLocation, error) {
+	var loc TxLocation
+
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		var err error
+		loc, err = getTransactionLocation(txn, ID)
+		return err
+	})
+
+	return loc, err
+}
+
+func getTransactionLocation(txn *badger.Txn, ID []byte) (TxLocation, error) {
+	var loc TxLocation
+
+	item, err := txn.Get(txIndexKey(ID))
+	if err == badger.ErrKeyNotFound {
+		return loc, ErrTxNotFound
+	}
+	if err != nil {
+		return loc, err
+	}
+
+	err = item.Value(func(v []byte) error {
+		loc, err = DeserializeTxLocation(v)
+		return err
+	})
+
+	return loc, err
+}
+
+func getTransaction(txn *badger.Txn, ID []byte) (Transaction, error) {
+	loc, err := getTransactionLocation(txn, ID)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	block, err := getBlock(txn, loc.BlockHash)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	if loc.Index >= len(block.Transactions) {
+		return Transaction{}, ErrTxNotFound
+	}
+
+	return *block.Transactions[loc.Index], nil
+}
+
+// ReindexTransactions drops the transaction index and rebuilds it from every
+// block of the chain.
+func (bc *BlockChain) ReindexTransactions() error {
+	err := bc.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set(txReindexKey, []byte{})
+	})
+	if err != nil {
+		return err
+	}
+
+	err = bc.Database.DropPrefix(txIndexPrefix)
+	if err != nil {
+		return err
+	}
+
+	iter := bc.Iterator()
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return err
+		}
+
+		err = bc.Database.Update(func(txn *badger.Txn) error {
+			return indexTransactions(txn, block)
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	return bc.Database.Update(func(txn *badger.Txn) error {
+		return txn.Delete(txReindexKey)
+	})
+}
+
+func (bc *BlockChain) CountIndexedTransactions() (int, error) {
+	counter := 0
+
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = txIndexPrefix
+		opts.PrefetchValues = false
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			counter++
+		}
+
+		return nil
+	})
+
+	return counter, err
+}
+
+// indexTransactions records the location of every transaction of the block.
+// It must run inside the same transaction that stores the block.
+func indexTransactions(txn *badger.Txn, block *Block) error {
+	for i, tx := range block.Transactions {
+		loc := TxLocation{block.Hash, i}
+
+		err := txn.Set(txIndexKey(tx.ID), loc.Serialize())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unindexTransactions removes the transactions of the block from the index.
+// It must run inside the same transaction that disconnects the block.
+func unindexTransactions(txn *badger.Txn, block *Block) error {
+	for _, tx := range block.Transactions {
+		err := txn.Delete(txIndexKey(tx.ID))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
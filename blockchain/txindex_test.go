@@ -0,0 +1,74 @@
+package blockchain
+
+import (
+	"bytes"
+	"github.com/dgraph-io/badger/v3"
+	"testing"
+)
+
+func TestInterruptedTxReindexIsFinishedOnOpen(t *testing.T) {
+	w, address := newTestWallet(t)
+	_, other := newTestWallet(t)
+	opts := testOptions(t)
+	chain := newTestChainWithOptions(t, address, opts)
+
+	mineBlocks(t, chain, address, 2)
+	tx := send(t, chain, w, other, 10, 0)
+	blocks := mineBlocks(t, chain, address, 1, tx)
+
+	want, err := chain.CountIndexedTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A rebuild that stopped right after dropping the index.
+	err = chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set(txReindexKey, []byte{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = chain.Database.DropPrefix(txIndexPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain = reopen(t, chain, opts)
+
+	got, err := chain.CountIndexedTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("indexed transactions = %d, want %d", got, want)
+	}
+
+	loc, err := chain.FindTransactionLocation(tx.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loc.BlockHash, blocks[0].Hash) || loc.Index != 1 {
+		t.Errorf("location = %x:%d, want %x:1", loc.BlockHash, loc.Index, blocks[0].Hash)
+	}
+}
+
+// TestReindexKeepsTheBlocks checks that dropping the index leaves a block
+// whose hash starts like its prefix.
+func TestReindexKeepsTheBlocks(t *testing.T) {
+	_, address := newTestWallet(t)
+	chain := newTestChainWithOptions(t, address, testOptions(t))
+	blocks := mineBlocks(t, chain, address, 1)
+
+	hash := append(append([]byte{}, txIndexPrefix...), blocks[0].Hash[len(txIndexPrefix):]...)
+	forceBlock(t, chain, hash, blocks[0], false)
+
+	err := chain.ReindexTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = chain.GetBlock(hash)
+	if err != nil {
+		t.Errorf("block %x after the reindex: %v", hash, err)
+	}
+}
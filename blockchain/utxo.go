@@ -0,0 +1,290 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/dgraph-io/badger/v3"
+)
+
+var (
+	utxoPrefix = []byte("utxo-")
+	// utxoReindexKey is set while Reindex rebuilds the UTXO set, so a
+	// rebuild cut short is finished when the chain is opened again.
+	utxoReindexKey = []byte("reindex-utxo")
+)
+
+type UTXOSet struct {
+	Blockchain *BlockChain
+}
+
+func utxoKey(txID []byte, outIdx int) []byte {
+	return bytes.Join([][]byte{utxoPrefix, txID, ToHex(int64(outIdx))}, []byte{})
+}
+
+func parseUTXOKey(key []byte) ([]byte, int) {
+	outIdxPos := len(key) - 8
+	txID := key[len(utxoPrefix):outIdxPos]
+	outIdx := int(binary.BigEndian.Uint64(key[outIdxPos:]))
+	return txID, outIdx
+}
+
+// FindSpendableOutputs selects outputs locked with the key until they add up
+// to amount. Outputs already spent by pending transactions of the mempool are
+// skipped.
+func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int, error) {
+	unspentOuts := make(map[string][]int)
+	accumulated := 0
+
+	err := u.Blockchain.Database.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = utxoPrefix
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid() && accumulated < amount; it.Next() {
+			item := it.Item()
+
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			out, err := DeserializeOutput(v)
+			if err != nil {
+				return err
+			}
+
+			if out.IsLockedWithKey(pubKeyHash) {
+				txID, outIdx := parseUTXOKey(item.Key())
+
+				pending, err := isSpentInMempool(txn, txID, outIdx)
+				if err != nil {
+					return err
+				}
+				if pending {
+					continue
+				}
+
+				id := hex.EncodeToString(txID)
+				accumulated += out.Value
+				unspentOuts[id] = append(unspentOuts[id], outIdx)
+			}
+		}
+
+		return nil
+	})
+
+	return accumulated, unspentOuts, err
+}
+
+func (u UTXOSet) FindUTXO(pubKeyHash []byte) ([]TxOutput, error) {
+	unspent, err := u.FindUnspentOutputs(pubKeyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	var UTXOs []TxOutput
+	for _, out := range unspent {
+		UTXOs = append(UTXOs, out.Output)
+	}
+
+	return UTXOs, nil
+}
+
+// UnspentOutput is an output of the UTXO set with the transaction and the
+// index it comes from.
+type UnspentOutput struct {
+	TxID   []byte
+	Index  int
+	Output TxOutput
+}
+
+// FindUnspentOutputs lists the outputs locked with the key, ordered by
+// transaction ID and index.
+func (u UTXOSet) FindUnspentOutputs(pubKeyHash []byte) ([]UnspentOutput, error) {
+	var unspent []UnspentOutput
+
+	err := u.Blockchain.Database.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = utxoPrefix
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			out, err := DeserializeOutput(v)
+			if err != nil {
+				return err
+			}
+
+			if out.IsLockedWithKey(pubKeyHash) {
+				txID, outIdx := parseUTXOKey(item.KeyCopy(nil))
+				unspent = append(unspent, UnspentOutput{txID, outIdx, out})
+			}
+		}
+
+		return nil
+	})
+
+	return unspent, err
+}
+
+func (u UTXOSet) CountOutputs() (int, error) {
+	counter := 0
+
+	err := u.Blockchain.Database.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = utxoPrefix
+		opts.PrefetchValues = false
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			counter++
+		}
+
+		return nil
+	})
+
+	return counter, err
+}
+
+// TotalValue sums the value of every unspent output, which is the amount of
+// coins in circulation.
+func (u UTXOSet) TotalValue() (int, error) {
+	total := 0
+
+	err := u.Blockchain.Database.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = utxoPrefix
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			v, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			out, err := DeserializeOutput(v)
+			if err != nil {
+				return err
+			}
+
+			total += out.Value
+		}
+
+		return nil
+	})
+
+	return total, err
+}
+
+// Reindex drops the whole UTXO set and rebuilds it by replaying every block
+// of the chain, from genesis to the tip.
+func (u UTXOSet) Reindex() error {
+	db := u.Blockchain.Database
+
+	err := db.Update(func(txn *badger.Txn) error {
+		return txn.Set(utxoReindexKey, []byte{})
+	})
+	if err != nil {
+		return err
+	}
+
+	err = db.DropPrefix(utxoPrefix)
+	if err != nil {
+		return err
+	}
+
+	height, err := u.Blockchain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+
+	for h := 0; h <= height; h++ {
+		block, err := u.Blockchain.GetBlockByHeight(h)
+		if err != nil {
+			return err
+		}
+
+		err = db.Update(func(txn *badger.Txn) error {
+			return u.update(txn, block)
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(utxoReindexKey)
+	})
+}
+
+// update removes the outputs spent by the block and adds the ones it creates.
+// It must run inside the same transaction that stores the block.
+func (u UTXOSet) update(txn *badger.Txn, block *Block) error {
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() == false {
+			for _, in := range tx.Inputs {
+				err := txn.Delete(utxoKey(in.ID, in.Out))
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		for outIdx, out := range tx.Outputs {
+			err := txn.Set(utxoKey(tx.ID, outIdx), out.Serialize())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// undo reverts update for the block at the tip of the chain: the outputs it
+// created are removed and the ones it spent are unspent again. It must run
+// inside the same transaction that disconnects the block, before the
+// transactions of the block leave the transaction index.
+func (u UTXOSet) undo(txn *badger.Txn, block *Block) error {
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		tx := block.Transactions[i]
+
+		for outIdx := range tx.Outputs {
+			err := txn.Delete(utxoKey(tx.ID, outIdx))
+			if err != nil {
+				return err
+			}
+		}
+
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		for _, in := range tx.Inputs {
+			prevTX, err := getTransaction(txn, in.ID)
+			if err != nil {
+				return err
+			}
+
+			err = txn.Set(utxoKey(in.ID, in.Out), prevTX.Outputs[in.Out].Serialize())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package blockchain
+
+import (
+	"github.com/dgraph-io/badger/v3"
+	"reflect"
+	"testing"
+)
+
+func TestReindexRebuildsTheSameUTXOSet(t *testing.T) {
+	w, address := newTestWallet(t)
+	_, other := newTestWallet(t)
+	chain := newTestChain(t, address)
+
+	mineBlocks(t, chain, address, 3)
+	mineBlocks(t, chain, address, 1, send(t, chain, w, other, 30, 5))
+
+	want := utxoSnapshot(t, chain)
+
+	err := UTXOSet{chain}.Reindex()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := utxoSnapshot(t, chain); !reflect.DeepEqual(got, want) {
+		t.Errorf("UTXO set after Reindex = %v, want %v", got, want)
+	}
+}
+
+func TestInterruptedReindexIsFinishedOnOpen(t *testing.T) {
+	_, address := newTestWallet(t)
+	opts := testOptions(t)
+	chain := newTestChainWithOptions(t, address, opts)
+	mineBlocks(t, chain, address, 3)
+
+	want := utxoSnapshot(t, chain)
+
+	// A rebuild that stopped right after dropping the set.
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set(utxoReindexKey, []byte{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = chain.Database.DropPrefix(utxoPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain = reopen(t, chain, opts)
+
+	if got := utxoSnapshot(t, chain); !reflect.DeepEqual(got, want) {
+		t.Errorf("UTXO set after reopening = %v, want %v", got, want)
+	}
+
+	pending, err := chain.reindexing(utxoReindexKey)
+	if err != nil || pending {
+		t.Errorf("reindexing = %v, %v, want false", pending, err)
+	}
+}
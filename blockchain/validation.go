@@ -0,0 +1,519 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/dgraph-io/badger/v3"
+	"sort"
+	"time"
+)
+
+const (
+	// medianTimeBlocks is the number of blocks whose median timestamp a new
+	// block must be later than.
+	medianTimeBlocks = 11
+	// MaxFutureBlockTime is how far ahead of the local clock the timestamp
+	// of a block may be.
+	MaxFutureBlockTime = 2 * time.Hour
+	// MaxMoney bounds every output and every sum of values: the outputs of a
+	// transaction, its inputs and the fees of a block. Twice it still fits a
+	// 32-bit int, so adding two bounded values never overflows.
+	MaxMoney = 1000000000
+)
+
+var (
+	ErrInvalidProofOfWork  = errors.New("invalid proof of work")
+	ErrInvalidTxRoot       = errors.New("tx root does not match the transactions")
+	ErrBrokenLink          = errors.New("previous hash does not match the previous block")
+	ErrInvalidHeight       = errors.New("height does not follow the previous block")
+	ErrMisplacedCoinbase   = errors.New("coinbase transaction outside position 0")
+	ErrInvalidTxID         = errors.New("transaction ID does not match its contents")
+	ErrUnknownInput        = errors.New("input refers to an unknown output")
+	ErrDoubleSpend         = errors.New("output is already spent")
+	ErrBadSignature        = errors.New("invalid input signature")
+	ErrOutputsExceedInputs = errors.New("outputs exceed inputs")
+	ErrInvalidOutputValue  = errors.New("output value must be positive and at most MaxMoney")
+	ErrDuplicateTx         = errors.New("transaction is already in the chain")
+	ErrMissingCoinbase     = errors.New("block does not start with a coinbase transaction")
+	ErrCoinbaseTooLarge    = errors.New("coinbase pays more than the subsidy plus the fees")
+	ErrTimestampTooOld     = errors.New("timestamp is not after the median time of the previous blocks")
+	ErrTimestampTooNew     = errors.New("timestamp is too far in the future")
+)
+
+// TxValidationError tells which transaction was rejected by AddBlock, and why.
+type TxValidationError struct {
+	TxID []byte
+	Err  error
+}
+
+func (e *TxValidationError) Error() string {
+	return fmt.Sprintf("transaction %x: %v", e.TxID, e.Err)
+}
+
+func (e *TxValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ChainVerifyError reports the first block of the chain that failed validation.
+type ChainVerifyError struct {
+	BlockHash []byte
+	Height    int
+	Err       error
+}
+
+func (e *ChainVerifyError) Error() string {
+	return fmt.Sprintf("block %d (%x): %v", e.Height, e.BlockHash, e.Err)
+}
+
+func (e *ChainVerifyError) Unwrap() error {
+	return e.Err
+}
+
+func outpointKey(txID []byte, outIdx int) string {
+	return fmt.Sprintf("%x:%d", txID, outIdx)
+}
+
+// addValue adds value to total, or returns false when the value is out of
+// range or the sum would exceed MaxMoney.
+func addValue(total, value int) (int, bool) {
+	if value < 0 || value > MaxMoney || total > MaxMoney-value {
+		return 0, false
+	}
+	return total + value, true
+}
+
+func outputsValue(tx *Transaction) (int, error) {
+	value := 0
+	for outIdx, out := range tx.Outputs {
+		var ok bool
+		value, ok = addValue(value, out.Value)
+		if !ok {
+			return 0, fmt.Errorf("outputs up to %d exceed %d: %w", outIdx, MaxMoney, ErrInvalidOutputValue)
+		}
+	}
+	return value, nil
+}
+
+func checkCoinbaseValue(coinbase *Transaction, subsidy, fees int) error {
+	value, err := outputsValue(coinbase)
+	if err != nil {
+		return err
+	}
+
+	maxValue, ok := addValue(subsidy, fees)
+	if !ok {
+		return fmt.Errorf("subsidy %d plus fees %d exceed %d: %w", subsidy, fees, MaxMoney, ErrInvalidOutputValue)
+	}
+	if value > maxValue {
+		return fmt.Errorf("%w: pays %d, at most %d", ErrCoinbaseTooLarge, value, maxValue)
+	}
+	return nil
+}
+
+// checkOutputs rejects outputs without value, above MaxMoney or adding up to
+// more than it. A coinbase may pay nothing once the subsidy ran out and its
+// block has no fees.
+func checkOutputs(tx *Transaction) error {
+	for outIdx, out := range tx.Outputs {
+		if out.Value < 0 || out.Value > MaxMoney || (out.Value == 0 && !tx.IsCoinbase()) {
+			return fmt.Errorf("output %d has value %d: %w", outIdx, out.Value, ErrInvalidOutputValue)
+		}
+	}
+
+	_, err := outputsValue(tx)
+	return err
+}
+
+// addFee adds the fee of a transaction to the fees of its block.
+func addFee(fees, fee int) (int, error) {
+	fees, ok := addValue(fees, fee)
+	if !ok {
+		return 0, fmt.Errorf("fees exceed %d: %w", MaxMoney, ErrInvalidOutputValue)
+	}
+	return fees, nil
+}
+
+// checkTransaction verifies the signatures of a non coinbase transaction and
+// that it does not create value. It returns the fee paid by the transaction.
+// prevTXs must hold every transaction its inputs refer to, with the referred
+// outputs in range.
+func checkTransaction(tx *Transaction, prevTXs map[string]Transaction) (int, error) {
+	valueIn := 0
+
+	for inIdx, in := range tx.Inputs {
+		prevOut := prevTXs[hex.EncodeToString(in.ID)].Outputs[in.Out]
+		if !in.UsesKey(prevOut.PubKeyHash) {
+			return 0, fmt.Errorf("input %d: public key does not own the output: %w", inIdx, ErrBadSignature)
+		}
+
+		var ok bool
+		valueIn, ok = addValue(valueIn, prevOut.Value)
+		if !ok {
+			return 0, fmt.Errorf("inputs up to %d exceed %d: %w", inIdx, MaxMoney, ErrInvalidOutputValue)
+		}
+	}
+
+	if !tx.Verify(prevTXs) {
+		return 0, ErrBadSignature
+	}
+
+	valueOut, err := outputsValue(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	if valueOut > valueIn {
+		return 0, fmt.Errorf("%w: %d in, %d out", ErrOutputsExceedInputs, valueIn, valueOut)
+	}
+
+	return valueIn - valueOut, nil
+}
+
+// Verify replays the whole chain from genesis to the tip, checking proof of
+// work, block linkage, coinbase placement and value, every signature, double
+// spends and that no transaction creates value. It returns a *ChainVerifyError for the
+// first invalid block.
+func (bc *BlockChain) Verify(ctx context.Context) error {
+	var hashes [][]byte
+
+	for hash := bc.LastHash; len(hash) > 0; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			return &ChainVerifyError{hash, -1, err}
+		}
+
+		hashes = append(hashes, hash)
+		hash = block.PrevHash
+	}
+
+	seenTXs := make(map[string]bool)
+	spent := make(map[string]bool)
+	var prev *Block
+
+	for i := len(hashes) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		block, err := bc.GetBlock(hashes[i])
+		if err != nil {
+			return &ChainVerifyError{hashes[i], -1, err}
+		}
+
+		err = bc.verifyBlock(block, prev, seenTXs, spent)
+		if err != nil {
+			return &ChainVerifyError{block.Hash, block.Height, err}
+		}
+
+		prev = block
+	}
+
+	return nil
+}
+
+// checkHeader checks what the block proves on its own on top of prev, which
+// is nil for the genesis block: the tx root, the header and that it starts
+// with a coinbase.
+func (bc *BlockChain) checkHeader(block, prev *Block) error {
+	if !bytes.Equal(block.TxRoot, block.HashTransactions()) {
+		return ErrInvalidTxRoot
+	}
+
+	err := bc.checkBlockHeader(block, prev)
+	if err != nil {
+		return err
+	}
+
+	if len(block.Transactions) == 0 || !block.Transactions[0].IsCoinbase() {
+		return ErrMissingCoinbase
+	}
+
+	return nil
+}
+
+// medianTimePast returns the median timestamp of the block and its
+// ancestors, up to medianTimeBlocks of them. A new block on top of the
+// block must be later than it.
+func medianTimePast(txn *badger.Txn, block *Block) (int64, error) {
+	var timestamps []int64
+
+	for len(timestamps) < medianTimeBlocks {
+		timestamps = append(timestamps, block.Timestamp)
+		if len(block.PrevHash) == 0 {
+			break
+		}
+
+		var err error
+		block, err = getHeader(txn, block.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2], nil
+}
+
+// checkTimestamp rejects a block on top of prev that is not later than the
+// median time past of prev, or that is more than MaxFutureBlockTime ahead of
+// the local clock.
+func (bc *BlockChain) checkTimestamp(block, prev *Block) error {
+	var median int64
+
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		var err error
+		median, err = medianTimePast(txn, prev)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if block.Timestamp <= median {
+		return fmt.Errorf("%w: %d, median %d", ErrTimestampTooOld, block.Timestamp, median)
+	}
+
+	if maxTime := time.Now().Add(MaxFutureBlockTime).Unix(); block.Timestamp > maxTime {
+		return fmt.Errorf("%w: %d, at most %d", ErrTimestampTooNew, block.Timestamp, maxTime)
+	}
+
+	return nil
+}
+
+// checkBlockHeader checks the consensus fields and seal of the block, its
+// linkage to prev and its timestamp, without looking at its transactions.
+// The timestamp of the genesis block is set by the genesis configuration.
+func (bc *BlockChain) checkBlockHeader(block, prev *Block) error {
+	err := bc.Consensus.VerifyHeader(bc, block, prev)
+	if err != nil {
+		return err
+	}
+
+	err = bc.Consensus.VerifySeal(block)
+	if err != nil {
+		return err
+	}
+
+	if prev == nil {
+		if len(block.PrevHash) != 0 {
+			return ErrBrokenLink
+		}
+		if block.Height != 0 {
+			return ErrInvalidHeight
+		}
+	} else {
+		if !bytes.Equal(block.PrevHash, prev.Hash) {
+			return ErrBrokenLink
+		}
+		if block.Height != prev.Height+1 {
+			return ErrInvalidHeight
+		}
+
+		err = bc.checkTimestamp(block, prev)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (bc *BlockChain) verifyBlock(block, prev *Block, seenTXs, spent map[string]bool) error {
+	err := bc.checkHeader(block, prev)
+	if err != nil {
+		return err
+	}
+
+	fees := 0
+
+	for txIdx, tx := range block.Transactions {
+		if !bytes.Equal(tx.ID, tx.unsignedHash()) {
+			return fmt.Errorf("transaction %x: %w", tx.ID, ErrInvalidTxID)
+		}
+
+		if seenTXs[hex.EncodeToString(tx.ID)] {
+			return fmt.Errorf("transaction %x: %w", tx.ID, ErrDuplicateTx)
+		}
+
+		if err := checkOutputs(tx); err != nil {
+			return fmt.Errorf("transaction %x: %w", tx.ID, err)
+		}
+
+		if tx.IsCoinbase() {
+			if txIdx != 0 {
+				return fmt.Errorf("transaction %x at position %d: %w", tx.ID, txIdx, ErrMisplacedCoinbase)
+			}
+			seenTXs[hex.EncodeToString(tx.ID)] = true
+			continue
+		}
+
+		prevTXs := make(map[string]Transaction)
+
+		for inIdx, in := range tx.Inputs {
+			key := outpointKey(in.ID, in.Out)
+			if spent[key] {
+				return fmt.Errorf("transaction %x input %d (%s): %w", tx.ID, inIdx, key, ErrDoubleSpend)
+			}
+
+			prevTX, err := bc.FindTransaction(in.ID)
+			if err != nil || !bytes.Equal(prevTX.ID, in.ID) || !seenTXs[hex.EncodeToString(in.ID)] ||
+				in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+				return fmt.Errorf("transaction %x input %d (%s): %w", tx.ID, inIdx, key, ErrUnknownInput)
+			}
+
+			spent[key] = true
+			prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+		}
+
+		fee, err := checkTransaction(tx, prevTXs)
+		if err == nil {
+			fees, err = addFee(fees, fee)
+		}
+		if err != nil {
+			return fmt.Errorf("transaction %x: %w", tx.ID, err)
+		}
+
+		seenTXs[hex.EncodeToString(tx.ID)] = true
+	}
+
+	// The genesis coinbase also carries the premine of the genesis
+	// configuration, so its value is not bounded by the subsidy.
+	coinbase := block.Transactions[0]
+	if prev == nil {
+		return nil
+	}
+	if err := checkCoinbaseValue(coinbase, bc.Params.Subsidy(block.Height), fees); err != nil {
+		return fmt.Errorf("transaction %x: %w", coinbase.ID, err)
+	}
+
+	return nil
+}
+
+// validateTransactions checks the transactions of a block that is about to be
+// mined on top of the current tip, against the UTXO set read through txn.
+// The first transaction must be the coinbase, paying at most the subsidy plus
+// the fees of the others. A transaction may spend outputs created by the ones
+// before it in the block.
+func (bc *BlockChain) validateTransactions(txn *badger.Txn, txs []*Transaction, height int) error {
+	if len(txs) == 0 || !txs[0].IsCoinbase() {
+		return ErrMissingCoinbase
+	}
+
+	fees, err := checkBlockTransactions(txn, txs, 0)
+	if err != nil {
+		return err
+	}
+
+	err = checkCoinbaseValue(txs[0], bc.Params.Subsidy(height), fees)
+	if err != nil {
+		return &TxValidationError{txs[0].ID, err}
+	}
+
+	return nil
+}
+
+// checkBlockTransactions validates the transactions in order, as if the
+// first one was at position firstIdx of the block, and returns the sum of
+// their fees.
+func checkBlockTransactions(txn *badger.Txn, txs []*Transaction, firstIdx int) (int, error) {
+	spent := make(map[string]bool)
+	blockTXs := make(map[string]Transaction)
+	fees := 0
+
+	for i, tx := range txs {
+		fee, err := validateTransaction(txn, tx, firstIdx+i, spent, blockTXs)
+		if err == nil {
+			fees, err = addFee(fees, fee)
+		}
+		if err != nil {
+			return 0, &TxValidationError{tx.ID, err}
+		}
+
+		blockTXs[hex.EncodeToString(tx.ID)] = *tx
+	}
+
+	return fees, nil
+}
+
+// validateTransaction checks a transaction found at position txIdx of a
+// block and returns the fee it pays.
+func validateTransaction(txn *badger.Txn, tx *Transaction, txIdx int, spent map[string]bool, blockTXs map[string]Transaction) (int, error) {
+	if !bytes.Equal(tx.ID, tx.unsignedHash()) {
+		return 0, ErrInvalidTxID
+	}
+
+	if _, ok := blockTXs[hex.EncodeToString(tx.ID)]; ok {
+		return 0, ErrDuplicateTx
+	}
+
+	_, err := getTransactionLocation(txn, tx.ID)
+	if err == nil {
+		return 0, ErrDuplicateTx
+	}
+	if err != ErrTxNotFound {
+		return 0, err
+	}
+
+	if err := checkOutputs(tx); err != nil {
+		return 0, err
+	}
+
+	if tx.IsCoinbase() {
+		if txIdx != 0 {
+			return 0, ErrMisplacedCoinbase
+		}
+		return 0, nil
+	}
+
+	prevTXs := make(map[string]Transaction)
+
+	for inIdx, in := range tx.Inputs {
+		key := outpointKey(in.ID, in.Out)
+		if spent[key] {
+			return 0, fmt.Errorf("input %d (%s) is spent twice within the block: %w", inIdx, key, ErrDoubleSpend)
+		}
+
+		prevTX, err := findPrevTransaction(txn, in, blockTXs)
+		if err != nil {
+			return 0, fmt.Errorf("input %d (%s): %w", inIdx, key, err)
+		}
+
+		spent[key] = true
+		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	}
+
+	return checkTransaction(tx, prevTXs)
+}
+
+// findPrevTransaction returns the transaction holding the output spent by in,
+// as long as that output is still unspent.
+func findPrevTransaction(txn *badger.Txn, in TxInput, blockTXs map[string]Transaction) (Transaction, error) {
+	if prevTX, ok := blockTXs[hex.EncodeToString(in.ID)]; ok {
+		if in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+			return Transaction{}, ErrUnknownInput
+		}
+		return prevTX, nil
+	}
+
+	prevTX, err := getTransaction(txn, in.ID)
+	if err != nil || in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+		return Transaction{}, ErrUnknownInput
+	}
+
+	_, err = txn.Get(utxoKey(in.ID, in.Out))
+	if err == badger.ErrKeyNotFound {
+		return Transaction{}, ErrDoubleSpend
+	}
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	return prevTX, nil
+}
@@ -0,0 +1,559 @@
+package blockchain
+
+import (
+	"context"
+	"errors"
+	"github.com/dgraph-io/badger/v3"
+	"go-blockchain/wallet"
+	"testing"
+	"time"
+)
+
+// sealBlock prepares and seals the block on top of parent, as a miner
+// would, without validating its transactions.
+func sealBlock(t *testing.T, chain *BlockChain, block, parent *Block) {
+	t.Helper()
+
+	block.TxRoot = block.HashTransactions()
+
+	err := chain.Consensus.Prepare(chain, block, parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = chain.Consensus.Seal(context.Background(), block)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// forceBlock stores the block under key, skipping every check, and makes
+// it the tip when it is the block at the top of the chain.
+func forceBlock(t *testing.T, chain *BlockChain, key []byte, block *Block, tip bool) {
+	t.Helper()
+
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		err := txn.Set(blockKey(key), block.Serialize())
+		if err != nil || !tip {
+			return err
+		}
+		return txn.Set([]byte(defaultKey), key)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tip {
+		chain.LastHash = key
+	}
+}
+
+// nextBlock builds a block on top of the tip with a coinbase paying the
+// address and the transactions, and a timestamp after the median time past.
+func nextBlock(t *testing.T, chain *BlockChain, address string, txs ...*Transaction) (*Block, *Block) {
+	t.Helper()
+
+	var tip *Block
+	var median int64
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		tip, err = getTip(txn)
+		if err != nil {
+			return err
+		}
+		median, err = medianTimePast(txn, tip)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coinbase, err := CoinbaseTx(address, "", chain.Params.Subsidy(tip.Height+1), chain.Params.AddressVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := CreateBlock(append([]*Transaction{coinbase}, txs...), tip.Hash, tip.Height+1)
+	if block.Timestamp <= median {
+		block.Timestamp = median + 1
+	}
+	return block, tip
+}
+
+// maxInt is the largest int, whatever its size.
+const maxInt = int(^uint(0) >> 1)
+
+// withOutputs replaces the outputs of the transaction with ones of the
+// values paying its sender, and signs it again.
+func withOutputs(t *testing.T, chain *BlockChain, w *wallet.Wallet, tx *Transaction, values ...int) *Transaction {
+	t.Helper()
+
+	tx.Outputs = nil
+	for _, value := range values {
+		tx.Outputs = append(tx.Outputs, TxOutput{value, wallet.PublicKeyHash(w.PublicKey)})
+	}
+	tx.ID = tx.unsignedHash()
+
+	err := chain.SignTransaction(tx, w.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestVerifyAcceptsAValidChain(t *testing.T) {
+	w, address := newTestWallet(t)
+	_, other := newTestWallet(t)
+	chain := newTestChain(t, address)
+
+	mineBlocks(t, chain, address, 2, send(t, chain, w, other, 10, 1))
+
+	err := chain.Verify(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyReportsTheFirstInvalidBlock(t *testing.T) {
+	tests := []struct {
+		name string
+		// corrupt writes an invalid block over the chain and returns the
+		// hash and height Verify must report.
+		corrupt func(t *testing.T, chain *BlockChain, w *wallet.Wallet, address string) ([]byte, int)
+		want    error
+	}{
+		{
+			name: "height skips a block",
+			corrupt: func(t *testing.T, chain *BlockChain, w *wallet.Wallet, address string) ([]byte, int) {
+				block, tip := nextBlock(t, chain, address)
+				block.Height++
+				sealBlock(t, chain, block, tip)
+				forceBlock(t, chain, block.Hash, block, true)
+				return block.Hash, block.Height
+			},
+			want: ErrInvalidHeight,
+		},
+		{
+			name: "parent stored under another hash",
+			corrupt: func(t *testing.T, chain *BlockChain, w *wallet.Wallet, address string) ([]byte, int) {
+				tip, err := chain.GetBlock(chain.LastHash)
+				if err != nil {
+					t.Fatal(err)
+				}
+				parent, err := chain.GetBlock(tip.PrevHash)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// A valid sibling of the parent, stored where the tip
+				// expects its parent.
+				sibling := *parent
+				sibling.Timestamp++
+				sealBlock(t, chain, &sibling, nil)
+				forceBlock(t, chain, parent.Hash, &sibling, false)
+				return tip.Hash, tip.Height
+			},
+			want: ErrBrokenLink,
+		},
+		{
+			name: "hash does not match the header",
+			corrupt: func(t *testing.T, chain *BlockChain, w *wallet.Wallet, address string) ([]byte, int) {
+				block, tip := nextBlock(t, chain, address)
+				sealBlock(t, chain, block, tip)
+				block.Nonce++
+				forceBlock(t, chain, block.Hash, block, true)
+				return block.Hash, block.Height
+			},
+			want: ErrInvalidProofOfWork,
+		},
+		{
+			name: "target is not the expected one",
+			corrupt: func(t *testing.T, chain *BlockChain, w *wallet.Wallet, address string) ([]byte, int) {
+				block, tip := nextBlock(t, chain, address)
+				sealBlock(t, chain, block, tip)
+
+				// Resealing keeps the easier target Prepare would fix.
+				block.Target = chain.Params.PowLimit.Bytes()
+				block.Target[0]++
+				err := chain.Consensus.Seal(context.Background(), block)
+				if err != nil {
+					t.Fatal(err)
+				}
+				forceBlock(t, chain, block.Hash, block, true)
+				return block.Hash, block.Height
+			},
+			want: ErrInvalidProofOfWork,
+		},
+		{
+			name: "transactions do not match the tx root",
+			corrupt: func(t *testing.T, chain *BlockChain, w *wallet.Wallet, address string) ([]byte, int) {
+				block, tip := nextBlock(t, chain, address)
+				sealBlock(t, chain, block, tip)
+				block.Transactions = block.Transactions[:0]
+				forceBlock(t, chain, block.Hash, block, true)
+				return block.Hash, block.Height
+			},
+			want: ErrInvalidTxRoot,
+		},
+		{
+			name: "output spent twice",
+			corrupt: func(t *testing.T, chain *BlockChain, w *wallet.Wallet, address string) ([]byte, int) {
+				first := send(t, chain, w, address, 10, 0)
+				second := send(t, chain, w, address, 20, 0)
+				mineBlocks(t, chain, address, 1, first)
+
+				block, tip := nextBlock(t, chain, address, second)
+				sealBlock(t, chain, block, tip)
+				forceBlock(t, chain, block.Hash, block, true)
+				return block.Hash, block.Height
+			},
+			want: ErrDoubleSpend,
+		},
+		{
+			name: "tampered signature",
+			corrupt: func(t *testing.T, chain *BlockChain, w *wallet.Wallet, address string) ([]byte, int) {
+				tx := send(t, chain, w, address, 10, 0)
+				tx.Inputs[0].Signature[0] ^= 0xff
+
+				block, tip := nextBlock(t, chain, address, tx)
+				sealBlock(t, chain, block, tip)
+				forceBlock(t, chain, block.Hash, block, true)
+				return block.Hash, block.Height
+			},
+			want: ErrBadSignature,
+		},
+		{
+			name: "outputs wrap around",
+			corrupt: func(t *testing.T, chain *BlockChain, w *wallet.Wallet, address string) ([]byte, int) {
+				tx := withOutputs(t, chain, w, send(t, chain, w, address, 10, 0), maxInt, maxInt, 2)
+
+				block, tip := nextBlock(t, chain, address, tx)
+				sealBlock(t, chain, block, tip)
+				forceBlock(t, chain, block.Hash, block, true)
+				return block.Hash, block.Height
+			},
+			want: ErrInvalidOutputValue,
+		},
+		{
+			name: "coinbase pays more than the subsidy",
+			corrupt: func(t *testing.T, chain *BlockChain, w *wallet.Wallet, address string) ([]byte, int) {
+				block, tip := nextBlock(t, chain, address)
+				coinbase := block.Transactions[0]
+				coinbase.Outputs[0].Value++
+				coinbase.ID = coinbase.Hash()
+				sealBlock(t, chain, block, tip)
+				forceBlock(t, chain, block.Hash, block, true)
+				return block.Hash, block.Height
+			},
+			want: ErrCoinbaseTooLarge,
+		},
+		{
+			name: "coinbase outputs wrap around",
+			corrupt: func(t *testing.T, chain *BlockChain, w *wallet.Wallet, address string) ([]byte, int) {
+				block, tip := nextBlock(t, chain, address)
+				coinbase := block.Transactions[0]
+				out := coinbase.Outputs[0]
+				out.Value = maxInt
+				coinbase.Outputs = []TxOutput{out, out, {2, out.PubKeyHash}}
+				coinbase.ID = coinbase.Hash()
+				sealBlock(t, chain, block, tip)
+				forceBlock(t, chain, block.Hash, block, true)
+				return block.Hash, block.Height
+			},
+			want: ErrInvalidOutputValue,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w, address := newTestWallet(t)
+			chain := newTestChain(t, address)
+			mineBlocks(t, chain, address, 2)
+
+			hash, height := test.corrupt(t, chain, w, address)
+			mineBlocks(t, chain, address, 1)
+
+			err := chain.Verify(context.Background())
+			if !errors.Is(err, test.want) {
+				t.Fatalf("Verify() = %v, want %v", err, test.want)
+			}
+
+			var verifyErr *ChainVerifyError
+			if !errors.As(err, &verifyErr) {
+				t.Fatalf("Verify() = %T, want *ChainVerifyError", err)
+			}
+			if string(verifyErr.BlockHash) != string(hash) || verifyErr.Height != height {
+				t.Errorf("Verify() reported block %d (%x), want %d (%x)",
+					verifyErr.Height, verifyErr.BlockHash, height, hash)
+			}
+		})
+	}
+}
+
+func TestAddBlockRejectsInvalidTransactions(t *testing.T) {
+	tests := []struct {
+		name string
+		// txs returns the transactions to mine and the one that must be
+		// rejected.
+		txs  func(t *testing.T, chain *BlockChain, w *wallet.Wallet, address string) ([]*Transaction, *Transaction)
+		want error
+	}{
+		{
+			name: "output spent twice in the block",
+			txs: func(t *testing.T, chain *BlockChain, w *wallet.Wallet, address string) ([]*Transaction, *Transaction) {
+				first := send(t, chain, w, address, 10, 0)
+				second := send(t, chain, w, address, 20, 0)
+				return []*Transaction{first, second}, second
+			},
+			want: ErrDoubleSpend,
+		},
+		{
+			name: "output spent by an earlier block",
+			txs: func(t *testing.T, chain *BlockChain, w *wallet.Wallet, address string) ([]*Transaction, *Transaction) {
+				first := send(t, chain, w, address, 10, 0)
+				second := send(t, chain, w, address, 20, 0)
+				mineBlocks(t, chain, address, 1, first)
+				return []*Transaction{second}, second
+			},
+			want: ErrDoubleSpend,
+		},
+		{
+			name: "tampered signature",
+			txs: func(t *testing.T, chain *BlockChain, w *wallet.Wallet, address string) ([]*Transaction, *Transaction) {
+				tx := send(t, chain, w, address, 10, 0)
+				tx.Inputs[0].Signature[0] ^= 0xff
+				return []*Transaction{tx}, tx
+			},
+			want: ErrBadSignature,
+		},
+		{
+			name: "signed by another key",
+			txs: func(t *testing.T, chain *BlockChain, w *wallet.Wallet, address string) ([]*Transaction, *Transaction) {
+				other, _ := newTestWallet(t)
+				tx := send(t, chain, w, address, 10, 0)
+				tx.Inputs[0].PubKey = other.PublicKey
+				tx.ID = tx.unsignedHash()
+				return []*Transaction{tx}, tx
+			},
+			want: ErrBadSignature,
+		},
+		{
+			name: "unknown input",
+			txs: func(t *testing.T, chain *BlockChain, w *wallet.Wallet, address string) ([]*Transaction, *Transaction) {
+				tx := send(t, chain, w, address, 10, 0)
+				tx.Inputs[0].ID = make([]byte, 32)
+				tx.ID = tx.unsignedHash()
+				return []*Transaction{tx}, tx
+			},
+			want: ErrUnknownInput,
+		},
+		{
+			name: "ID does not match the contents",
+			txs: func(t *testing.T, chain *BlockChain, w *wallet.Wallet, address string) ([]*Transaction, *Transaction) {
+				tx := send(t, chain, w, address, 10, 0)
+				tx.Outputs[0].Value++
+				return []*Transaction{tx}, tx
+			},
+			want: ErrInvalidTxID,
+		},
+		{
+			name: "transaction already in the chain",
+			txs: func(t *testing.T, chain *BlockChain, w *wallet.Wallet, address string) ([]*Transaction, *Transaction) {
+				tx := send(t, chain, w, address, 10, 0)
+				mineBlocks(t, chain, address, 1, tx)
+				return []*Transaction{tx}, tx
+			},
+			want: ErrDuplicateTx,
+		},
+		{
+			name: "coinbase after the first position",
+			txs: func(t *testing.T, chain *BlockChain, w *wallet.Wallet, address string) ([]*Transaction, *Transaction) {
+				coinbase, err := CoinbaseTx(address, "", 1, chain.Params.AddressVersion)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return []*Transaction{coinbase}, coinbase
+			},
+			want: ErrMisplacedCoinbase,
+		},
+		{
+			name: "outputs wrap around",
+			txs: func(t *testing.T, chain *BlockChain, w *wallet.Wallet, address string) ([]*Transaction, *Transaction) {
+				// The sum wraps to 0, below the 100 coins spent.
+				tx := withOutputs(t, chain, w, send(t, chain, w, address, 10, 0), maxInt, maxInt, 2)
+				return []*Transaction{tx}, tx
+			},
+			want: ErrInvalidOutputValue,
+		},
+		{
+			name: "outputs add up to more than MaxMoney",
+			txs: func(t *testing.T, chain *BlockChain, w *wallet.Wallet, address string) ([]*Transaction, *Transaction) {
+				tx := withOutputs(t, chain, w, send(t, chain, w, address, 10, 0), MaxMoney, MaxMoney)
+				return []*Transaction{tx}, tx
+			},
+			want: ErrInvalidOutputValue,
+		},
+		{
+			name: "outputs exceed the inputs",
+			txs: func(t *testing.T, chain *BlockChain, w *wallet.Wallet, address string) ([]*Transaction, *Transaction) {
+				tx := withOutputs(t, chain, w, send(t, chain, w, address, 10, 0), MaxMoney)
+				return []*Transaction{tx}, tx
+			},
+			want: ErrOutputsExceedInputs,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w, address := newTestWallet(t)
+			chain := newTestChain(t, address)
+			mineBlocks(t, chain, address, 1)
+
+			txs, rejected := test.txs(t, chain, w, address)
+			tip := chain.LastHash
+
+			_, err := chain.MineBlock(context.Background(), address, txs)
+			if !errors.Is(err, test.want) {
+				t.Fatalf("MineBlock() = %v, want %v", err, test.want)
+			}
+
+			var txErr *TxValidationError
+			if !errors.As(err, &txErr) {
+				t.Fatalf("MineBlock() = %T, want *TxValidationError", err)
+			}
+			if string(txErr.TxID) != string(rejected.ID) {
+				t.Errorf("MineBlock() rejected %x, want %x", txErr.TxID, rejected.ID)
+			}
+
+			if string(chain.LastHash) != string(tip) {
+				t.Error("the rejected block was added to the chain")
+			}
+		})
+	}
+}
+
+func TestAddBlockRejectsAnOverpayingCoinbase(t *testing.T) {
+	_, address := newTestWallet(t)
+	chain := newTestChain(t, address)
+
+	coinbase, err := CoinbaseTx(address, "", chain.Params.Subsidy(1)+1, chain.Params.AddressVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = chain.AddBlock(context.Background(), []*Transaction{coinbase})
+	if !errors.Is(err, ErrCoinbaseTooLarge) {
+		t.Fatalf("AddBlock() = %v, want %v", err, ErrCoinbaseTooLarge)
+	}
+
+	var txErr *TxValidationError
+	if !errors.As(err, &txErr) || string(txErr.TxID) != string(coinbase.ID) {
+		t.Errorf("AddBlock() = %v, want a *TxValidationError for the coinbase", err)
+	}
+}
+
+// TestAddBlockRejectsAWrappingCoinbase checks that coinbase outputs adding
+// up past the int range do not pass for a small value.
+func TestAddBlockRejectsAWrappingCoinbase(t *testing.T) {
+	w, address := newTestWallet(t)
+	chain := newTestChain(t, address)
+
+	coinbase, err := CoinbaseTx(address, "", chain.Params.Subsidy(1), chain.Params.AddressVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
+	coinbase.Outputs = []TxOutput{{maxInt, pubKeyHash}, {maxInt, pubKeyHash}, {2, pubKeyHash}}
+	coinbase.ID = coinbase.Hash()
+
+	_, err = chain.AddBlock(context.Background(), []*Transaction{coinbase})
+	if !errors.Is(err, ErrInvalidOutputValue) {
+		t.Fatalf("AddBlock() = %v, want %v", err, ErrInvalidOutputValue)
+	}
+
+	var txErr *TxValidationError
+	if !errors.As(err, &txErr) || string(txErr.TxID) != string(coinbase.ID) {
+		t.Errorf("AddBlock() = %v, want a *TxValidationError for the coinbase", err)
+	}
+}
+
+func TestCheckCoinbaseValueBoundsTheFees(t *testing.T) {
+	_, address := newTestWallet(t)
+	coinbase, err := CoinbaseTx(address, "", 1, RegtestChainParams.AddressVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = checkCoinbaseValue(coinbase, 100, MaxMoney)
+	if !errors.Is(err, ErrInvalidOutputValue) {
+		t.Errorf("checkCoinbaseValue() with the fees at MaxMoney = %v, want %v", err, ErrInvalidOutputValue)
+	}
+
+	_, err = addFee(MaxMoney, 1)
+	if !errors.Is(err, ErrInvalidOutputValue) {
+		t.Errorf("addFee() past MaxMoney = %v, want %v", err, ErrInvalidOutputValue)
+	}
+}
+
+func TestProcessBlockChecksTheTimestamp(t *testing.T) {
+	tests := []struct {
+		name      string
+		timestamp func(median int64) int64
+		want      error
+	}{
+		{"at the median time past", func(median int64) int64 { return median }, ErrTimestampTooOld},
+		{"before the median time past", func(median int64) int64 { return median - 100 }, ErrTimestampTooOld},
+		{"too far in the future", func(int64) int64 {
+			return time.Now().Add(MaxFutureBlockTime + time.Minute).Unix()
+		}, ErrTimestampTooNew},
+		{"just after the median time past", func(median int64) int64 { return median + 1 }, nil},
+		{"a little in the future", func(int64) int64 { return time.Now().Add(time.Hour).Unix() }, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, address := newTestWallet(t)
+			chain := newTestChain(t, address)
+			mineBlocks(t, chain, address, medianTimeBlocks)
+
+			block, tip := nextBlock(t, chain, address)
+
+			var median int64
+			err := chain.Database.View(func(txn *badger.Txn) error {
+				var err error
+				median, err = medianTimePast(txn, tip)
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			block.Timestamp = test.timestamp(median)
+			sealBlock(t, chain, block, tip)
+
+			err = chain.ProcessBlock(block)
+			if !errors.Is(err, test.want) {
+				t.Fatalf("ProcessBlock() = %v, want %v", err, test.want)
+			}
+
+			err = chain.AddHeaders([]*BlockHeader{block.Header()})
+			if test.want != nil && !errors.Is(err, test.want) {
+				t.Fatalf("AddHeaders() = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+// TestBlocksMinedAtOnceFollowTheMedianTime mines more blocks in a row than
+// seconds go by, so their timestamps must move past the median time past.
+func TestBlocksMinedAtOnceFollowTheMedianTime(t *testing.T) {
+	_, address := newTestWallet(t)
+	chain := newTestChain(t, address)
+	mineBlocks(t, chain, address, 3*medianTimeBlocks)
+
+	err := chain.Verify(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
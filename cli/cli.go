@@ -1,61 +1,318 @@
 package cli
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"go-blockchain/blockchain"
+	"go-blockchain/explorer"
+	"go-blockchain/p2p"
+	"go-blockchain/rpc"
 	"go-blockchain/wallet"
 	"io"
 	"log"
 	"os"
-	"runtime"
+	"os/signal"
 	"strconv"
+	"strings"
+	"time"
 )
 
-type CommandLine struct{}
+const (
+	dataDirEnv     = "GOBLOCKCHAIN_DATADIR"
+	rpcPasswordEnv = "GOBLOCKCHAIN_RPCPASSWORD"
+)
+
+type CommandLine struct {
+	// DataDir holds the chain database and the wallet file. It is set by the
+	// -datadir flag, or the GOBLOCKCHAIN_DATADIR environment variable.
+	DataDir string
+	// Workers is the number of goroutines mining blocks, set by the -workers
+	// flag. Zero uses one per CPU.
+	Workers int
+	// Network is the network the commands run on, set by the -network flag
+	// or by -regtest. Every network but mainnet is stored in its own
+	// subdirectory of DataDir.
+	Network blockchain.Network
+	// Genesis is the genesis configuration read from the file of the
+	// -genesis flag. Chains are created with it, and a chain created with
+	// another configuration is refused. When nil, the genesis of the network
+	// is used.
+	Genesis *blockchain.GenesisConfig
+}
+
+func defaultDataDir() string {
+	if dataDir := os.Getenv(dataDirEnv); dataDir != "" {
+		return dataDir
+	}
+	return blockchain.DefaultOptions().DataDir
+}
+
+func (cli *CommandLine) chainOptions() blockchain.Options {
+	opts := cli.Network.Options(cli.DataDir)
+	opts.Mining.Workers = cli.Workers
+	opts.Mining.Progress = printMiningProgress
+	if cli.Genesis != nil {
+		opts.Genesis = *cli.Genesis
+		opts.CheckGenesis = true
+	}
+	return opts
+}
+
+func printMiningProgress(progress blockchain.MiningProgress) {
+	fmt.Printf("Mining: %d hashes in %s, %.0f H/s\n",
+		progress.Hashes, progress.Elapsed.Round(time.Second), progress.HashRate)
+}
+
+func (cli *CommandLine) walletOptions() wallet.Options {
+	opts := wallet.DefaultOptions()
+	opts.DataDir = cli.Network.DataDir(cli.DataDir)
+	opts.AddressVersion = cli.Network.Params.AddressVersion
+	return opts
+}
+
+// checkAddress returns wallet.ErrInvalidAddress, or wallet.ErrWrongNetwork,
+// unless the address belongs to the network.
+func (cli *CommandLine) checkAddress(address string) error {
+	_, err := wallet.AddressPubKeyHash(address, cli.Network.Params.AddressVersion)
+	return err
+}
 
 func (cli *CommandLine) printUsage() {
-	fmt.Println("Usage:")
+	fmt.Println("Usage: [-datadir DIR] [-workers N] [-network NAME | -regtest] [-genesis FILE] COMMAND")
+	fmt.Printf(" -datadir DIR - Where the chain and the wallets are stored (default %s, or $%s)\n",
+		blockchain.DefaultOptions().DataDir, dataDirEnv)
+	fmt.Println(" -workers N - Number of goroutines mining blocks (default one per CPU)")
+	fmt.Println(" -network NAME - mainnet (default), testnet or regtest, stored in DIR/NAME except mainnet")
+	fmt.Println(" -regtest - Same as -network regtest, the local test network with instant blocks")
+	fmt.Println(" -genesis FILE - JSON genesis configuration of the chains created, other chains are refused")
 	fmt.Println(" getbalance -address ADDRESS - get the balance for an address")
-	fmt.Println(" createblockchain -address ADDRESS creates a blockchain and sends genesis reward to address")
+	fmt.Println(" createblockchain [-address ADDRESS] creates a blockchain, sending the genesis reward to the address, refused when the genesis configuration sets one")
 	fmt.Println(" printchain - Prints the blocks in the chain")
-	fmt.Println(" send -from FROM -to TO -amount AMOUNT - Send amount of coins")
+	fmt.Println(" send -from FROM -to TO -amount AMOUNT [-fee FEE] [-nomine] - Send amount of coins, -nomine only queues it in the mempool")
+	fmt.Println(" mine -address ADDRESS - Mines the mempool transactions into a block rewarding the address (the signer under proof of authority)")
+	fmt.Println(" generate -blocks N -address ADDRESS - Mines N blocks rewarding the address, the first with the mempool transactions")
 	fmt.Println(" createwallet - Creates a new Wallet")
 	fmt.Println(" listaddresses - Lists the addresses in our wallet file")
+	fmt.Println(" reindexutxo - Rebuilds the UTXO set")
+	fmt.Println(" reindextx - Rebuilds the transaction index")
+	fmt.Println(" gettransaction -id TXID - Prints a transaction and the block it was mined in")
+	fmt.Println(" getblock -height HEIGHT | -hash HASH - Prints the block at a height or with a hash")
+	fmt.Println(" getmerkleproof -id TXID - Prints the merkle proof that a transaction is in its block")
+	fmt.Println(" verifymerkleproof -root ROOT -id TXID -proof PROOF - Checks a merkle proof against a tx root")
+	fmt.Println(" verifychain - Checks every block and transaction of the chain")
+	fmt.Println(" supply - Prints the coins in circulation and the subsidy schedule")
+	fmt.Println(" getdifficulty - Prints the current and the next proof of work target")
+	fmt.Println(" getchaintips - Prints the tip of every known branch, the active chain first")
+	fmt.Println(" startnode -port PORT [-peers HOST:PORT,...] [-miner ADDRESS] [-maxinbound N] [-maxoutbound N] [-rpcaddr HOST:PORT -rpcuser USER -rpcpassword PASSWORD] [-exploreraddr HOST:PORT] - Runs a node sharing the chain with its peers, mining the mempool to the miner address, with a JSON-RPC server and a REST explorer when their addresses are given")
+	fmt.Println(" listpeers - Prints the known nodes and the misbehaviour score and ban of their hosts")
+	fmt.Println(" addpeer -addr HOST:PORT - Adds a node to connect to")
+	fmt.Println(" banpeer -host HOST[:PORT] [-duration DURATION] - Refuses a node, or every node of a host, for a while (default 24h)")
+	fmt.Println(" startrpc [-addr HOST:PORT] [-user USER -password PASSWORD] - Runs a JSON-RPC server over HTTP (default 127.0.0.1:8332)")
+	fmt.Println(" startexplorer [-addr HOST:PORT] - Runs a read-only REST explorer of the chain (default 127.0.0.1:8080)")
 }
 
-func (cli *CommandLine) validateArgs() {
-	if len(os.Args) < 2 {
+func (cli *CommandLine) validateArgs(args []string) error {
+	if len(args) < 1 {
 		cli.printUsage()
-		runtime.Goexit()
+		return errUsage
 	}
+	return nil
 }
 
-func (cli *CommandLine) listAddresses() {
-	wallets, err := wallet.CreateWallets()
+func (cli *CommandLine) listAddresses() error {
+	wallets, err := wallet.CreateWallets(cli.walletOptions())
 	if err != nil {
-		log.Panicln("wallet.CreateWallets failed on listAddresses:", err)
+		return err
 	}
 	addresses := wallets.GetAllAddresses()
 
 	for _, address := range addresses {
 		fmt.Println(address)
 	}
+
+	return nil
 }
 
-func (cli *CommandLine) createWallet() {
-	wallets, err := wallet.CreateWallets()
+func (cli *CommandLine) createWallet() error {
+	wallets, err := wallet.CreateWallets(cli.walletOptions())
 	if err != nil && !os.IsNotExist(err) {
-		log.Panicln("wallet.CreateWallets failed on createWallet:", err)
+		return err
+	}
+
+	address, err := wallets.AddWallet()
+	if err != nil {
+		return err
+	}
+
+	err = wallets.SaveFile()
+	if err != nil {
+		return err
+	}
+
+	w, err := wallets.GetWallet(address)
+	if err != nil {
+		return err
 	}
-	address := wallets.AddWallet()
-	wallets.SaveFile()
 
 	fmt.Printf("New address is: %s\n", address)
+	fmt.Printf("Public key: %x\n", w.PublicKey)
+	return nil
+}
+
+func (cli *CommandLine) reindexUTXO() error {
+	chain, err := blockchain.ContinueBlockChain("", cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer HandleClose(chain.Database)
+
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	err = UTXOSet.Reindex()
+	if err != nil {
+		return err
+	}
+
+	count, err := UTXOSet.CountOutputs()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Done! There are %d unspent outputs in the UTXO set.\n", count)
+	return nil
 }
 
-func (cli *CommandLine) printChain() {
-	chain := blockchain.ContinueBlockChain("")
+func (cli *CommandLine) reindexTransactions() error {
+	chain, err := blockchain.ContinueBlockChain("", cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer HandleClose(chain.Database)
+
+	err = chain.ReindexTransactions()
+	if err != nil {
+		return err
+	}
+
+	count, err := chain.CountIndexedTransactions()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Done! There are %d transactions in the index.\n", count)
+	return nil
+}
+
+func (cli *CommandLine) getTransaction(txID string) error {
+	ID, err := hex.DecodeString(txID)
+	if err != nil {
+		return errInvalidTxID
+	}
+
+	chain, err := blockchain.ContinueBlockChain("", cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer HandleClose(chain.Database)
+
+	loc, err := chain.FindTransactionLocation(ID)
+	if err != nil {
+		return err
+	}
+
+	block, err := chain.GetBlock(loc.BlockHash)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Block: %x\n", block.Hash)
+	fmt.Printf("Height: %d\n", block.Height)
+	fmt.Printf("Position: %d\n", loc.Index)
+	fmt.Println(block.Transactions[loc.Index])
+	return nil
+}
+
+func (cli *CommandLine) getMerkleProof(txID string) error {
+	ID, err := hex.DecodeString(txID)
+	if err != nil {
+		return errInvalidTxID
+	}
+
+	chain, err := blockchain.ContinueBlockChain("", cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer HandleClose(chain.Database)
+
+	loc, err := chain.FindTransactionLocation(ID)
+	if err != nil {
+		return err
+	}
+
+	block, err := chain.GetBlock(loc.BlockHash)
+	if err != nil {
+		return err
+	}
+
+	proof, err := block.MerkleProof(ID)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Block: %x\n", block.Hash)
+	fmt.Printf("Tx root: %x\n", block.TxRoot)
+	fmt.Printf("Proof: %s\n", proof)
+	return nil
+}
+
+func (cli *CommandLine) verifyMerkleProof(root, txID, proof string) error {
+	rootHash, err := hex.DecodeString(root)
+	if err != nil {
+		return errors.New("root is not valid")
+	}
+
+	ID, err := hex.DecodeString(txID)
+	if err != nil {
+		return errInvalidTxID
+	}
+
+	merkleProof, err := blockchain.ParseMerkleProof(proof)
+	if err != nil {
+		return err
+	}
+
+	valid := blockchain.VerifyMerkleProof(rootHash, ID, merkleProof)
+	fmt.Printf("Valid: %s\n", strconv.FormatBool(valid))
+	return nil
+}
+
+func (cli *CommandLine) verifyChain() error {
+	chain, err := blockchain.ContinueBlockChain("", cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer HandleClose(chain.Database)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err = chain.Verify(ctx)
+	if err != nil {
+		fmt.Println("Chain is NOT valid")
+		return err
+	}
+
+	fmt.Println("Chain is valid")
+	return nil
+}
+
+func (cli *CommandLine) printChain() error {
+	chain, err := blockchain.ContinueBlockChain("", cli.chainOptions())
+	if err != nil {
+		return err
+	}
 	defer HandleClose(chain.Database)
 
 	iter := chain.Iterator()
@@ -63,72 +320,607 @@ func (cli *CommandLine) printChain() {
 	log.Println("BlockChain:")
 	fmt.Println()
 	for {
-		block := iter.Next()
-
-		fmt.Printf("Hash: %x\n", block.Hash)
-		fmt.Printf("Prev. hash: %x\n", block.PrevHash)
-		pow := blockchain.NewProofOfWork(block)
-		fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
-		for _, tx := range block.Transactions {
-			fmt.Println(tx)
+		block, err := iter.Next()
+		if err != nil {
+			return err
 		}
-		fmt.Println()
+
+		printBlock(chain, block)
 
 		if len(block.PrevHash) == 0 {
 			break
 		}
 	}
+
+	return nil
 }
 
-func (cli *CommandLine) createBlockChain(address string) {
-	if !wallet.ValidateAddress(address) {
-		log.Panicln("Address is not valid")
+func (cli *CommandLine) getBlock(height int, hash string) error {
+	var blockHash []byte
+
+	if hash != "" {
+		var err error
+		blockHash, err = hex.DecodeString(hash)
+		if err != nil {
+			return errors.New("block hash is not valid")
+		}
 	}
 
-	chain := blockchain.InitBlockChain(address)
+	chain, err := blockchain.ContinueBlockChain("", cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer HandleClose(chain.Database)
+
+	var block *blockchain.Block
+
+	if blockHash != nil {
+		block, err = chain.GetBlock(blockHash)
+	} else {
+		block, err = chain.GetBlockByHeight(height)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	printBlock(chain, block)
+	return nil
+}
+
+func printBlock(chain *blockchain.BlockChain, block *blockchain.Block) {
+	fmt.Printf("Hash: %x\n", block.Hash)
+	fmt.Printf("Prev. hash: %x\n", block.PrevHash)
+	fmt.Printf("Height: %d\n", block.Height)
+	fmt.Printf("Version: %d\n", block.Version)
+	fmt.Printf("Timestamp: %s\n", time.Unix(block.Timestamp, 0).Format(time.RFC3339))
+	fmt.Printf("Target: %064x\n", block.TargetInt())
+	fmt.Printf("Difficulty: %.2f\n", chain.Params.Difficulty(block.TargetInt()))
+	fmt.Printf("Tx root: %x\n", block.TxRoot)
+	fmt.Printf("Nonce: %d\n", block.Nonce)
+	if len(block.Signature) > 0 {
+		fmt.Printf("Signature: %x\n", block.Signature)
+	}
+	fmt.Printf("Seal: %s\n", strconv.FormatBool(chain.CheckSeal(block) == nil))
+	for _, tx := range block.Transactions {
+		fmt.Println(tx)
+	}
+	fmt.Println()
+}
+
+// createBlockChain creates the chain. The address receives the genesis
+// subsidy, and is refused when the genesis configuration sets one, as the
+// genesis block of a network always pays the same one.
+func (cli *CommandLine) createBlockChain(address string) error {
+	opts := cli.chainOptions()
+
+	if opts.Genesis.Address != "" && address != "" {
+		return fmt.Errorf("%w: the genesis configuration pays %s, drop -address", errUsage, opts.Genesis.Address)
+	}
+	if opts.Genesis.Address == "" {
+		if address == "" {
+			return fmt.Errorf("%w: the genesis configuration has no address, pass -address", errUsage)
+		}
+		if err := cli.checkAddress(address); err != nil {
+			return err
+		}
+	}
+
+	chain, err := blockchain.InitBlockChain(address, opts)
+	if err != nil {
+		return err
+	}
 	HandleClose(chain.Database)
+
+	fmt.Printf("Genesis: %x\n", chain.LastHash)
 	fmt.Println("Finished!")
+	return nil
 }
 
-func (cli *CommandLine) getBalance(address string) {
-	if !wallet.ValidateAddress(address) {
-		log.Panicln("Address is not valid")
+func (cli *CommandLine) getBalance(address string) error {
+	pubKeyHash, err := wallet.AddressPubKeyHash(address, cli.Network.Params.AddressVersion)
+	if err != nil {
+		return err
 	}
 
-	chain := blockchain.ContinueBlockChain(address)
+	chain, err := blockchain.ContinueBlockChain(address, cli.chainOptions())
+	if err != nil {
+		return err
+	}
 	defer HandleClose(chain.Database)
 
 	balance := 0
-	pubKeyHash := wallet.Base58Decode([]byte(address))
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := chain.FindUTXO(pubKeyHash)
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	UTXOs, err := UTXOSet.FindUTXO(pubKeyHash)
+	if err != nil {
+		return err
+	}
 
 	for _, out := range UTXOs {
 		balance += out.Value
 	}
 
 	fmt.Printf("Balance of %s: %d\n", address, balance)
+	return nil
 }
 
-func (cli *CommandLine) send(from, to string, amount int) {
-	if !wallet.ValidateAddress(from) {
-		log.Panicln("Address is not valid")
+func (cli *CommandLine) send(from, to string, amount, fee int, noMine bool) error {
+	if err := cli.checkAddress(from); err != nil {
+		return err
 	}
 
-	if !wallet.ValidateAddress(to) {
-		log.Panicln("Address is not valid")
+	if err := cli.checkAddress(to); err != nil {
+		return err
 	}
 
-	chain := blockchain.ContinueBlockChain(from)
+	wallets, err := wallet.CreateWallets(cli.walletOptions())
+	if err != nil {
+		return err
+	}
+
+	w, err := wallets.GetWallet(from)
+	if err != nil {
+		return err
+	}
+
+	chain, err := blockchain.ContinueBlockChain(from, cli.chainOptions())
+	if err != nil {
+		return err
+	}
 	defer HandleClose(chain.Database)
 
-	tx := blockchain.NewTransaction(from, to, amount, chain)
-	chain.AddBlock([]*blockchain.Transaction{tx})
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	tx, err := blockchain.NewTransaction(&w, to, amount, fee, &UTXOSet)
+	if err != nil {
+		return err
+	}
+
+	if noMine {
+		err = blockchain.Mempool{Blockchain: chain}.Add(tx)
+		if err != nil {
+			fmt.Println("Transaction rejected")
+			return err
+		}
+
+		fmt.Printf("Transaction %x added to the mempool\n", tx.ID)
+		return nil
+	}
+
+	useSigner(chain, &w)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	_, err = chain.MineBlock(ctx, from, []*blockchain.Transaction{tx})
+	if err != nil {
+		fmt.Println("Transaction rejected")
+		return err
+	}
+
 	fmt.Println("Success!")
+	return nil
+}
+
+func (cli *CommandLine) mine(minerAddress string) error {
+	if err := cli.checkAddress(minerAddress); err != nil {
+		return err
+	}
+
+	chain, err := blockchain.ContinueBlockChain(minerAddress, cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer HandleClose(chain.Database)
+
+	err = cli.useMinerSigner(chain, minerAddress)
+	if err != nil {
+		return err
+	}
+
+	mempool := blockchain.Mempool{Blockchain: chain}
+	txs, err := mempool.Transactions()
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	block, err := chain.MineBlock(ctx, minerAddress, txs)
+	if err != nil {
+		fmt.Println("Block rejected")
+		return err
+	}
+
+	fmt.Printf("Mined block %x at height %d with %d transactions from the mempool\n",
+		block.Hash, block.Height, len(txs))
+	return nil
+}
+
+// useSigner lets the wallet seal blocks when the chain runs proof of
+// authority.
+func useSigner(chain *blockchain.BlockChain, w *wallet.Wallet) {
+	if poa, ok := chain.Consensus.(*blockchain.PoAEngine); ok {
+		poa.Signer = &w.PrivateKey
+	}
+}
+
+// useMinerSigner loads the wallet of the miner to seal blocks with, when the
+// chain runs proof of authority. Proof of work needs no wallet.
+func (cli *CommandLine) useMinerSigner(chain *blockchain.BlockChain, minerAddress string) error {
+	if _, ok := chain.Consensus.(*blockchain.PoAEngine); !ok {
+		return nil
+	}
+
+	wallets, err := wallet.CreateWallets(cli.walletOptions())
+	if err != nil {
+		return err
+	}
+
+	w, err := wallets.GetWallet(minerAddress)
+	if err != nil {
+		return err
+	}
+
+	useSigner(chain, &w)
+	return nil
+}
+
+func (cli *CommandLine) generate(blocks int, minerAddress string) error {
+	if err := cli.checkAddress(minerAddress); err != nil {
+		return err
+	}
+
+	chain, err := blockchain.ContinueBlockChain(minerAddress, cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer HandleClose(chain.Database)
+
+	err = cli.useMinerSigner(chain, minerAddress)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	mempool := blockchain.Mempool{Blockchain: chain}
+
+	for i := 0; i < blocks; i++ {
+		txs, err := mempool.Transactions()
+		if err != nil {
+			return err
+		}
+
+		block, err := chain.MineBlock(ctx, minerAddress, txs)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%x\n", block.Hash)
+	}
+
+	return nil
+}
+
+func (cli *CommandLine) supply() error {
+	chain, err := blockchain.ContinueBlockChain("", cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer HandleClose(chain.Database)
+
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+
+	circulating, err := blockchain.UTXOSet{Blockchain: chain}.TotalValue()
+	if err != nil {
+		return err
+	}
+
+	params := chain.Params
+	fmt.Printf("Height: %d\n", height)
+	fmt.Printf("Circulating supply: %d\n", circulating)
+	fmt.Printf("Max issued supply: %d\n", params.IssuedSupply(height+1))
+	fmt.Printf("Max supply: %d\n", params.MaxSupply)
+	fmt.Printf("Next block subsidy: %d\n", params.Subsidy(height+1))
+	if params.HalvingInterval > 0 {
+		next := (height/params.HalvingInterval + 1) * params.HalvingInterval
+		fmt.Printf("Next halving: height %d\n", next)
+	}
+
+	return nil
+}
+
+func (cli *CommandLine) getChainTips() error {
+	chain, err := blockchain.ContinueBlockChain("", cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer HandleClose(chain.Database)
+
+	tips, err := chain.ChainTips()
+	if err != nil {
+		return err
+	}
+
+	for _, tip := range tips {
+		fmt.Printf("Height: %d\n", tip.Height)
+		fmt.Printf("Hash: %x\n", tip.Hash)
+		fmt.Printf("Branch length: %d\n", tip.BranchLen)
+		fmt.Printf("Chain work: %s\n", tip.Work)
+		fmt.Printf("Status: %s\n", tip.Status)
+		fmt.Println()
+	}
+
+	return nil
+}
+
+func (cli *CommandLine) addrBook() (*p2p.AddrBook, error) {
+	return p2p.LoadAddrBook(cli.Network.DataDir(cli.DataDir))
+}
+
+func (cli *CommandLine) listPeers() error {
+	book, err := cli.addrBook()
+	if err != nil {
+		return err
+	}
+
+	for _, peer := range book.Peers(time.Now()) {
+		fmt.Printf("Address: %s\n", peer.Addr)
+		if peer.LastSeen.IsZero() {
+			fmt.Println("Last seen: never")
+		} else {
+			fmt.Printf("Last seen: %s\n", peer.LastSeen.Format(time.RFC3339))
+		}
+		fmt.Printf("Score: %d\n", peer.Score)
+		if !peer.BannedUntil.IsZero() {
+			fmt.Printf("Banned until: %s\n", peer.BannedUntil.Format(time.RFC3339))
+		}
+		fmt.Println()
+	}
+
+	return nil
+}
+
+func (cli *CommandLine) addPeer(addr string) error {
+	book, err := cli.addrBook()
+	if err != nil {
+		return err
+	}
+
+	err = book.Add(addr)
+	if err != nil {
+		return err
+	}
+
+	return book.Save()
 }
 
-func (cli *CommandLine) Run() {
-	cli.validateArgs()
+func (cli *CommandLine) banPeer(host string, duration time.Duration) error {
+	book, err := cli.addrBook()
+	if err != nil {
+		return err
+	}
+
+	until := time.Now().Add(duration)
+	book.Ban(host, until)
+
+	err = book.Save()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Banned %s until %s\n", host, until.Format(time.RFC3339))
+	return nil
+}
+
+// rpcOptions returns the options of a JSON-RPC server. The password is read
+// from GOBLOCKCHAIN_RPCPASSWORD when not given, to keep it off the command
+// line.
+func (cli *CommandLine) rpcOptions(addr, user, password string) rpc.Options {
+	if password == "" {
+		password = os.Getenv(rpcPasswordEnv)
+	}
+
+	return rpc.Options{
+		Addr:     addr,
+		User:     user,
+		Password: password,
+		Wallets:  cli.walletOptions(),
+	}
+}
+
+func (cli *CommandLine) startRPC(opts rpc.Options) error {
+	chain, err := blockchain.ContinueBlockChain("", cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer HandleClose(chain.Database)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	return rpc.NewServer(chain, opts).Run(ctx)
+}
+
+func (cli *CommandLine) startExplorer(opts explorer.Options) error {
+	chain, err := blockchain.ContinueBlockChain("", cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer HandleClose(chain.Database)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	return explorer.NewServer(chain, opts).Run(ctx)
+}
+
+// runAll runs the services until ctx is done or one of them fails, which
+// stops the others. It returns the first error.
+func runAll(ctx context.Context, services ...func(context.Context) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(services))
+	for _, run := range services {
+		go func(run func(context.Context) error) {
+			err := run(ctx)
+			cancel()
+			errs <- err
+		}(run)
+	}
+
+	var first error
+	for range services {
+		err := <-errs
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// startNode runs a node, with a JSON-RPC server and an explorer next to it
+// when their options have an address. The JSON-RPC server hands the
+// transactions it sends to the node.
+func (cli *CommandLine) startNode(port int, peers []string, minerAddress string, maxInbound, maxOutbound int, rpcOpts rpc.Options, explorerOpts explorer.Options) error {
+	if minerAddress != "" {
+		if err := cli.checkAddress(minerAddress); err != nil {
+			return err
+		}
+	}
+
+	chain, err := blockchain.ContinueBlockChain(minerAddress, cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer HandleClose(chain.Database)
+
+	if minerAddress != "" {
+		err = cli.useMinerSigner(chain, minerAddress)
+		if err != nil {
+			return err
+		}
+	}
+
+	book, err := cli.addrBook()
+	if err != nil {
+		return err
+	}
+
+	node, err := p2p.NewNode(chain, p2p.Options{
+		ListenAddr:   ":" + strconv.Itoa(port),
+		Peers:        peers,
+		Network:      cli.Network,
+		MinerAddress: minerAddress,
+		AddrBook:     book,
+		MaxInbound:   maxInbound,
+		MaxOutbound:  maxOutbound,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	services := []func(context.Context) error{node.Run}
+
+	if rpcOpts.Addr != "" {
+		rpcOpts.Submit = node.SubmitTransaction
+		services = append(services, rpc.NewServer(chain, rpcOpts).Run)
+	}
+	if explorerOpts.Addr != "" {
+		services = append(services, explorer.NewServer(chain, explorerOpts).Run)
+	}
+
+	return runAll(ctx, services...)
+}
+
+func (cli *CommandLine) getDifficulty() error {
+	chain, err := blockchain.ContinueBlockChain("", cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer HandleClose(chain.Database)
+
+	if _, ok := chain.Consensus.(*blockchain.PowEngine); !ok {
+		return errors.New("the chain does not use proof of work")
+	}
+
+	tip, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		return err
+	}
+
+	next, err := chain.NextTarget(tip)
+	if err != nil {
+		return err
+	}
+
+	params := chain.Params
+	fmt.Printf("Height: %d\n", tip.Height)
+	fmt.Printf("Target: %064x\n", tip.TargetInt())
+	fmt.Printf("Difficulty: %.2f\n", params.Difficulty(tip.TargetInt()))
+	fmt.Printf("Next target: %064x\n", next)
+	fmt.Printf("Next difficulty: %.2f\n", params.Difficulty(next))
+	if params.RetargetInterval > 0 {
+		retarget := (tip.Height/params.RetargetInterval + 1) * params.RetargetInterval
+		fmt.Printf("Next retarget: height %d\n", retarget)
+	}
+
+	return nil
+}
+
+// Run executes the command given in os.Args and returns the exit code of
+// the process.
+func (cli *CommandLine) Run() int {
+	err := cli.run()
+	if err != nil && err != errUsage {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+	}
+	return ExitCode(err)
+}
+
+func (cli *CommandLine) run() error {
+	globalFlags := flag.NewFlagSet("go-blockchain", flag.ExitOnError)
+	globalFlags.Usage = cli.printUsage
+	dataDir := globalFlags.String("datadir", defaultDataDir(), "Where the chain and the wallets are stored")
+	workers := globalFlags.Int("workers", 0, "Number of goroutines mining blocks, 0 for one per CPU")
+	network := globalFlags.String("network", blockchain.Mainnet.Name, "The network: mainnet, testnet or regtest")
+	regtest := globalFlags.Bool("regtest", false, "Use the local test network")
+	genesisFile := globalFlags.String("genesis", "", "JSON genesis configuration file")
+
+	err := globalFlags.Parse(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	cli.DataDir = *dataDir
+	cli.Workers = *workers
+	if *regtest {
+		*network = blockchain.Regtest.Name
+	}
+	cli.Network, err = blockchain.NetworkByName(*network)
+	if err != nil {
+		return err
+	}
+	if *genesisFile != "" {
+		config, err := blockchain.LoadGenesisConfig(*genesisFile)
+		if err != nil {
+			return err
+		}
+		cli.Genesis = &config
+	}
+
+	args := globalFlags.Args()
+	if err := cli.validateArgs(args); err != nil {
+		return err
+	}
 
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	createBlockChainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
@@ -136,90 +928,364 @@ func (cli *CommandLine) Run() {
 	printChainCmd := flag.NewFlagSet("print", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
+	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	reindexTxCmd := flag.NewFlagSet("reindextx", flag.ExitOnError)
+	getTransactionCmd := flag.NewFlagSet("gettransaction", flag.ExitOnError)
+	getBlockCmd := flag.NewFlagSet("getblock", flag.ExitOnError)
+	getMerkleProofCmd := flag.NewFlagSet("getmerkleproof", flag.ExitOnError)
+	verifyMerkleProofCmd := flag.NewFlagSet("verifymerkleproof", flag.ExitOnError)
+	verifyChainCmd := flag.NewFlagSet("verifychain", flag.ExitOnError)
+	mineCmd := flag.NewFlagSet("mine", flag.ExitOnError)
+	supplyCmd := flag.NewFlagSet("supply", flag.ExitOnError)
+	getDifficultyCmd := flag.NewFlagSet("getdifficulty", flag.ExitOnError)
+	generateCmd := flag.NewFlagSet("generate", flag.ExitOnError)
+	getChainTipsCmd := flag.NewFlagSet("getchaintips", flag.ExitOnError)
+	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	listPeersCmd := flag.NewFlagSet("listpeers", flag.ExitOnError)
+	addPeerCmd := flag.NewFlagSet("addpeer", flag.ExitOnError)
+	banPeerCmd := flag.NewFlagSet("banpeer", flag.ExitOnError)
+	startRPCCmd := flag.NewFlagSet("startrpc", flag.ExitOnError)
+	startExplorerCmd := flag.NewFlagSet("startexplorer", flag.ExitOnError)
 
 	getBalanceAddress := getBalanceCmd.String("address", "", "The balance of one address")
-	createBlockChainAddress := createBlockChainCmd.String("address", "", "The address to receive coinbase tx")
+	createBlockChainAddress := createBlockChainCmd.String("address", "", "The address to receive the genesis reward, refused when the genesis configuration sets one")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+	sendFee := sendCmd.Int("fee", 0, "Fee paid to the miner")
+	sendNoMine := sendCmd.Bool("nomine", false, "Only add the transaction to the mempool")
+	mineAddress := mineCmd.String("address", "", "The address to receive the coinbase reward")
+	generateBlocks := generateCmd.Int("blocks", 1, "Number of blocks to mine")
+	generateAddress := generateCmd.String("address", "", "The address to receive the coinbase rewards")
+	getTransactionID := getTransactionCmd.String("id", "", "The transaction ID in hex")
+	startNodePort := startNodeCmd.Int("port", 3000, "The port to accept peers on")
+	startNodePeers := startNodeCmd.String("peers", "", "Comma separated addresses of the nodes to connect to")
+	startNodeMiner := startNodeCmd.String("miner", "", "The address to receive the rewards of the blocks mined by the node")
+	startNodeMaxInbound := startNodeCmd.Int("maxinbound", 0, "Most connections accepted from peers, 0 for the default")
+	startNodeMaxOutbound := startNodeCmd.Int("maxoutbound", 0, "Most connections opened to peers, 0 for the default")
+	startNodeRPCAddr := startNodeCmd.String("rpcaddr", "", "The HOST:PORT of the JSON-RPC server, none when empty")
+	startNodeRPCUser := startNodeCmd.String("rpcuser", "", "The user of the JSON-RPC clients")
+	startNodeRPCPassword := startNodeCmd.String("rpcpassword", "", "The password of the JSON-RPC clients, "+rpcPasswordEnv+" when empty")
+	startNodeExplorerAddr := startNodeCmd.String("exploreraddr", "", "The HOST:PORT of the REST explorer, none when empty")
+	addPeerAddr := addPeerCmd.String("addr", "", "The HOST:PORT of the node")
+	banPeerHost := banPeerCmd.String("host", "", "The node to ban as HOST:PORT, or a host to ban all its nodes")
+	banPeerDuration := banPeerCmd.Duration("duration", p2p.DefaultBanDuration, "How long the node or host stays banned")
+	startRPCAddr := startRPCCmd.String("addr", rpc.DefaultAddr, "The HOST:PORT to listen on")
+	startRPCUser := startRPCCmd.String("user", "", "The user of the clients")
+	startRPCPassword := startRPCCmd.String("password", "", "The password of the clients, "+rpcPasswordEnv+" when empty")
+	startExplorerAddr := startExplorerCmd.String("addr", explorer.DefaultAddr, "The HOST:PORT to listen on")
+	getBlockHeight := getBlockCmd.Int("height", -1, "The height of the block")
+	getBlockHash := getBlockCmd.String("hash", "", "The hash of the block in hex")
+	getMerkleProofID := getMerkleProofCmd.String("id", "", "The transaction ID in hex")
+	verifyMerkleProofRoot := verifyMerkleProofCmd.String("root", "", "The tx root of the block in hex")
+	verifyMerkleProofID := verifyMerkleProofCmd.String("id", "", "The transaction ID in hex")
+	verifyMerkleProofProof := verifyMerkleProofCmd.String("proof", "", "The proof printed by getmerkleproof")
 
-	switch os.Args[1] {
+	switch args[0] {
 	case "getbalance":
-		err := getBalanceCmd.Parse(os.Args[2:])
+		err := getBalanceCmd.Parse(args[1:])
 		if err != nil {
-			log.Panicln("getBalanceCmd.Parse failed on cli.run: ", err)
+			return err
 		}
 
 	case "createblockchain":
-		err := createBlockChainCmd.Parse(os.Args[2:])
+		err := createBlockChainCmd.Parse(args[1:])
 		if err != nil {
-			log.Panicln("createBlockChainCmd.Parse failed on cli.Run: ", err)
+			return err
 		}
 
 	case "send":
-		err := sendCmd.Parse(os.Args[2:])
+		err := sendCmd.Parse(args[1:])
 		if err != nil {
-			log.Panicln("sendCmd.Parse failed on cli.Run: ", err)
+			return err
 		}
 
 	case "printchain":
-		err := printChainCmd.Parse(os.Args[2:])
+		err := printChainCmd.Parse(args[1:])
 		if err != nil {
-			log.Panicln("printChainCmd.Parse failed on cli.Run: ", err)
+			return err
 		}
 
 	case "createwallet":
-		err := createWalletCmd.Parse(os.Args[2:])
+		err := createWalletCmd.Parse(args[1:])
 		if err != nil {
-			log.Panicln("createWalletCmd.Parse failed on cli.Run: ", err)
+			return err
 		}
 
 	case "listaddresses":
-		err := listAddressesCmd.Parse(os.Args[2:])
+		err := listAddressesCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "reindexutxo":
+		err := reindexUTXOCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "reindextx":
+		err := reindexTxCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "gettransaction":
+		err := getTransactionCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "getblock":
+		err := getBlockCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "getmerkleproof":
+		err := getMerkleProofCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "verifymerkleproof":
+		err := verifyMerkleProofCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "verifychain":
+		err := verifyChainCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "mine":
+		err := mineCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "supply":
+		err := supplyCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "getdifficulty":
+		err := getDifficultyCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "generate":
+		err := generateCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "getchaintips":
+		err := getChainTipsCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "startnode":
+		err := startNodeCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "listpeers":
+		err := listPeersCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "addpeer":
+		err := addPeerCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "banpeer":
+		err := banPeerCmd.Parse(args[1:])
 		if err != nil {
-			log.Panicln("listAddressesCmd.Parse failed on cli.Run: ", err)
+			return err
+		}
+
+	case "startrpc":
+		err := startRPCCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "startexplorer":
+		err := startExplorerCmd.Parse(args[1:])
+		if err != nil {
+			return err
 		}
 
 	default:
 		cli.printUsage()
-		runtime.Goexit()
+		return errUsage
 	}
 
 	if getBalanceCmd.Parsed() {
 		if *getBalanceAddress == "" {
 			getBalanceCmd.Usage()
-			runtime.Goexit()
+			return errUsage
 		}
-		cli.getBalance(*getBalanceAddress)
+		return cli.getBalance(*getBalanceAddress)
 	}
 
 	if createBlockChainCmd.Parsed() {
-		if *createBlockChainAddress == "" {
-			getBalanceCmd.Usage()
-			runtime.Goexit()
-		}
-		cli.createBlockChain(*createBlockChainAddress)
+		return cli.createBlockChain(*createBlockChainAddress)
 	}
 
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 {
 			sendCmd.Usage()
-			runtime.Goexit()
+			return errUsage
 		}
-		cli.send(*sendFrom, *sendTo, *sendAmount)
+		return cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, *sendNoMine)
 	}
 
 	if printChainCmd.Parsed() {
-		cli.printChain()
+		return cli.printChain()
 	}
 
 	if createWalletCmd.Parsed() {
-		cli.createWallet()
+		return cli.createWallet()
 	}
 
 	if listAddressesCmd.Parsed() {
-		cli.listAddresses()
+		return cli.listAddresses()
+	}
+
+	if reindexUTXOCmd.Parsed() {
+		return cli.reindexUTXO()
+	}
+
+	if reindexTxCmd.Parsed() {
+		return cli.reindexTransactions()
+	}
+
+	if getTransactionCmd.Parsed() {
+		if *getTransactionID == "" {
+			getTransactionCmd.Usage()
+			return errUsage
+		}
+		return cli.getTransaction(*getTransactionID)
+	}
+
+	if getBlockCmd.Parsed() {
+		if (*getBlockHeight < 0) == (*getBlockHash == "") {
+			getBlockCmd.Usage()
+			return errUsage
+		}
+		return cli.getBlock(*getBlockHeight, *getBlockHash)
+	}
+
+	if getMerkleProofCmd.Parsed() {
+		if *getMerkleProofID == "" {
+			getMerkleProofCmd.Usage()
+			return errUsage
+		}
+		return cli.getMerkleProof(*getMerkleProofID)
+	}
+
+	if verifyMerkleProofCmd.Parsed() {
+		if *verifyMerkleProofRoot == "" || *verifyMerkleProofID == "" {
+			verifyMerkleProofCmd.Usage()
+			return errUsage
+		}
+		return cli.verifyMerkleProof(*verifyMerkleProofRoot, *verifyMerkleProofID, *verifyMerkleProofProof)
+	}
+
+	if verifyChainCmd.Parsed() {
+		return cli.verifyChain()
+	}
+
+	if mineCmd.Parsed() {
+		if *mineAddress == "" {
+			mineCmd.Usage()
+			return errUsage
+		}
+		return cli.mine(*mineAddress)
 	}
+
+	if supplyCmd.Parsed() {
+		return cli.supply()
+	}
+
+	if getDifficultyCmd.Parsed() {
+		return cli.getDifficulty()
+	}
+
+	if generateCmd.Parsed() {
+		if *generateAddress == "" || *generateBlocks <= 0 {
+			generateCmd.Usage()
+			return errUsage
+		}
+		return cli.generate(*generateBlocks, *generateAddress)
+	}
+
+	if getChainTipsCmd.Parsed() {
+		return cli.getChainTips()
+	}
+
+	if startNodeCmd.Parsed() {
+		if *startNodePort <= 0 || *startNodeMaxInbound < 0 || *startNodeMaxOutbound < 0 {
+			startNodeCmd.Usage()
+			return errUsage
+		}
+		var peers []string
+		if *startNodePeers != "" {
+			peers = strings.Split(*startNodePeers, ",")
+		}
+		rpcOpts := cli.rpcOptions(*startNodeRPCAddr, *startNodeRPCUser, *startNodeRPCPassword)
+		explorerOpts := explorer.Options{Addr: *startNodeExplorerAddr}
+		return cli.startNode(*startNodePort, peers, *startNodeMiner, *startNodeMaxInbound, *startNodeMaxOutbound, rpcOpts, explorerOpts)
+	}
+
+	if listPeersCmd.Parsed() {
+		return cli.listPeers()
+	}
+
+	if addPeerCmd.Parsed() {
+		if *addPeerAddr == "" {
+			addPeerCmd.Usage()
+			return errUsage
+		}
+		return cli.addPeer(*addPeerAddr)
+	}
+
+	if banPeerCmd.Parsed() {
+		if *banPeerHost == "" || *banPeerDuration <= 0 {
+			banPeerCmd.Usage()
+			return errUsage
+		}
+		return cli.banPeer(*banPeerHost, *banPeerDuration)
+	}
+
+	if startRPCCmd.Parsed() {
+		if *startRPCAddr == "" {
+			startRPCCmd.Usage()
+			return errUsage
+		}
+		return cli.startRPC(cli.rpcOptions(*startRPCAddr, *startRPCUser, *startRPCPassword))
+	}
+
+	if startExplorerCmd.Parsed() {
+		if *startExplorerAddr == "" {
+			startExplorerCmd.Usage()
+			return errUsage
+		}
+		return cli.startExplorer(explorer.Options{Addr: *startExplorerAddr})
+	}
+
+	return nil
 }
 
 func HandleClose(closer io.Closer) {
@@ -0,0 +1,57 @@
+package cli
+
+import (
+	"errors"
+	"go-blockchain/blockchain"
+	"go-blockchain/p2p"
+	"go-blockchain/wallet"
+)
+
+// Exit codes returned by CommandLine.Run, so scripts can tell failures apart.
+const (
+	ExitOK             = 0
+	ExitFailure        = 1
+	ExitUsage          = 2
+	ExitInvalidAddress = 3
+	ExitNoChain        = 4
+	ExitChainExists    = 5
+	ExitNotEnoughFunds = 6
+	ExitNotFound       = 7
+	ExitInvalid        = 8
+)
+
+var (
+	errUsage       = errors.New("invalid usage")
+	errInvalidTxID = errors.New("transaction ID is not valid")
+)
+
+func ExitCode(err error) int {
+	var txErr *blockchain.TxValidationError
+	var chainErr *blockchain.ChainVerifyError
+
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.Is(err, errUsage), errors.Is(err, p2p.ErrInvalidPeerAddr):
+		return ExitUsage
+	case errors.Is(err, wallet.ErrInvalidAddress):
+		return ExitInvalidAddress
+	case errors.Is(err, blockchain.ErrNoChain):
+		return ExitNoChain
+	case errors.Is(err, blockchain.ErrChainExists):
+		return ExitChainExists
+	case errors.Is(err, blockchain.ErrNotEnoughFunds):
+		return ExitNotEnoughFunds
+	case errors.Is(err, blockchain.ErrTxNotFound),
+		errors.Is(err, blockchain.ErrBlockNotFound),
+		errors.Is(err, wallet.ErrWalletNotFound):
+		return ExitNotFound
+	case errors.As(err, &txErr), errors.As(err, &chainErr),
+		errors.Is(err, blockchain.ErrAlreadyPending), errors.Is(err, blockchain.ErrMissingCoinbase),
+		errors.Is(err, blockchain.ErrSignerOutOfTurn), errors.Is(err, blockchain.ErrUnknownSigner),
+		errors.Is(err, blockchain.ErrGenesisMismatch):
+		return ExitInvalid
+	default:
+		return ExitFailure
+	}
+}
@@ -0,0 +1,407 @@
+package explorer
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"go-blockchain/blockchain"
+	"go-blockchain/rpc"
+	"go-blockchain/wallet"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultLimit = 20
+	maxLimit     = 100
+
+	hashLen = 32
+)
+
+// Page is a page of a list. Next is the from parameter that gets the next
+// page, empty on the last one.
+type Page struct {
+	Items interface{} `json:"items"`
+	Next  string      `json:"next,omitempty"`
+}
+
+// UTXO is an unspent output with the transaction and index it comes from.
+type UTXO struct {
+	TxID string `json:"txid"`
+	Out  int    `json:"out"`
+	rpc.TxOutput
+}
+
+func badRequest(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", errBadRequest, fmt.Sprintf(format, a...))
+}
+
+func decodeHash(name, value string) ([]byte, error) {
+	hash, err := hex.DecodeString(value)
+	if err != nil || len(hash) != hashLen {
+		return nil, badRequest("%s is not a valid hex hash", name)
+	}
+	return hash, nil
+}
+
+// limit reads the limit parameter of a page.
+func limit(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return defaultLimit, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 || limit > maxLimit {
+		return 0, badRequest("limit must be between 1 and %d", maxLimit)
+	}
+	return limit, nil
+}
+
+// cursor splits a from parameter made of a hash and an index, like
+// "HASH:INDEX".
+func cursor(from string) ([]byte, int, error) {
+	parts := strings.Split(from, ":")
+	if len(parts) != 2 {
+		return nil, 0, badRequest("from must be HASH:INDEX")
+	}
+
+	hash, err := decodeHash("from", parts[0])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	index, err := strconv.Atoi(parts[1])
+	if err != nil || index < 0 {
+		return nil, 0, badRequest("from must be HASH:INDEX")
+	}
+
+	return hash, index, nil
+}
+
+func formatCursor(hash []byte, index int) string {
+	return fmt.Sprintf("%x:%d", hash, index)
+}
+
+func (s *Server) addressVersion() byte {
+	return s.chain.Params.AddressVersion
+}
+
+// iterator walks the active chain from the block of the from parameter, or
+// from the tip. A block of a side branch, like the cursor of a page read
+// before a reorganization, is a bad request: walking from it would list
+// blocks outside the active chain.
+func (s *Server) iterator(from []byte) (*blockchain.BlockChainIterator, error) {
+	if from == nil {
+		return s.chain.TipIterator()
+	}
+
+	block, err := s.chain.GetBlock(from)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := s.chain.GetBlockHashByHeight(block.Height)
+	if err != nil && err != blockchain.ErrBlockNotFound {
+		return nil, err
+	}
+	if !bytes.Equal(hash, from) {
+		return nil, badRequest("from %x is not in the active chain", from)
+	}
+
+	return &blockchain.BlockChainIterator{CurrentHash: from, Database: s.chain.Database}, nil
+}
+
+func (s *Server) notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, fmt.Errorf("no such path %s", r.URL.Path))
+}
+
+// handleBlocks lists the blocks of the active chain, the tip first. The from
+// parameter is the hash of the first block of the page.
+func (s *Server) handleBlocks(w http.ResponseWriter, r *http.Request) {
+	limit, err := limit(r)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	var from []byte
+	if value := r.URL.Query().Get("from"); value != "" {
+		from, err = decodeHash("from", value)
+		if err != nil {
+			fail(w, err)
+			return
+		}
+	}
+
+	iter, err := s.iterator(from)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	page := Page{}
+	blocks := []rpc.Block{}
+
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			fail(w, err)
+			return
+		}
+
+		blocks = append(blocks, rpc.NewBlock(block, s.addressVersion()))
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+		if len(blocks) == limit {
+			page.Next = hex.EncodeToString(block.PrevHash)
+			break
+		}
+	}
+
+	page.Items = blocks
+	writeJSON(w, page)
+}
+
+func (s *Server) handleBlock(w http.ResponseWriter, r *http.Request) {
+	hash, err := decodeHash("hash", strings.TrimPrefix(r.URL.Path, "/blocks/"))
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	block, err := s.chain.GetBlock(hash)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	writeJSON(w, rpc.NewBlock(block, s.addressVersion()))
+}
+
+func (s *Server) handleTx(w http.ResponseWriter, r *http.Request) {
+	ID, err := decodeHash("id", strings.TrimPrefix(r.URL.Path, "/tx/"))
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	loc, err := s.chain.FindTransactionLocation(ID)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	block, err := s.chain.GetBlock(loc.BlockHash)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	writeJSON(w, rpc.TransactionResult{
+		Block:       hex.EncodeToString(block.Hash),
+		Height:      block.Height,
+		Position:    loc.Index,
+		Transaction: rpc.NewTransaction(block.Transactions[loc.Index], s.addressVersion()),
+	})
+}
+
+// handleAddress serves /address/{addr}/utxos, /balance and /history.
+func (s *Server) handleAddress(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/address/"), "/")
+	if len(parts) != 2 {
+		s.notFound(w, r)
+		return
+	}
+
+	address := parts[0]
+	pubKeyHash, err := wallet.AddressPubKeyHash(address, s.addressVersion())
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	switch parts[1] {
+	case "utxos":
+		s.handleUTXOs(w, r, pubKeyHash)
+	case "balance":
+		s.handleBalance(w, r, address, pubKeyHash)
+	case "history":
+		s.handleHistory(w, r, pubKeyHash)
+	default:
+		s.notFound(w, r)
+	}
+}
+
+// handleUTXOs lists the unspent outputs of the address, by transaction ID
+// and index. The from parameter is the TXID:INDEX of the first output of the
+// page.
+func (s *Server) handleUTXOs(w http.ResponseWriter, r *http.Request, pubKeyHash []byte) {
+	limit, err := limit(r)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	var fromID []byte
+	fromIndex := 0
+	if value := r.URL.Query().Get("from"); value != "" {
+		fromID, fromIndex, err = cursor(value)
+		if err != nil {
+			fail(w, err)
+			return
+		}
+	}
+
+	UTXOSet := blockchain.UTXOSet{Blockchain: s.chain}
+	unspent, err := UTXOSet.FindUnspentOutputs(pubKeyHash)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	page := Page{}
+	utxos := []UTXO{}
+
+	for _, out := range unspent {
+		// Outputs before the cursor were on the previous pages.
+		if fromID != nil {
+			cmp := bytes.Compare(out.TxID, fromID)
+			if cmp < 0 || (cmp == 0 && out.Index < fromIndex) {
+				continue
+			}
+		}
+
+		if len(utxos) == limit {
+			page.Next = formatCursor(out.TxID, out.Index)
+			break
+		}
+
+		utxos = append(utxos, UTXO{
+			TxID: hex.EncodeToString(out.TxID),
+			Out:  out.Index,
+			TxOutput: rpc.TxOutput{
+				Value:      out.Output.Value,
+				PubKeyHash: hex.EncodeToString(out.Output.PubKeyHash),
+				Address:    wallet.PubKeyHashAddress(out.Output.PubKeyHash, s.addressVersion()),
+			},
+		})
+	}
+
+	page.Items = utxos
+	writeJSON(w, page)
+}
+
+func (s *Server) handleBalance(w http.ResponseWriter, r *http.Request, address string, pubKeyHash []byte) {
+	UTXOSet := blockchain.UTXOSet{Blockchain: s.chain}
+	UTXOs, err := UTXOSet.FindUTXO(pubKeyHash)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	balance := 0
+	for _, out := range UTXOs {
+		balance += out.Value
+	}
+
+	writeJSON(w, rpc.BalanceResult{Address: address, Balance: balance})
+}
+
+// involves tells if the transaction pays the key or spends its outputs.
+func involves(tx *blockchain.Transaction, pubKeyHash []byte) bool {
+	for _, out := range tx.Outputs {
+		if out.IsLockedWithKey(pubKeyHash) {
+			return true
+		}
+	}
+
+	if tx.IsCoinbase() {
+		return false
+	}
+
+	for _, in := range tx.Inputs {
+		if in.UsesKey(pubKeyHash) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleHistory lists the confirmed transactions that pay the address or
+// spend from it, the newest first. The from parameter is the BLOCK:POSITION
+// of the first transaction of the page. There is no index by address, so
+// the chain is walked from the cursor until the page is full.
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request, pubKeyHash []byte) {
+	limit, err := limit(r)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	var from []byte
+	fromPosition := -1
+	if value := r.URL.Query().Get("from"); value != "" {
+		from, fromPosition, err = cursor(value)
+		if err != nil {
+			fail(w, err)
+			return
+		}
+	}
+
+	iter, err := s.iterator(from)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	page := Page{}
+	history := []rpc.TransactionResult{}
+
+	for page.Next == "" {
+		if err := r.Context().Err(); err != nil {
+			return
+		}
+
+		block, err := iter.Next()
+		if err != nil {
+			fail(w, err)
+			return
+		}
+
+		last := len(block.Transactions) - 1
+		if fromPosition >= 0 && fromPosition < last {
+			last = fromPosition
+		}
+		fromPosition = -1
+
+		for i := last; i >= 0; i-- {
+			tx := block.Transactions[i]
+			if !involves(tx, pubKeyHash) {
+				continue
+			}
+
+			if len(history) == limit {
+				page.Next = formatCursor(block.Hash, i)
+				break
+			}
+
+			history = append(history, rpc.TransactionResult{
+				Block:       hex.EncodeToString(block.Hash),
+				Height:      block.Height,
+				Position:    i,
+				Transaction: rpc.NewTransaction(tx, s.addressVersion()),
+			})
+		}
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	page.Items = history
+	writeJSON(w, page)
+}
@@ -0,0 +1,122 @@
+package explorer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go-blockchain/blockchain"
+	"go-blockchain/wallet"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// DefaultAddr only accepts local clients.
+	DefaultAddr = "127.0.0.1:8080"
+
+	shutdownTimeout = 10 * time.Second
+)
+
+// errBadRequest marks the errors in the parameters of a request.
+var errBadRequest = errors.New("bad request")
+
+// Options configures a Server.
+type Options struct {
+	// Addr is where the server listens, like "127.0.0.1:8080".
+	Addr string
+}
+
+// Server answers read-only REST requests about a chain with JSON. It only
+// reads the database, so it can share the chain with a node adding blocks.
+type Server struct {
+	chain *blockchain.BlockChain
+	opts  Options
+	mux   *http.ServeMux
+}
+
+func NewServer(chain *blockchain.BlockChain, opts Options) *Server {
+	if opts.Addr == "" {
+		opts.Addr = DefaultAddr
+	}
+
+	s := &Server{chain: chain, opts: opts, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/", s.notFound)
+	s.mux.HandleFunc("/blocks", s.handleBlocks)
+	s.mux.HandleFunc("/blocks/", s.handleBlock)
+	s.mux.HandleFunc("/tx/", s.handleTx)
+	s.mux.HandleFunc("/address/", s.handleAddress)
+	return s
+}
+
+// Run serves requests until ctx is done. The requests in progress are
+// cancelled with it.
+func (s *Server) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.opts.Addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Explorer listening on %s", listener.Addr())
+
+	server := &http.Server{
+		Handler:     s,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	err = server.Serve(listener)
+	if err == http.ErrServerClosed {
+		<-done
+		return nil
+	}
+	return err
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("only GET is allowed"))
+		return
+	}
+
+	s.mux.ServeHTTP(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+type errorBody struct {
+	Error string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorBody{err.Error()})
+}
+
+// fail answers with the status telling err.
+func fail(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+
+	switch {
+	case errors.Is(err, errBadRequest), errors.Is(err, wallet.ErrInvalidAddress):
+		status = http.StatusBadRequest
+	case errors.Is(err, blockchain.ErrBlockNotFound), errors.Is(err, blockchain.ErrTxNotFound):
+		status = http.StatusNotFound
+	}
+
+	writeError(w, status, err)
+}
@@ -0,0 +1,344 @@
+package explorer
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go-blockchain/blockchain"
+	"go-blockchain/rpc"
+	"go-blockchain/wallet"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testPage struct {
+	Items json.RawMessage `json:"items"`
+	Next  string          `json:"next"`
+}
+
+func newTestWallet(t *testing.T) (*wallet.Wallet, string) {
+	t.Helper()
+
+	w, err := wallet.MakeWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, string(w.Address(blockchain.RegtestChainParams.AddressVersion))
+}
+
+// newTestChain creates a regtest chain whose genesis block pays the address.
+func newTestChain(t *testing.T, address string) *blockchain.BlockChain {
+	t.Helper()
+
+	opts := blockchain.Regtest.Options(t.TempDir())
+	opts.Genesis.Address = ""
+	opts.Mining.Workers = 1
+
+	chain, err := blockchain.InitBlockChain(address, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { chain.Database.Close() })
+	return chain
+}
+
+func mineBlocks(t *testing.T, chain *blockchain.BlockChain, address string, n int, txs ...*blockchain.Transaction) []*blockchain.Block {
+	t.Helper()
+
+	var blocks []*blockchain.Block
+	for i := 0; i < n; i++ {
+		block, err := chain.MineBlock(context.Background(), address, txs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block)
+		txs = nil
+	}
+	return blocks
+}
+
+func newTestServer(t *testing.T, chain *blockchain.BlockChain) *httptest.Server {
+	t.Helper()
+
+	ts := httptest.NewServer(NewServer(chain, Options{}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// get fetches the path and decodes the reply into v, failing unless the
+// status is want.
+func get(t *testing.T, ts *httptest.Server, path string, want int, v interface{}) {
+	t.Helper()
+
+	resp, err := ts.Client().Get(ts.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != want {
+		var body errorBody
+		json.NewDecoder(resp.Body).Decode(&body)
+		t.Fatalf("GET %s: status %d %q, want %d", path, resp.StatusCode, body.Error, want)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+}
+
+// getPages follows the pages of the list at the path, whose query ends
+// with the from parameter, and returns their items.
+func getPages(t *testing.T, ts *httptest.Server, path string, items func(json.RawMessage) int) int {
+	t.Helper()
+
+	pages := 0
+	from := ""
+	for {
+		var page testPage
+		get(t, ts, path+from, http.StatusOK, &page)
+		pages++
+
+		if items(page.Items) == 0 && page.Next != "" {
+			t.Fatalf("GET %s: empty page with a next one", path+from)
+		}
+		if page.Next == "" {
+			return pages
+		}
+		from = page.Next
+	}
+}
+
+func TestBlocksPages(t *testing.T) {
+	_, address := newTestWallet(t)
+	chain := newTestChain(t, address)
+	mineBlocks(t, chain, address, 24)
+	ts := newTestServer(t, chain)
+
+	var heights []int
+	pages := getPages(t, ts, "/blocks?limit=10&from=", func(raw json.RawMessage) int {
+		var blocks []rpc.Block
+		if err := json.Unmarshal(raw, &blocks); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, block := range blocks {
+			hash, err := chain.GetBlockHashByHeight(block.Height)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if block.Hash != hex.EncodeToString(hash) {
+				t.Errorf("block at height %d is %s, want %x", block.Height, block.Hash, hash)
+			}
+			heights = append(heights, block.Height)
+		}
+		return len(blocks)
+	})
+
+	if pages != 3 {
+		t.Errorf("%d pages, want 3", pages)
+	}
+	if len(heights) != 25 {
+		t.Fatalf("%d blocks, want 25", len(heights))
+	}
+	for i, height := range heights {
+		if height != 24-i {
+			t.Fatalf("heights %v, want the tip first down to genesis", heights)
+		}
+	}
+
+	// The default limit.
+	var page testPage
+	get(t, ts, "/blocks", http.StatusOK, &page)
+	var blocks []rpc.Block
+	if err := json.Unmarshal(page.Items, &blocks); err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != defaultLimit || page.Next != hex.EncodeToString(hashAt(t, chain, 4)) {
+		t.Errorf("default page has %d blocks and next %q", len(blocks), page.Next)
+	}
+}
+
+func hashAt(t *testing.T, chain *blockchain.BlockChain, height int) []byte {
+	t.Helper()
+
+	hash, err := chain.GetBlockHashByHeight(height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestUTXOsAndHistoryPages(t *testing.T) {
+	w, address := newTestWallet(t)
+	_, to := newTestWallet(t)
+	chain := newTestChain(t, address)
+	mineBlocks(t, chain, address, 6)
+
+	tx, err := blockchain.NewTransaction(w, to, 30, 2, &blockchain.UTXOSet{Blockchain: chain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, chain, address, 2, tx)
+	ts := newTestServer(t, chain)
+
+	unspent, err := blockchain.UTXOSet{Blockchain: chain}.FindUnspentOutputs(wallet.PublicKeyHash(w.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var utxos []UTXO
+	getPages(t, ts, "/address/"+address+"/utxos?limit=3&from=", func(raw json.RawMessage) int {
+		var page []UTXO
+		if err := json.Unmarshal(raw, &page); err != nil {
+			t.Fatal(err)
+		}
+		utxos = append(utxos, page...)
+		return len(page)
+	})
+
+	balance := 0
+	if len(utxos) != len(unspent) {
+		t.Fatalf("%d outputs, want %d", len(utxos), len(unspent))
+	}
+	for i, out := range unspent {
+		if utxos[i].TxID != hex.EncodeToString(out.TxID) || utxos[i].Out != out.Index || utxos[i].Value != out.Output.Value {
+			t.Errorf("output %d is %+v, want %x:%d", i, utxos[i], out.TxID, out.Index)
+		}
+		balance += out.Output.Value
+	}
+
+	var result rpc.BalanceResult
+	get(t, ts, "/address/"+address+"/balance", http.StatusOK, &result)
+	if result.Balance != balance {
+		t.Errorf("balance %d, want %d", result.Balance, balance)
+	}
+
+	// Every block pays the address, and the transaction spends from it.
+	var history []rpc.TransactionResult
+	getPages(t, ts, "/address/"+address+"/history?limit=2&from=", func(raw json.RawMessage) int {
+		var page []rpc.TransactionResult
+		if err := json.Unmarshal(raw, &page); err != nil {
+			t.Fatal(err)
+		}
+		history = append(history, page...)
+		return len(page)
+	})
+
+	if len(history) != 10 {
+		t.Fatalf("%d transactions in the history, want 10", len(history))
+	}
+	// The newest first: the coinbase of block 8, then the transaction and
+	// the coinbase of block 7.
+	if history[1].Transaction.ID != hex.EncodeToString(tx.ID) || history[1].Height != 7 || history[1].Position != 1 {
+		t.Errorf("second transaction is %+v, want %x", history[1], tx.ID)
+	}
+	for i := 1; i < len(history); i++ {
+		prev, cur := history[i-1], history[i]
+		if cur.Height > prev.Height || (cur.Height == prev.Height && cur.Position >= prev.Position) {
+			t.Fatalf("history is not the newest first at %d: %+v after %+v", i, cur, prev)
+		}
+	}
+
+	var page testPage
+	get(t, ts, "/address/"+to+"/history", http.StatusOK, &page)
+	if !strings.Contains(string(page.Items), hex.EncodeToString(tx.ID)) || page.Next != "" {
+		t.Errorf("history of the recipient = %s, want the transaction", page.Items)
+	}
+}
+
+// TestCursorsOutsideTheActiveChain checks that a cursor on a side branch,
+// like one read before a reorganization, is refused.
+func TestCursorsOutsideTheActiveChain(t *testing.T) {
+	_, address := newTestWallet(t)
+	_, other := newTestWallet(t)
+
+	chain := newTestChain(t, address)
+	side := newTestChain(t, address)
+	mineBlocks(t, chain, address, 3)
+
+	sideBlocks := mineBlocks(t, side, other, 2)
+	for _, block := range sideBlocks {
+		err := chain.ProcessBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts := newTestServer(t, chain)
+	sideHash := hex.EncodeToString(sideBlocks[1].Hash)
+	unknown := strings.Repeat("ab", hashLen)
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/blocks?from=" + sideHash, http.StatusBadRequest},
+		{"/address/" + other + "/history?from=" + sideHash + ":0", http.StatusBadRequest},
+		{"/blocks?from=" + unknown, http.StatusNotFound},
+		{"/address/" + other + "/history?from=" + unknown + ":0", http.StatusNotFound},
+		{"/blocks/" + sideHash, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		var body map[string]interface{}
+		get(t, ts, test.path, test.want, &body)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	_, address := newTestWallet(t)
+	chain := newTestChain(t, address)
+	ts := newTestServer(t, chain)
+
+	unknown := strings.Repeat("ab", hashLen)
+	genesis := hex.EncodeToString(chain.LastHash)
+	mainnet := blockchain.UnspendableAddress(blockchain.DefaultChainParams.AddressVersion)
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/blocks?limit=0", http.StatusBadRequest},
+		{fmt.Sprintf("/blocks?limit=%d", maxLimit+1), http.StatusBadRequest},
+		{"/blocks?limit=ten", http.StatusBadRequest},
+		{"/blocks?from=xyz", http.StatusBadRequest},
+		{"/blocks?from=abcd", http.StatusBadRequest},
+		{"/blocks/xyz", http.StatusBadRequest},
+		{"/tx/abcd", http.StatusBadRequest},
+		{"/address/invalid/balance", http.StatusBadRequest},
+		{"/address/" + mainnet + "/balance", http.StatusBadRequest},
+		{"/address/" + address + "/utxos?from=" + genesis, http.StatusBadRequest},
+		{"/address/" + address + "/utxos?from=" + genesis + ":-1", http.StatusBadRequest},
+		{"/address/" + address + "/utxos?from=xyz:0", http.StatusBadRequest},
+		{"/address/" + address + "/history?from=" + genesis + ":x", http.StatusBadRequest},
+		{"/address/" + address + "/history?limit=1000", http.StatusBadRequest},
+		{"/blocks/" + unknown, http.StatusNotFound},
+		{"/tx/" + unknown, http.StatusNotFound},
+		{"/nosuchpath", http.StatusNotFound},
+		{"/address/" + address, http.StatusNotFound},
+		{"/address/" + address + "/nosuchlist", http.StatusNotFound},
+		{"/address/" + address + "/balance/more", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		var body errorBody
+		get(t, ts, test.path, test.want, &body)
+		if body.Error == "" {
+			t.Errorf("GET %s: no error message", test.path)
+		}
+	}
+
+	resp, err := ts.Client().Post(ts.URL+"/blocks", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST status %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
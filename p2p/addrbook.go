@@ -0,0 +1,371 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	addrBookFileName = "peers.json"
+
+	// BanScore is the misbehaviour score that gets a node banned.
+	BanScore = 100
+	// DefaultBanDuration is how long a misbehaving node stays banned.
+	DefaultBanDuration = 24 * time.Hour
+)
+
+var ErrInvalidPeerAddr = errors.New("peer address must be HOST:PORT")
+
+// AddrBook lists the known nodes, and their misbehaviour scores and bans.
+// Misbehaving nodes are scored and banned by HOST:PORT, so other nodes of
+// the same host are not refused with them. Banning a host alone refuses
+// every node of the host. The book is stored as JSON in the data directory
+// and is safe for concurrent use.
+type AddrBook struct {
+	Addrs map[string]*KnownAddr `json:"addrs"`
+	// Hosts holds the scores and bans, by HOST:PORT or by host alone.
+	Hosts map[string]*HostRecord `json:"hosts"`
+
+	mu   sync.Mutex
+	path string
+	// modTime is when the file was last read or written by us.
+	modTime time.Time
+}
+
+type KnownAddr struct {
+	// LastSeen is when a connection to the node last completed the
+	// handshake, zero if it never did.
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+type HostRecord struct {
+	Score       int       `json:"score"`
+	BannedUntil time.Time `json:"bannedUntil"`
+}
+
+// PeerInfo is an entry of the address book, as listed by AddrBook.Peers.
+type PeerInfo struct {
+	// Addr is HOST:PORT, or just the host for a banned host.
+	Addr     string
+	LastSeen time.Time
+	Score    int
+	// BannedUntil is zero unless the node or its host is banned.
+	BannedUntil time.Time
+}
+
+func newAddrBook(path string) *AddrBook {
+	return &AddrBook{
+		Addrs: make(map[string]*KnownAddr),
+		Hosts: make(map[string]*HostRecord),
+		path:  path,
+	}
+}
+
+// NewMemAddrBook returns an empty address book that is never saved.
+func NewMemAddrBook() *AddrBook {
+	return newAddrBook("")
+}
+
+// LoadAddrBook reads the address book of the data directory, which is empty
+// when the file does not exist yet.
+func LoadAddrBook(dataDir string) (*AddrBook, error) {
+	book := newAddrBook(filepath.Join(dataDir, addrBookFileName))
+
+	err := book.read()
+	if os.IsNotExist(err) {
+		return book, nil
+	}
+	return book, err
+}
+
+func (b *AddrBook) read() error {
+	info, err := os.Stat(b.path)
+	if err != nil {
+		return err
+	}
+
+	content, err := ioutil.ReadFile(b.path)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(content, b)
+	if err != nil {
+		return err
+	}
+	if b.Addrs == nil {
+		b.Addrs = make(map[string]*KnownAddr)
+	}
+	if b.Hosts == nil {
+		b.Hosts = make(map[string]*HostRecord)
+	}
+
+	b.modTime = info.ModTime()
+	return nil
+}
+
+// Reload merges the changes another process, like the addpeer and banpeer
+// commands, made to the file: new addresses are added and bans extended.
+func (b *AddrBook) Reload() error {
+	if b.path == "" {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.merge()
+}
+
+func (b *AddrBook) merge() error {
+	info, err := os.Stat(b.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.ModTime().After(b.modTime) {
+		return nil
+	}
+
+	saved := newAddrBook(b.path)
+	err = saved.read()
+	if err != nil {
+		return err
+	}
+
+	for addr, known := range saved.Addrs {
+		current, ok := b.Addrs[addr]
+		if !ok {
+			b.Addrs[addr] = known
+		} else if known.LastSeen.After(current.LastSeen) {
+			current.LastSeen = known.LastSeen
+		}
+	}
+
+	for host, record := range saved.Hosts {
+		current, ok := b.Hosts[host]
+		if !ok {
+			b.Hosts[host] = record
+		} else if record.BannedUntil.After(current.BannedUntil) {
+			current.BannedUntil = record.BannedUntil
+		}
+	}
+
+	b.modTime = saved.modTime
+	return nil
+}
+
+// Save writes the book to its file, after merging the changes made to it
+// since it was read. The file is replaced at once so a reader never sees
+// half of it.
+func (b *AddrBook) Save() error {
+	if b.path == "" {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err := b.merge()
+	if err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(b, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(b.path), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp := b.path + ".tmp"
+	err = ioutil.WriteFile(tmp, content, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, b.path)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(b.path)
+	if err != nil {
+		return err
+	}
+	b.modTime = info.ModTime()
+	return nil
+}
+
+// hostOf returns the host of HOST:PORT, or the string itself when it has no
+// port.
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// Add adds the address of a node to connect to.
+func (b *AddrBook) Add(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || port == "" {
+		return ErrInvalidPeerAddr
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.Addrs[addr]; !ok {
+		b.Addrs[addr] = &KnownAddr{}
+	}
+	return nil
+}
+
+// Seen records a completed handshake with the node at addr, adding it to
+// the book.
+func (b *AddrBook) Seen(addr string, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.Addrs[addr] = &KnownAddr{LastSeen: now}
+}
+
+// Addresses lists the known addresses, the last seen first.
+func (b *AddrBook) Addresses() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var addrs []string
+	for addr := range b.Addrs {
+		addrs = append(addrs, addr)
+	}
+
+	sort.Slice(addrs, func(i, j int) bool {
+		seen, other := b.Addrs[addrs[i]].LastSeen, b.Addrs[addrs[j]].LastSeen
+		if !seen.Equal(other) {
+			return seen.After(other)
+		}
+		return addrs[i] < addrs[j]
+	})
+	return addrs
+}
+
+func (b *AddrBook) host(addr string) *HostRecord {
+	record, ok := b.Hosts[addr]
+	if !ok {
+		record = &HostRecord{}
+		b.Hosts[addr] = record
+	}
+	return record
+}
+
+// bannedUntil returns when the ban of the address, or of its host, ends.
+func (b *AddrBook) bannedUntil(addr string) time.Time {
+	var until time.Time
+	for _, key := range []string{addr, hostOf(addr)} {
+		if record, ok := b.Hosts[key]; ok && record.BannedUntil.After(until) {
+			until = record.BannedUntil
+		}
+	}
+	return until
+}
+
+// Ban refuses the node at HOST:PORT, or every node of a host given alone,
+// until the time. Its score starts over.
+func (b *AddrBook) Ban(addr string, until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	record := b.host(addr)
+	record.Score = 0
+	if until.After(record.BannedUntil) {
+		record.BannedUntil = until
+	}
+}
+
+// Banned tells if the node at HOST:PORT, or its host, is banned.
+func (b *AddrBook) Banned(addr string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return now.Before(b.bannedUntil(addr))
+}
+
+// Misbehaved adds to the score of the node at HOST:PORT and bans it for
+// DefaultBanDuration once it reaches BanScore. It tells if the node got
+// banned.
+func (b *AddrBook) Misbehaved(addr string, score int, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	record := b.host(addr)
+	record.Score += score
+	if record.Score < BanScore {
+		return false
+	}
+
+	record.Score = 0
+	record.BannedUntil = now.Add(DefaultBanDuration)
+	return true
+}
+
+// Peers lists the known addresses, with their score and ban, then the other
+// nodes and hosts with a score or a ban.
+func (b *AddrBook) Peers(now time.Time) []PeerInfo {
+	addrs := b.Addresses()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var peers []PeerInfo
+	listed := make(map[string]bool)
+
+	info := func(addr string) PeerInfo {
+		peer := PeerInfo{Addr: addr}
+		if record, ok := b.Hosts[addr]; ok {
+			peer.Score = record.Score
+		}
+		if until := b.bannedUntil(addr); now.Before(until) {
+			peer.BannedUntil = until
+		}
+		return peer
+	}
+
+	for _, addr := range addrs {
+		peer := info(addr)
+		peer.LastSeen = b.Addrs[addr].LastSeen
+		peers = append(peers, peer)
+		listed[addr] = true
+	}
+
+	var hosts []string
+	for host := range b.Hosts {
+		if !listed[host] {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+
+	for _, host := range hosts {
+		peer := info(host)
+		if peer.Score > 0 || !peer.BannedUntil.IsZero() {
+			peers = append(peers, peer)
+		}
+	}
+
+	return peers
+}
@@ -0,0 +1,225 @@
+package p2p
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func TestAddrBookAdd(t *testing.T) {
+	book := NewMemAddrBook()
+
+	for _, addr := range []string{"", "127.0.0.1", ":3000", "127.0.0.1:"} {
+		if err := book.Add(addr); !errors.Is(err, ErrInvalidPeerAddr) {
+			t.Errorf("Add(%q) = %v, want %v", addr, err, ErrInvalidPeerAddr)
+		}
+	}
+
+	for _, addr := range []string{"127.0.0.1:3000", "127.0.0.1:3001", "[::1]:3000"} {
+		if err := book.Add(addr); err != nil {
+			t.Fatalf("Add(%q) = %v", addr, err)
+		}
+	}
+
+	// The last seen come first, then the others in order.
+	book.Seen("127.0.0.1:3001", testNow)
+	book.Seen("10.0.0.1:3000", testNow.Add(time.Minute))
+
+	want := []string{"10.0.0.1:3000", "127.0.0.1:3001", "127.0.0.1:3000", "[::1]:3000"}
+	got := book.Addresses()
+	if len(got) != len(want) {
+		t.Fatalf("Addresses() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Addresses() = %v, want %v", got, want)
+			break
+		}
+	}
+}
+
+func TestMisbehavedBansAtTheScore(t *testing.T) {
+	book := NewMemAddrBook()
+	addr := "127.0.0.1:3000"
+
+	for score := invalidTxScore; score < BanScore; score += invalidTxScore {
+		if book.Misbehaved(addr, invalidTxScore, testNow) {
+			t.Fatalf("banned at score %d, below %d", score, BanScore)
+		}
+	}
+	if book.Banned(addr, testNow) {
+		t.Fatal("banned below the score")
+	}
+
+	if !book.Misbehaved(addr, invalidTxScore, testNow) {
+		t.Fatalf("not banned at score %d", BanScore)
+	}
+	if !book.Banned(addr, testNow) {
+		t.Error("Banned() = false after reaching the score")
+	}
+
+	peers := book.Peers(testNow)
+	if len(peers) != 1 || peers[0].Addr != addr || peers[0].Score != 0 || !peers[0].BannedUntil.Equal(testNow.Add(DefaultBanDuration)) {
+		t.Errorf("Peers() = %+v, want %s banned for %s with its score reset", peers, addr, DefaultBanDuration)
+	}
+
+	// A single large score bans at once.
+	if !book.Misbehaved("127.0.0.1:3001", BanScore, testNow) {
+		t.Error("not banned by a score of BanScore")
+	}
+}
+
+// TestBansAreByNode checks that a misbehaving node does not get the other
+// nodes of its host refused, unless the host itself is banned.
+func TestBansAreByNode(t *testing.T) {
+	book := NewMemAddrBook()
+
+	book.Misbehaved("127.0.0.1:3000", BanScore, testNow)
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1:3000", true},
+		{"127.0.0.1:3001", false},
+		{"127.0.0.1", false},
+		{"10.0.0.1:3000", false},
+	}
+	for _, test := range tests {
+		if got := book.Banned(test.addr, testNow); got != test.want {
+			t.Errorf("Banned(%q) = %v, want %v", test.addr, got, test.want)
+		}
+	}
+
+	book.Ban("10.0.0.1", testNow.Add(time.Hour))
+
+	for _, addr := range []string{"10.0.0.1", "10.0.0.1:3000", "10.0.0.1:3001"} {
+		if !book.Banned(addr, testNow) {
+			t.Errorf("Banned(%q) = false after banning the host", addr)
+		}
+	}
+	if book.Banned("10.0.0.2:3000", testNow) {
+		t.Error("another host is banned")
+	}
+}
+
+func TestBansExpire(t *testing.T) {
+	book := NewMemAddrBook()
+	addr := "127.0.0.1:3000"
+	until := testNow.Add(time.Hour)
+
+	book.Misbehaved(addr, 30, testNow)
+	book.Ban(addr, until)
+
+	if !book.Banned(addr, until.Add(-time.Second)) {
+		t.Error("not banned before the ban ends")
+	}
+	if book.Banned(addr, until) {
+		t.Error("still banned when the ban ends")
+	}
+
+	// A shorter ban does not shorten the current one, a longer one extends
+	// it.
+	book.Ban(addr, testNow.Add(time.Minute))
+	if !book.Banned(addr, until.Add(-time.Second)) {
+		t.Error("a shorter ban ended the current one")
+	}
+	book.Ban(addr, until.Add(time.Hour))
+	if !book.Banned(addr, until) {
+		t.Error("a longer ban did not extend the current one")
+	}
+
+	peers := book.Peers(until.Add(2 * time.Hour))
+	if len(peers) != 0 {
+		t.Errorf("Peers() after the ban = %+v, want none", peers)
+	}
+}
+
+func TestAddrBookIsSaved(t *testing.T) {
+	dir := t.TempDir()
+
+	book, err := LoadAddrBook(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(book.Addresses()) != 0 {
+		t.Fatalf("new book has addresses %v", book.Addresses())
+	}
+
+	err = book.Add("127.0.0.1:3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	book.Seen("127.0.0.1:3001", testNow)
+	book.Misbehaved("127.0.0.1:3001", invalidBlockScore, testNow)
+	book.Ban("10.0.0.1", testNow.Add(time.Hour))
+
+	err = book.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := LoadAddrBook(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := book.Peers(testNow)
+	got := saved.Peers(testNow)
+	if len(got) != len(want) {
+		t.Fatalf("saved Peers() = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i].Addr != want[i].Addr || !got[i].LastSeen.Equal(want[i].LastSeen) ||
+			got[i].Score != want[i].Score || !got[i].BannedUntil.Equal(want[i].BannedUntil) {
+			t.Errorf("saved Peers()[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+// TestAddrBookMergesOtherWriters checks that saving keeps what another
+// process, like the banpeer command, saved meanwhile.
+func TestAddrBookMergesOtherWriters(t *testing.T) {
+	dir := t.TempDir()
+
+	node, err := LoadAddrBook(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.Seen("127.0.0.1:3000", testNow)
+	err = node.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file times of the two writes may be equal, and the node only
+	// merges a newer file.
+	time.Sleep(10 * time.Millisecond)
+
+	command, err := LoadAddrBook(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	command.Ban("127.0.0.1:3001", testNow.Add(time.Hour))
+	err = command.Add("10.0.0.1:3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = command.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !node.Banned("127.0.0.1:3001", testNow) {
+		t.Error("the ban saved by another process is missing")
+	}
+	if len(node.Addresses()) != 2 {
+		t.Errorf("Addresses() = %v, want the one added by another process too", node.Addresses())
+	}
+}
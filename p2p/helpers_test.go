@@ -0,0 +1,133 @@
+package p2p
+
+import (
+	"context"
+	"go-blockchain/blockchain"
+	"go-blockchain/wallet"
+	"net"
+	"testing"
+	"time"
+)
+
+const testTimeout = 30 * time.Second
+
+// newTestWallet returns a wallet and its regtest address.
+func newTestWallet(t *testing.T) (*wallet.Wallet, string) {
+	t.Helper()
+
+	w, err := wallet.MakeWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, string(w.Address(blockchain.RegtestChainParams.AddressVersion))
+}
+
+// testOptions are the options of a regtest chain in a temporary directory,
+// whose genesis block pays the address the chain is created with. Chains
+// created with the same address share their genesis block.
+func testOptions(t *testing.T) blockchain.Options {
+	t.Helper()
+
+	opts := blockchain.Regtest.Options(t.TempDir())
+	opts.Genesis.Address = ""
+	opts.Mining.Workers = 1
+	return opts
+}
+
+func newTestChainWithOptions(t *testing.T, address string, opts blockchain.Options) *blockchain.BlockChain {
+	t.Helper()
+
+	chain, err := blockchain.InitBlockChain(address, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { chain.Database.Close() })
+	return chain
+}
+
+func newTestChain(t *testing.T, address string) *blockchain.BlockChain {
+	t.Helper()
+	return newTestChainWithOptions(t, address, testOptions(t))
+}
+
+func mineBlocks(t *testing.T, chain *blockchain.BlockChain, address string, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		_, err := chain.MineBlock(context.Background(), address, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// freeAddr returns a local address no one listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// startNode runs a node of the chain on a free local address until the test
+// ends, and returns the node and its address.
+func startNode(t *testing.T, chain *blockchain.BlockChain, opts Options) (*Node, string) {
+	t.Helper()
+
+	opts.ListenAddr = freeAddr(t)
+	opts.Network = blockchain.Regtest
+
+	node, err := NewNode(chain, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- node.Run(ctx) }()
+
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run() = %v", err)
+		}
+	})
+
+	// Wait for the node to listen, so peers started next can connect.
+	waitFor(t, "the node to listen", func() bool {
+		conn, err := net.Dial("tcp", opts.ListenAddr)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	})
+
+	return node, opts.ListenAddr
+}
+
+// waitFor polls the condition until it holds, failing the test after
+// testTimeout.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// atHeight tells if the best height of the chain is height.
+func atHeight(chain *blockchain.BlockChain, height int) func() bool {
+	return func() bool {
+		best, err := chain.GetBestHeight()
+		return err == nil && best == height
+	}
+}
@@ -0,0 +1,157 @@
+package p2p
+
+import (
+	"context"
+	"go-blockchain/blockchain"
+	"log"
+	"time"
+)
+
+const (
+	defaultMaxInbound  = 32
+	defaultMaxOutbound = 8
+	connectInterval    = 30 * time.Second
+
+	// Misbehaviour scores added to a peer, which is banned at BanScore.
+	invalidBlockScore = 50
+	invalidTxScore    = 10
+)
+
+func (n *Node) maxInbound() int {
+	if n.opts.MaxInbound > 0 {
+		return n.opts.MaxInbound
+	}
+	return defaultMaxInbound
+}
+
+func (n *Node) maxOutbound() int {
+	if n.opts.MaxOutbound > 0 {
+		return n.opts.MaxOutbound
+	}
+	return defaultMaxOutbound
+}
+
+func (n *Node) inbound() int {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
+	count := 0
+	for p := range n.peers {
+		if p.inbound {
+			count++
+		}
+	}
+	return count
+}
+
+// connectLoop keeps up to MaxOutbound connections to the nodes of the
+// address book. It also applies the changes other processes made to the
+// book, and saves it.
+func (n *Node) connectLoop(ctx context.Context) {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(connectInterval)
+	defer ticker.Stop()
+
+	for {
+		err := n.book.Reload()
+		if err != nil {
+			log.Printf("Reading the address book: %v", err)
+		}
+
+		n.dropBanned()
+		n.connectPeers(ctx)
+
+		err = n.book.Save()
+		if err != nil {
+			log.Printf("Saving the address book: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// connectPeers connects to the known nodes, the last seen first, that are
+// neither banned nor connected yet, up to MaxOutbound connections.
+func (n *Node) connectPeers(ctx context.Context) {
+	now := time.Now()
+
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
+	connected := make(map[string]bool)
+	for p := range n.peers {
+		connected[p.bookAddr()] = true
+	}
+
+	for _, addr := range n.book.Addresses() {
+		if len(n.outbound) >= n.maxOutbound() {
+			return
+		}
+		if connected[addr] || n.outbound[addr] || n.book.Banned(addr, now) {
+			continue
+		}
+
+		n.outbound[addr] = true
+		n.wg.Add(1)
+
+		go func(addr string) {
+			defer n.wg.Done()
+
+			err := n.Connect(ctx, addr)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Connecting to %s: %v", addr, err)
+			}
+
+			n.peersMu.Lock()
+			delete(n.outbound, addr)
+			n.peersMu.Unlock()
+		}(addr)
+	}
+}
+
+// dropBanned disconnects the peers that are banned, or whose host is.
+func (n *Node) dropBanned() {
+	now := time.Now()
+
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
+	for p := range n.peers {
+		if n.book.Banned(p.scoreAddr(), now) {
+			log.Printf("Dropping banned peer %s", p)
+			p.close()
+		}
+	}
+}
+
+// misbehaving adds the score to the peer, banning and disconnecting it once
+// it reaches BanScore.
+func (n *Node) misbehaving(p *peer, score int) {
+	addr := p.scoreAddr()
+	if !n.book.Misbehaved(addr, score, time.Now()) {
+		return
+	}
+
+	log.Printf("Banning %s for %s", addr, DefaultBanDuration)
+	n.dropBanned()
+
+	err := n.book.Save()
+	if err != nil {
+		log.Printf("Saving the address book: %v", err)
+	}
+}
+
+// validBlock checks the proof of work of a block against the target it
+// claims, before it gets near the chain. Blocks of chains sealed otherwise
+// are checked by the chain alone.
+func (n *Node) validBlock(block *blockchain.Block) bool {
+	if _, ok := n.chain.Consensus.(*blockchain.PowEngine); !ok {
+		return true
+	}
+	return blockchain.NewProofOfWork(block, block.TargetInt()).Validate()
+}
@@ -0,0 +1,174 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	protocolVersion = 2
+
+	commandLength  = 12
+	checksumLength = 4
+	headerLength   = 4 + commandLength + 4 + checksumLength
+	maxPayload     = 32 << 20
+
+	// maxInvItems is the most hashes sent in one inv message.
+	maxInvItems = 500
+	// maxHeaders is the most headers sent in one headers message.
+	maxHeaders = 2000
+)
+
+// Commands of the messages between nodes.
+const (
+	cmdVersion    = "version"
+	cmdGetHeaders = "getheaders"
+	cmdHeaders    = "headers"
+	cmdInv        = "inv"
+	cmdGetData    = "getdata"
+	cmdBlock      = "block"
+	cmdTx         = "tx"
+)
+
+// Types of the items of inv and getdata messages.
+const (
+	invBlock = "block"
+	invTx    = "tx"
+)
+
+var (
+	ErrWrongMagic       = errors.New("message from another network")
+	ErrBadChecksum      = errors.New("message checksum does not match its payload")
+	ErrPayloadTooLarge  = errors.New("message payload too large")
+	ErrGenesisMismatch  = errors.New("peer has another genesis block")
+	ErrUnexpectedMsg    = errors.New("unexpected message")
+	ErrProtocolMismatch = errors.New("peer speaks another protocol version")
+	ErrBannedPeer       = errors.New("peer is banned")
+)
+
+// message is a command and its gob encoded payload. On the wire it is
+// preceded by the magic of the network, the command padded with zeros to
+// commandLength bytes, the payload length and its checksum.
+type message struct {
+	Command string
+	Payload []byte
+}
+
+// versionMsg starts the handshake. Each side sends one as soon as the
+// connection is open.
+type versionMsg struct {
+	Version     int
+	BestHeight  int
+	GenesisHash []byte
+	// ListenPort is where the sender accepts connections, zero if it does
+	// not.
+	ListenPort int
+}
+
+// getHeadersMsg asks for the headers of the active chain after the first
+// locator hash the receiver has in it, answered with a headers message.
+type getHeadersMsg struct {
+	Locator [][]byte
+}
+
+// headersMsg carries serialized headers, each following the previous one.
+type headersMsg struct {
+	Headers [][]byte
+}
+
+// invMsg announces blocks or transactions by hash.
+type invMsg struct {
+	Type  string
+	Items [][]byte
+}
+
+// getDataMsg asks for the blocks or transactions with the hashes.
+type getDataMsg struct {
+	Type  string
+	Items [][]byte
+}
+
+type blockMsg struct {
+	Block []byte
+}
+
+type txMsg struct {
+	Transaction []byte
+}
+
+func newMessage(command string, payload interface{}) (message, error) {
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(payload)
+	if err != nil {
+		return message{}, fmt.Errorf("encoding %s: %w", command, err)
+	}
+	return message{command, buffer.Bytes()}, nil
+}
+
+func (msg message) decode(payload interface{}) error {
+	err := gob.NewDecoder(bytes.NewReader(msg.Payload)).Decode(payload)
+	if err != nil {
+		return fmt.Errorf("decoding %s: %w", msg.Command, err)
+	}
+	return nil
+}
+
+func checksum(payload []byte) []byte {
+	hash := sha256.Sum256(payload)
+	return hash[:checksumLength]
+}
+
+func writeMessage(w io.Writer, magic [4]byte, msg message) error {
+	if len(msg.Command) > commandLength {
+		return fmt.Errorf("command %q is too long", msg.Command)
+	}
+
+	header := make([]byte, headerLength)
+	copy(header, magic[:])
+	copy(header[4:], msg.Command)
+	binary.BigEndian.PutUint32(header[4+commandLength:], uint32(len(msg.Payload)))
+	copy(header[4+commandLength+4:], checksum(msg.Payload))
+
+	_, err := w.Write(append(header, msg.Payload...))
+	return err
+}
+
+func readMessage(r io.Reader, magic [4]byte) (message, error) {
+	header := make([]byte, headerLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return message{}, err
+	}
+
+	if !bytes.Equal(header[:4], magic[:]) {
+		return message{}, ErrWrongMagic
+	}
+
+	command := string(bytes.TrimRight(header[4:4+commandLength], "\x00"))
+
+	length := binary.BigEndian.Uint32(header[4+commandLength:])
+	if length > maxPayload {
+		return message{}, fmt.Errorf("%s: %w", command, ErrPayloadTooLarge)
+	}
+
+	// The payload grows as it arrives, so a header alone can't make us
+	// allocate up to maxPayload.
+	var payload bytes.Buffer
+	_, err := io.CopyN(&payload, r, int64(length))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return message{}, err
+	}
+
+	if !bytes.Equal(header[4+commandLength+4:], checksum(payload.Bytes())) {
+		return message{}, fmt.Errorf("%s: %w", command, ErrBadChecksum)
+	}
+
+	return message{command, payload.Bytes()}, nil
+}
@@ -0,0 +1,54 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"runtime"
+	"testing"
+)
+
+func TestReadMessage(t *testing.T) {
+	magic := [4]byte{1, 2, 3, 4}
+	msg, err := newMessage(cmdTx, txMsg{Transaction: []byte("tx")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buffer bytes.Buffer
+	if err := writeMessage(&buffer, magic, msg); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readMessage(&buffer, magic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Command != msg.Command || !bytes.Equal(read.Payload, msg.Payload) {
+		t.Errorf("read %+v, want %+v", read, msg)
+	}
+}
+
+// TestReadMessageCutShort checks that a header announcing the largest
+// payload, followed by a few bytes, fails without allocating the payload.
+func TestReadMessageCutShort(t *testing.T) {
+	magic := [4]byte{1, 2, 3, 4}
+	var buffer bytes.Buffer
+	err := writeMessage(&buffer, magic, message{cmdTx, make([]byte, 16)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wire := buffer.Bytes()
+	binary.BigEndian.PutUint32(wire[4+commandLength:], maxPayload)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = readMessage(bytes.NewReader(wire), magic)
+	runtime.ReadMemStats(&after)
+
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("%d bytes allocated for a 16 byte payload", allocated)
+	}
+}
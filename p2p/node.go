@@ -0,0 +1,808 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go-blockchain/blockchain"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const dialTimeout = 10 * time.Second
+
+// Options configures a Node.
+type Options struct {
+	// ListenAddr is where the node accepts connections, like ":3000".
+	ListenAddr string
+	// Peers are addresses of nodes to connect to, added to the address
+	// book.
+	Peers []string
+	// AddrBook holds the known nodes, their scores and bans.
+	// When nil, a book that is never saved is used.
+	AddrBook *AddrBook
+	// MaxInbound and MaxOutbound limit the connections accepted and opened,
+	// defaultMaxInbound and defaultMaxOutbound when zero.
+	MaxInbound  int
+	MaxOutbound int
+	// Network sets the magic of the messages. Nodes of other networks are
+	// not understood.
+	Network blockchain.Network
+	// MinerAddress, when set, makes the node mine the pending transactions
+	// into a block paying this address whenever the mempool is not empty.
+	MinerAddress string
+}
+
+// Node shares the chain with other nodes over TCP. Nodes handshake with
+// their best height and genesis block, announce new blocks and transactions
+// by hash and serve them on request. A node behind its peers first
+// downloads and checks their chain of headers, then downloads the blocks
+// from all the peers that have them.
+type Node struct {
+	chain   *blockchain.BlockChain
+	opts    Options
+	genesis []byte
+	book    *AddrBook
+
+	listenPort int
+
+	// chainMu serializes the changes to the chain and the mempool. Mining
+	// holds it to read the mempool and to store the sealed block, not while
+	// sealing.
+	chainMu sync.Mutex
+
+	miningMu     sync.Mutex
+	cancelMining context.CancelFunc
+
+	peersMu sync.Mutex
+	peers   map[*peer]bool
+	// outbound holds the addresses of the connections opened by
+	// connectLoop, the ones still dialing included.
+	outbound map[string]bool
+
+	syncMu sync.Mutex
+	// inFlight holds the blocks requested and not received yet, by hash.
+	inFlight map[string]blockRequest
+	// orphans holds the requested blocks received before their parent, by
+	// parent hash.
+	orphans map[string]*blockchain.Block
+	// missing holds the headers of the header chain whose blocks are not
+	// stored, lowest first.
+	missing []*blockchain.BlockHeader
+
+	mempoolChanged chan struct{}
+	wg             sync.WaitGroup
+}
+
+func NewNode(chain *blockchain.BlockChain, opts Options) (*Node, error) {
+	genesis, err := chain.GetBlockHashByHeight(0)
+	if err != nil {
+		return nil, fmt.Errorf("reading genesis block: %w", err)
+	}
+
+	book := opts.AddrBook
+	if book == nil {
+		book = NewMemAddrBook()
+	}
+
+	for _, addr := range opts.Peers {
+		err := book.Add(addr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", addr, err)
+		}
+	}
+
+	return &Node{
+		chain:          chain,
+		opts:           opts,
+		genesis:        genesis,
+		book:           book,
+		peers:          make(map[*peer]bool),
+		outbound:       make(map[string]bool),
+		inFlight:       make(map[string]blockRequest),
+		orphans:        make(map[string]*blockchain.Block),
+		mempoolChanged: make(chan struct{}, 1),
+	}, nil
+}
+
+// Run listens for peers, connects to the configured ones and serves them
+// until ctx is done.
+func (n *Node) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", n.opts.ListenAddr)
+	if err != nil {
+		return err
+	}
+	n.listenPort = listener.Addr().(*net.TCPAddr).Port
+	log.Printf("Listening on %s", listener.Addr())
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	n.wg.Add(2)
+	go n.connectLoop(ctx)
+	go n.syncLoop(ctx)
+
+	if n.opts.MinerAddress != "" {
+		n.wg.Add(1)
+		go n.mineLoop(ctx)
+		n.signalMiner()
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				err = nil
+			}
+			listener.Close()
+			n.closePeers()
+			n.wg.Wait()
+			if saveErr := n.book.Save(); err == nil {
+				err = saveErr
+			}
+			return err
+		}
+
+		if n.inbound() >= n.maxInbound() {
+			log.Printf("Refusing %s: too many peers", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			n.serve(ctx, conn, "")
+		}()
+	}
+}
+
+// Connect opens a connection to the node at addr and serves it until it
+// closes or ctx is done.
+func (n *Node) Connect(ctx context.Context, addr string) error {
+	dialer := net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	n.serve(ctx, conn, addr)
+	return nil
+}
+
+// serve handles the connection, opened to addr or, when addr is empty,
+// accepted from a peer.
+func (n *Node) serve(ctx context.Context, conn net.Conn, addr string) {
+	if n.book.Banned(conn.RemoteAddr().String(), time.Now()) {
+		log.Printf("Refusing banned peer %s", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	p := newPeer(conn, addr)
+
+	n.peersMu.Lock()
+	n.peers[p] = true
+	n.peersMu.Unlock()
+
+	defer func() {
+		p.close()
+		n.peersMu.Lock()
+		delete(n.peers, p)
+		n.peersMu.Unlock()
+
+		n.forgetRequests(p)
+		n.requestBlocks()
+	}()
+
+	go p.writeLoop(n.opts.Network.Magic)
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.close()
+		case <-p.done:
+		}
+	}()
+
+	err := n.sendVersion(p)
+	if err != nil {
+		log.Printf("Peer %s: %v", p, err)
+		return
+	}
+
+	for {
+		msg, err := readMessage(conn, n.opts.Network.Magic)
+		if err != nil {
+			if !p.closed() {
+				log.Printf("Peer %s disconnected: %v", p, err)
+			}
+			return
+		}
+
+		err = n.handle(p, msg)
+		if err != nil {
+			log.Printf("Dropping peer %s: %v", p, err)
+			return
+		}
+	}
+}
+
+func (n *Node) closePeers() {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
+	for p := range n.peers {
+		p.close()
+	}
+}
+
+// announce sends an inv of the items to every peer done with the handshake
+// but from, which sent them to us.
+func (n *Node) announce(from *peer, invType string, items ...[]byte) {
+	msg, err := newMessage(cmdInv, invMsg{invType, items})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, p := range n.readyPeers() {
+		if p != from {
+			p.queue(msg)
+		}
+	}
+}
+
+// readyPeers lists the peers done with the handshake.
+func (n *Node) readyPeers() []*peer {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
+	var peers []*peer
+	for p := range n.peers {
+		if p.ready() && !p.closed() {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+func (n *Node) sendVersion(p *peer) error {
+	height, err := n.chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+
+	msg, err := newMessage(cmdVersion, versionMsg{protocolVersion, height, n.genesis, n.listenPort})
+	if err != nil {
+		return err
+	}
+
+	p.queue(msg)
+	return nil
+}
+
+// processBlock adds the block to the chain, and stops mining when it changed
+// the tip. Known, side branch and invalid blocks leave the miner alone, so
+// peers can't keep it from finishing a block. It tells if the tip changed.
+func (n *Node) processBlock(block *blockchain.Block) (bool, error) {
+	n.chainMu.Lock()
+	defer n.chainMu.Unlock()
+
+	tip := n.chain.LastHash
+	err := n.chain.ProcessBlock(block)
+
+	changed := !bytes.Equal(tip, n.chain.LastHash)
+	if changed {
+		n.stopMining()
+	}
+	return changed, err
+}
+
+func (n *Node) handle(p *peer, msg message) error {
+	if msg.Command != cmdVersion && !p.ready() {
+		return fmt.Errorf("%s before the handshake: %w", msg.Command, ErrUnexpectedMsg)
+	}
+
+	switch msg.Command {
+	case cmdVersion:
+		return n.handleVersion(p, msg)
+	case cmdGetHeaders:
+		return n.handleGetHeaders(p, msg)
+	case cmdHeaders:
+		return n.handleHeaders(p, msg)
+	case cmdInv:
+		return n.handleInv(p, msg)
+	case cmdGetData:
+		return n.handleGetData(p, msg)
+	case cmdBlock:
+		return n.handleBlock(p, msg)
+	case cmdTx:
+		return n.handleTx(p, msg)
+	default:
+		// Newer nodes may send commands we don't know.
+		return nil
+	}
+}
+
+func (n *Node) handleVersion(p *peer, msg message) error {
+	var version versionMsg
+	if err := msg.decode(&version); err != nil {
+		return err
+	}
+
+	if p.ready() {
+		return fmt.Errorf("second version: %w", ErrUnexpectedMsg)
+	}
+	if version.Version != protocolVersion {
+		return fmt.Errorf("%w: %d", ErrProtocolMismatch, version.Version)
+	}
+	if !bytes.Equal(version.GenesisHash, n.genesis) {
+		return fmt.Errorf("%w: %x", ErrGenesisMismatch, version.GenesisHash)
+	}
+
+	p.mu.Lock()
+	p.version = &version
+	p.height = version.BestHeight
+	p.mu.Unlock()
+
+	// An inbound peer is known by where it listens only now.
+	if n.book.Banned(p.scoreAddr(), time.Now()) {
+		return ErrBannedPeer
+	}
+
+	log.Printf("Connected to %s at height %d", p, version.BestHeight)
+
+	if addr := p.bookAddr(); addr != "" {
+		n.book.Seen(addr, time.Now())
+	}
+
+	tip, err := n.chain.HeaderTip()
+	if err != nil {
+		return err
+	}
+	if version.BestHeight > tip.Height {
+		err := n.requestHeaders(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Resume the download of the blocks of stored headers.
+	n.refreshMissing()
+	n.requestBlocks()
+
+	txs, err := blockchain.Mempool{Blockchain: n.chain}.Transactions()
+	if err != nil {
+		return err
+	}
+
+	var ids [][]byte
+	for _, tx := range txs {
+		ids = append(ids, tx.ID)
+	}
+
+	for len(ids) > 0 {
+		count := len(ids)
+		if count > maxInvItems {
+			count = maxInvItems
+		}
+
+		inv, err := newMessage(cmdInv, invMsg{invTx, ids[:count]})
+		if err != nil {
+			return err
+		}
+		p.queue(inv)
+
+		ids = ids[count:]
+	}
+
+	return nil
+}
+
+func (n *Node) handleGetHeaders(p *peer, msg message) error {
+	var getHeaders getHeadersMsg
+	if err := msg.decode(&getHeaders); err != nil {
+		return err
+	}
+
+	headers, err := n.chain.HeadersAfter(getHeaders.Locator, maxHeaders)
+	if err != nil {
+		return err
+	}
+
+	// The reply is sent even without headers, so the peer may ask again.
+	var payload headersMsg
+	for _, header := range headers {
+		payload.Headers = append(payload.Headers, header.Serialize())
+	}
+
+	reply, err := newMessage(cmdHeaders, payload)
+	if err != nil {
+		return err
+	}
+
+	p.queue(reply)
+	return nil
+}
+
+func (n *Node) handleHeaders(p *peer, msg message) error {
+	var payload headersMsg
+	if err := msg.decode(&payload); err != nil {
+		return err
+	}
+
+	if len(payload.Headers) > maxHeaders {
+		return fmt.Errorf("%d headers: %w", len(payload.Headers), ErrUnexpectedMsg)
+	}
+
+	again := p.headersReceived()
+	if len(payload.Headers) == 0 {
+		if again {
+			return n.requestHeaders(p)
+		}
+		return nil
+	}
+
+	var headers []*blockchain.BlockHeader
+	for _, data := range payload.Headers {
+		header, err := blockchain.DeserializeHeader(data)
+		if err != nil {
+			return fmt.Errorf("decoding header: %w", err)
+		}
+		headers = append(headers, header)
+	}
+
+	n.chainMu.Lock()
+	err := n.chain.AddHeaders(headers)
+	n.chainMu.Unlock()
+
+	var verifyErr *blockchain.ChainVerifyError
+	switch {
+	case err == nil:
+	case errors.Is(err, blockchain.ErrUnknownParent), errors.Is(err, blockchain.ErrInvalidBranch):
+		log.Printf("Ignoring headers from %s: %v", p, err)
+		return nil
+	case errors.As(err, &verifyErr):
+		log.Printf("Rejected headers from %s: %v", p, err)
+		if errors.Is(err, blockchain.ErrInvalidProofOfWork) {
+			n.misbehaving(p, invalidBlockScore)
+		}
+		return nil
+	default:
+		return err
+	}
+
+	p.updateHeight(headers[len(headers)-1].Height)
+
+	// A full message means the peer has more, and so does a block it
+	// announced while the headers were on their way.
+	if len(headers) == maxHeaders || again {
+		err := n.requestHeaders(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	n.refreshMissing()
+	n.requestBlocks()
+	return nil
+}
+
+func (n *Node) handleInv(p *peer, msg message) error {
+	var inv invMsg
+	if err := msg.decode(&inv); err != nil {
+		return err
+	}
+
+	var wanted [][]byte
+
+	for _, hash := range inv.Items {
+		switch inv.Type {
+		case invBlock:
+			// New blocks are downloaded once their header is.
+			known, err := n.chain.HasHeader(hash)
+			if err != nil {
+				return err
+			}
+			if !known {
+				return n.requestHeaders(p)
+			}
+
+		case invTx:
+			_, err := blockchain.Mempool{Blockchain: n.chain}.Get(hash)
+			if err == blockchain.ErrTxNotFound {
+				_, err = n.chain.FindTransaction(hash)
+			}
+			if err == blockchain.ErrTxNotFound {
+				wanted = append(wanted, hash)
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(wanted) == 0 {
+		return nil
+	}
+
+	getData, err := newMessage(cmdGetData, getDataMsg{inv.Type, wanted})
+	if err != nil {
+		return err
+	}
+
+	p.queue(getData)
+	return nil
+}
+
+func (n *Node) handleGetData(p *peer, msg message) error {
+	var getData getDataMsg
+	if err := msg.decode(&getData); err != nil {
+		return err
+	}
+
+	for _, hash := range getData.Items {
+		reply, found, err := n.data(getData.Type, hash)
+		if err != nil {
+			return err
+		}
+		if found {
+			p.queue(reply)
+		}
+	}
+
+	return nil
+}
+
+// data returns the message carrying the block or transaction with the hash,
+// pending or confirmed, and whether we have it.
+func (n *Node) data(invType string, hash []byte) (message, bool, error) {
+	switch invType {
+	case invBlock:
+		block, err := n.chain.GetBlock(hash)
+		if err == blockchain.ErrBlockNotFound {
+			return message{}, false, nil
+		}
+		if err != nil {
+			return message{}, false, err
+		}
+
+		msg, err := newMessage(cmdBlock, blockMsg{block.Serialize()})
+		return msg, err == nil, err
+
+	case invTx:
+		tx, err := blockchain.Mempool{Blockchain: n.chain}.Get(hash)
+		if err == blockchain.ErrTxNotFound {
+			var confirmed blockchain.Transaction
+			confirmed, err = n.chain.FindTransaction(hash)
+			tx = &confirmed
+		}
+		if err == blockchain.ErrTxNotFound {
+			return message{}, false, nil
+		}
+		if err != nil {
+			return message{}, false, err
+		}
+
+		msg, err := newMessage(cmdTx, txMsg{tx.Serialize()})
+		return msg, err == nil, err
+	}
+
+	return message{}, false, nil
+}
+
+func (n *Node) handleBlock(p *peer, msg message) error {
+	var payload blockMsg
+	if err := msg.decode(&payload); err != nil {
+		return err
+	}
+
+	block, err := blockchain.Deserialize(payload.Block)
+	if err != nil {
+		return fmt.Errorf("decoding block: %w", err)
+	}
+
+	requested := n.blockReceived(block.Hash)
+
+	if !n.validBlock(block) {
+		log.Printf("Rejected block %x from %s: %v", block.Hash, p, blockchain.ErrInvalidProofOfWork)
+		n.misbehaving(p, invalidBlockScore)
+		return nil
+	}
+
+	p.updateHeight(block.Height)
+
+	tipChanged, err := n.processBlock(block)
+	switch {
+	case err == nil:
+		if tipChanged {
+			n.blockConnected(p, block)
+		}
+		n.connectOrphans(p, block)
+
+	case errors.Is(err, blockchain.ErrBlockKnown):
+
+	case errors.Is(err, blockchain.ErrUnknownParent):
+		if requested {
+			n.addOrphan(block)
+		} else {
+			// A block we did not ask for, on top of headers we miss.
+			err := n.requestHeaders(p)
+			if err != nil {
+				return err
+			}
+		}
+
+	default:
+		log.Printf("Rejected block %x from %s: %v", block.Hash, p, err)
+		if errors.Is(err, blockchain.ErrInvalidProofOfWork) {
+			n.misbehaving(p, invalidBlockScore)
+		}
+		// The chain of headers may have been invalid.
+		n.refreshMissing()
+	}
+
+	n.requestBlocks()
+	return nil
+}
+
+// blockConnected relays a block from the peer that became the tip.
+func (n *Node) blockConnected(from *peer, block *blockchain.Block) {
+	log.Printf("New tip %x at height %d from %s", block.Hash, block.Height, from)
+	n.announce(from, invBlock, block.Hash)
+	n.signalMiner()
+}
+
+func (n *Node) handleTx(p *peer, msg message) error {
+	var payload txMsg
+	if err := msg.decode(&payload); err != nil {
+		return err
+	}
+
+	tx, err := blockchain.DeserializeTransaction(payload.Transaction)
+	if err != nil {
+		return fmt.Errorf("decoding transaction: %w", err)
+	}
+
+	err = n.addTransaction(tx)
+	switch {
+	case err == nil:
+		log.Printf("New transaction %x from %s", tx.ID, p)
+		n.announce(p, invTx, tx.ID)
+		n.signalMiner()
+	case errors.Is(err, blockchain.ErrAlreadyPending):
+	default:
+		log.Printf("Rejected transaction %x from %s: %v", tx.ID, p, err)
+		if errors.Is(err, blockchain.ErrBadSignature) {
+			n.misbehaving(p, invalidTxScore)
+		}
+	}
+
+	return nil
+}
+
+// SubmitTransaction adds a transaction made on this node to the mempool and
+// relays it to the peers.
+func (n *Node) SubmitTransaction(tx *blockchain.Transaction) error {
+	err := n.addTransaction(tx)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("New transaction %x submitted", tx.ID)
+	n.announce(nil, invTx, tx.ID)
+	n.signalMiner()
+	return nil
+}
+
+// addTransaction adds the transaction to the mempool. It holds chainMu, or
+// the mempool could change under a block being processed.
+func (n *Node) addTransaction(tx *blockchain.Transaction) error {
+	n.chainMu.Lock()
+	defer n.chainMu.Unlock()
+
+	return blockchain.Mempool{Blockchain: n.chain}.Add(tx)
+}
+
+func (n *Node) signalMiner() {
+	select {
+	case n.mempoolChanged <- struct{}{}:
+	default:
+	}
+}
+
+func (n *Node) stopMining() {
+	n.miningMu.Lock()
+	defer n.miningMu.Unlock()
+
+	if n.cancelMining != nil {
+		n.cancelMining()
+	}
+}
+
+// mineLoop mines the pending transactions whenever the mempool or the tip
+// changes, until the mempool is empty.
+func (n *Node) mineLoop(ctx context.Context) {
+	defer n.wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-n.mempoolChanged:
+		}
+
+		for {
+			block, err := n.mine(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, context.Canceled) {
+				// A block from a peer changed the tip, start over on top of it.
+				continue
+			}
+			if err != nil {
+				log.Printf("Mining: %v", err)
+				break
+			}
+			if block == nil {
+				break
+			}
+
+			log.Printf("Mined block %x at height %d", block.Hash, block.Height)
+			n.announce(nil, invBlock, block.Hash)
+		}
+	}
+}
+
+// mine mines the pending transactions into a block, or returns a nil block
+// when there are none. It stops with context.Canceled when a block from a
+// peer changes the tip. Blocks and headers from peers are processed while the
+// block is sealed.
+func (n *Node) mine(ctx context.Context) (*blockchain.Block, error) {
+	miningCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	n.miningMu.Lock()
+	n.cancelMining = cancel
+	n.miningMu.Unlock()
+
+	defer func() {
+		n.miningMu.Lock()
+		n.cancelMining = nil
+		n.miningMu.Unlock()
+	}()
+
+	n.chainMu.Lock()
+	txs, err := blockchain.Mempool{Blockchain: n.chain}.Transactions()
+	n.chainMu.Unlock()
+
+	if err != nil || len(txs) == 0 {
+		return nil, err
+	}
+
+	block, err := n.chain.SealBlock(miningCtx, n.opts.MinerAddress, txs)
+	if err != nil {
+		return nil, err
+	}
+
+	n.chainMu.Lock()
+	defer n.chainMu.Unlock()
+
+	err = n.chain.ProcessBlock(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// A block from a peer changed the tip after the block was sealed, so it
+	// was stored on a side branch.
+	if !bytes.Equal(n.chain.LastHash, block.Hash) {
+		return nil, context.Canceled
+	}
+
+	return block, nil
+}
@@ -0,0 +1,290 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"go-blockchain/blockchain"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// stuckEngine seals no block: Seal waits for the context to be done, like
+// a proof of work search that never ends.
+type stuckEngine struct {
+	blockchain.Consensus
+	sealing chan struct{}
+}
+
+func (e *stuckEngine) Seal(ctx context.Context, block *blockchain.Block) error {
+	select {
+	case e.sealing <- struct{}{}:
+	default:
+	}
+
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestNodesSyncBlocksAndTransactions(t *testing.T) {
+	w, address := newTestWallet(t)
+	_, to := newTestWallet(t)
+
+	miner := newTestChain(t, address)
+	relay := newTestChain(t, address)
+	last := newTestChain(t, address)
+	mineBlocks(t, miner, address, 50)
+
+	_, minerAddr := startNode(t, miner, Options{MinerAddress: address})
+	_, relayAddr := startNode(t, relay, Options{Peers: []string{minerAddr}})
+	node, _ := startNode(t, last, Options{Peers: []string{relayAddr}})
+
+	waitFor(t, "the nodes to sync", atHeight(last, 50))
+
+	tx, err := blockchain.NewTransaction(w, to, 10, 1, &blockchain.UTXOSet{Blockchain: last})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node.SubmitTransaction(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The transaction goes through the relay to the miner, whose block
+	// comes back the same way.
+	for _, chain := range []*blockchain.BlockChain{miner, relay, last} {
+		waitFor(t, "the transaction to be mined", atHeight(chain, 51))
+
+		loc, err := chain.FindTransactionLocation(tx.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(loc.BlockHash, chain.LastHash) {
+			t.Errorf("transaction mined in %x, want the tip %x", loc.BlockHash, chain.LastHash)
+		}
+	}
+
+	err = last.Verify(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestHeadersAreProcessedWhileMining checks that a node keeps syncing
+// while it searches for a block.
+func TestHeadersAreProcessedWhileMining(t *testing.T) {
+	w, address := newTestWallet(t)
+	_, to := newTestWallet(t)
+
+	ahead := newTestChain(t, address)
+	mineBlocks(t, ahead, address, 5)
+	_, aheadAddr := startNode(t, ahead, Options{})
+
+	engine := &stuckEngine{
+		Consensus: blockchain.NewPowEngine(blockchain.MiningOptions{Workers: 1}),
+		sealing:   make(chan struct{}, 1),
+	}
+	chain := newTestChain(t, address)
+	chain.Consensus = engine
+
+	tx, err := blockchain.NewTransaction(w, to, 10, 1, &blockchain.UTXOSet{Blockchain: chain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = blockchain.Mempool{Blockchain: chain}.Add(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node, _ := startNode(t, chain, Options{MinerAddress: address})
+	<-engine.sealing
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- node.Connect(ctx, aheadAddr) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	waitFor(t, "the headers", func() bool {
+		tip, err := chain.HeaderTip()
+		return err == nil && tip.Height == 5
+	})
+	waitFor(t, "the blocks", atHeight(chain, 5))
+
+	if !bytes.Equal(chain.LastHash, ahead.LastHash) {
+		t.Errorf("tip is %x, want %x", chain.LastHash, ahead.LastHash)
+	}
+}
+
+// TestOnlyANewTipStopsMining checks that known and side branch blocks from
+// peers leave the miner alone, while a block that changes the tip makes it
+// start over.
+func TestOnlyANewTipStopsMining(t *testing.T) {
+	w, address := newTestWallet(t)
+	_, to := newTestWallet(t)
+	_, other := newTestWallet(t)
+
+	chain := newTestChain(t, address)
+	side := newTestChain(t, address)
+
+	// The transaction spends the genesis output, which stays unspent on
+	// both branches.
+	tx, err := blockchain.NewTransaction(w, to, 10, 1, &blockchain.UTXOSet{Blockchain: chain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, chain, address, 1)
+
+	var sideBlocks []*blockchain.Block
+	for i := 0; i < 2; i++ {
+		block, err := side.MineBlock(context.Background(), other, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sideBlocks = append(sideBlocks, block)
+	}
+
+	engine := &stuckEngine{
+		Consensus: chain.Consensus,
+		sealing:   make(chan struct{}, 1),
+	}
+	chain.Consensus = engine
+
+	err = blockchain.Mempool{Blockchain: chain}.Add(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node, _ := startNode(t, chain, Options{MinerAddress: address})
+	<-engine.sealing
+
+	// A block on a side branch with the same work, then the same block,
+	// now known.
+	for _, block := range []*blockchain.Block{sideBlocks[0], sideBlocks[0]} {
+		changed, _ := node.processBlock(block)
+		if changed {
+			t.Fatalf("block %x changed the tip", block.Hash)
+		}
+	}
+
+	select {
+	case <-engine.sealing:
+		t.Fatal("mining started over without a new tip")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	changed, err := node.processBlock(sideBlocks[1])
+	if err != nil || !changed {
+		t.Fatalf("processBlock() = %v, %v, want a new tip", changed, err)
+	}
+
+	select {
+	case <-engine.sealing:
+	case <-time.After(testTimeout):
+		t.Fatal("mining did not start over on the new tip")
+	}
+}
+
+// TestSyncResumesFromStoredHeaders checks that a node restarted with
+// headers whose blocks it did not download yet downloads them from a peer
+// that is not ahead of its headers.
+func TestSyncResumesFromStoredHeaders(t *testing.T) {
+	_, address := newTestWallet(t)
+
+	ahead := newTestChain(t, address)
+	mineBlocks(t, ahead, address, 300)
+	_, aheadAddr := startNode(t, ahead, Options{})
+
+	chain := newTestChain(t, address)
+	headers, err := ahead.HeadersAfter(nil, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = chain.AddHeaders(headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startNode(t, chain, Options{Peers: []string{aheadAddr}})
+	waitFor(t, "the missing blocks", atHeight(chain, 300))
+
+	missing, err := chain.MissingBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 0 {
+		t.Errorf("%d blocks still missing", len(missing))
+	}
+}
+
+// misbehave connects to the node as one listening on the port and sends it
+// blocks with an invalid proof of work until it closes the connection.
+func misbehave(t *testing.T, addr string, genesis []byte, port int) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	version, err := newMessage(cmdVersion, versionMsg{protocolVersion, 0, genesis, port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := []message{version}
+
+	// A block claiming the lowest target can't meet it.
+	block := blockchain.CreateBlock(nil, genesis, 1)
+	block.Target = big.NewInt(1).Bytes()
+	for i := 0; i < BanScore/invalidBlockScore; i++ {
+		block.Nonce++
+		msg, err := newMessage(cmdBlock, blockMsg{block.Serialize()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, msg)
+	}
+
+	for _, msg := range messages {
+		err := writeMessage(conn, blockchain.Regtest.Magic, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	_, err = io.Copy(ioutil.Discard, conn)
+	if err != nil {
+		t.Fatalf("the connection was not closed: %v", err)
+	}
+}
+
+// TestMisbehavingNodesAreBannedAlone checks that a node banned for invalid
+// blocks does not get the other nodes of its host refused.
+func TestMisbehavingNodesAreBannedAlone(t *testing.T) {
+	_, address := newTestWallet(t)
+	chain := newTestChain(t, address)
+	node, addr := startNode(t, chain, Options{})
+
+	misbehave(t, addr, chain.LastHash, 4999)
+
+	if !node.book.Banned("127.0.0.1:4999", time.Now()) {
+		t.Fatal("the misbehaving node is not banned")
+	}
+	if node.book.Banned("127.0.0.1:5000", time.Now()) {
+		t.Fatal("another node of the host is banned")
+	}
+
+	// Another node of the host syncs with the node.
+	good := newTestChain(t, address)
+	mineBlocks(t, good, address, 3)
+	startNode(t, good, Options{Peers: []string{addr}})
+
+	waitFor(t, "the node to sync", atHeight(chain, 3))
+}
@@ -0,0 +1,181 @@
+package p2p
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	sendQueueLength = 1024
+	writeTimeout    = 30 * time.Second
+	headersTimeout  = 30 * time.Second
+)
+
+// peer is a connection to another node. Messages are queued by the handlers
+// and written by a goroutine of their own, so a slow peer never blocks the
+// node: one that lets its queue fill up is disconnected.
+type peer struct {
+	conn net.Conn
+	// addr is the address the connection was opened to, empty for an
+	// inbound peer.
+	addr    string
+	inbound bool
+	send    chan message
+	done    chan struct{}
+
+	closeOnce sync.Once
+
+	mu sync.Mutex
+	// version is the handshake of the peer, nil until it arrives.
+	version *versionMsg
+	// height is the best height the peer is known to have.
+	height int
+	// headersAsked is when getheaders was sent, zero once the headers
+	// arrived.
+	headersAsked time.Time
+	// headersAgain is set when the headers were wanted again while an
+	// answer was awaited, since the answer may not have them.
+	headersAgain bool
+}
+
+func newPeer(conn net.Conn, addr string) *peer {
+	return &peer{
+		conn:    conn,
+		addr:    addr,
+		inbound: addr == "",
+		send:    make(chan message, sendQueueLength),
+		done:    make(chan struct{}),
+	}
+}
+
+func (p *peer) String() string {
+	return p.conn.RemoteAddr().String()
+}
+
+// listenAddr is where the peer accepts connections, empty if it does not.
+func (p *peer) listenAddr() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.version == nil || p.version.ListenPort == 0 {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(p.String())
+	if err != nil {
+		return ""
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p.version.ListenPort))
+}
+
+// bookAddr is the address of the peer for the address book: the one it
+// was connected to or, for an inbound peer, where it listens.
+func (p *peer) bookAddr() string {
+	if !p.inbound {
+		return p.addr
+	}
+	return p.listenAddr()
+}
+
+// scoreAddr is the address the misbehaviour of the peer is scored and
+// banned by: its address in the book or, for an inbound peer that does not
+// listen, the one it connected from.
+func (p *peer) scoreAddr() string {
+	if addr := p.bookAddr(); addr != "" {
+		return addr
+	}
+	return p.String()
+}
+
+func (p *peer) ready() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.version != nil
+}
+
+func (p *peer) bestHeight() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.height
+}
+
+func (p *peer) updateHeight(height int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if height > p.height {
+		p.height = height
+	}
+}
+
+// askHeaders tells if getheaders can be sent, which is when no answer is
+// awaited or it took too long, and records it was sent.
+func (p *peer) askHeaders() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.headersAsked.IsZero() && time.Since(p.headersAsked) < headersTimeout {
+		p.headersAgain = true
+		return false
+	}
+	p.headersAsked = time.Now()
+	p.headersAgain = false
+	return true
+}
+
+// headersReceived records the answer to getheaders arrived. It tells if
+// the headers were wanted again meanwhile.
+func (p *peer) headersReceived() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	again := p.headersAgain
+	p.headersAsked = time.Time{}
+	p.headersAgain = false
+	return again
+}
+
+// queue sends the message unless the peer is closed. It never waits: a
+// peer whose queue is full does not keep up and is disconnected.
+func (p *peer) queue(msg message) {
+	select {
+	case p.send <- msg:
+	case <-p.done:
+	default:
+		log.Printf("Disconnecting %s: its send queue is full", p)
+		p.close()
+	}
+}
+
+func (p *peer) writeLoop(magic [4]byte) {
+	for {
+		select {
+		case msg := <-p.send:
+			p.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := writeMessage(p.conn, magic, msg); err != nil {
+				p.close()
+				return
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *peer) close() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+		p.conn.Close()
+	})
+}
+
+func (p *peer) closed() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,23 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+)
+
+// TestFullQueueDisconnects checks that queueing to a peer that reads
+// nothing never blocks: the peer is disconnected once its queue is full.
+func TestFullQueueDisconnects(t *testing.T) {
+	conn, other := net.Pipe()
+	defer other.Close()
+
+	p := newPeer(conn, "")
+	go p.writeLoop([4]byte{})
+
+	for i := 0; i <= sendQueueLength+1; i++ {
+		p.queue(message{cmdTx, nil})
+	}
+	if !p.closed() {
+		t.Error("peer with a full queue is still connected")
+	}
+}
@@ -0,0 +1,222 @@
+package p2p
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"go-blockchain/blockchain"
+	"log"
+	"time"
+)
+
+const (
+	// blockWindow is how far above the tip blocks are requested, which
+	// bounds the blocks kept while their parents are on their way.
+	blockWindow = 1024
+	// maxBlocksInFlight is the most blocks requested from one peer at once.
+	maxBlocksInFlight = 16
+	// blockTimeout is how long a peer has to send a requested block before
+	// it is asked to another one.
+	blockTimeout = 30 * time.Second
+	syncInterval = 5 * time.Second
+)
+
+// blockRequest is a block asked to a peer with getdata.
+type blockRequest struct {
+	peer *peer
+	sent time.Time
+}
+
+// requestHeaders asks the peer for the headers after our header tip, unless
+// it was already asked.
+func (n *Node) requestHeaders(p *peer) error {
+	if !p.askHeaders() {
+		return nil
+	}
+
+	locator, err := n.chain.Locator()
+	if err != nil {
+		return err
+	}
+
+	msg, err := newMessage(cmdGetHeaders, getHeadersMsg{locator})
+	if err != nil {
+		return err
+	}
+
+	p.queue(msg)
+	return nil
+}
+
+// refreshMissing lists again the blocks of the chain of headers not stored
+// yet, after the header tip changed.
+func (n *Node) refreshMissing() {
+	missing, err := n.chain.MissingBlocks()
+	if err != nil {
+		log.Printf("Listing missing blocks: %v", err)
+		return
+	}
+
+	n.syncMu.Lock()
+	defer n.syncMu.Unlock()
+	n.missing = missing
+}
+
+// requestBlocks asks for the missing blocks, lowest first, spreading them
+// over the peers that have them. Blocks already requested or waiting for
+// their parent are skipped.
+func (n *Node) requestBlocks() {
+	peers := n.readyPeers()
+
+	n.syncMu.Lock()
+
+	// Blocks are stored in order, the ones stored since the list was made
+	// are at its start.
+	for len(n.missing) > 0 {
+		_, err := n.chain.GetBlock(n.missing[0].Hash)
+		if err == blockchain.ErrBlockNotFound {
+			break
+		}
+		if err != nil {
+			n.syncMu.Unlock()
+			log.Printf("Reading block: %v", err)
+			return
+		}
+		n.missing = n.missing[1:]
+	}
+
+	if len(n.missing) == 0 {
+		n.syncMu.Unlock()
+		return
+	}
+
+	inFlight := make(map[*peer]int)
+	for _, req := range n.inFlight {
+		inFlight[req.peer]++
+	}
+
+	requests := make(map[*peer][][]byte)
+	limit := n.missing[0].Height + blockWindow
+
+	for _, header := range n.missing {
+		if header.Height >= limit {
+			break
+		}
+
+		key := hex.EncodeToString(header.Hash)
+		if _, ok := n.inFlight[key]; ok {
+			continue
+		}
+		if _, ok := n.orphans[hex.EncodeToString(header.PrevHash)]; ok {
+			continue
+		}
+
+		// The least busy peer that has the block.
+		var best *peer
+		for _, p := range peers {
+			if inFlight[p] >= maxBlocksInFlight || p.bestHeight() < header.Height {
+				continue
+			}
+			if best == nil || inFlight[p] < inFlight[best] {
+				best = p
+			}
+		}
+		if best == nil {
+			continue
+		}
+
+		n.inFlight[key] = blockRequest{best, time.Now()}
+		inFlight[best]++
+		requests[best] = append(requests[best], header.Hash)
+	}
+
+	n.syncMu.Unlock()
+
+	for p, hashes := range requests {
+		msg, err := newMessage(cmdGetData, getDataMsg{invBlock, hashes})
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		p.queue(msg)
+	}
+}
+
+// blockReceived forgets the request of the block and tells if it was
+// requested.
+func (n *Node) blockReceived(hash []byte) bool {
+	n.syncMu.Lock()
+	defer n.syncMu.Unlock()
+
+	key := hex.EncodeToString(hash)
+	_, requested := n.inFlight[key]
+	delete(n.inFlight, key)
+	return requested
+}
+
+// forgetRequests drops the blocks requested from the peer, or the expired
+// ones when p is nil, so they get requested again.
+func (n *Node) forgetRequests(p *peer) {
+	n.syncMu.Lock()
+	defer n.syncMu.Unlock()
+
+	for key, req := range n.inFlight {
+		if req.peer == p || (p == nil && time.Since(req.sent) > blockTimeout) {
+			delete(n.inFlight, key)
+		}
+	}
+}
+
+// addOrphan keeps a requested block that arrived before its parent.
+func (n *Node) addOrphan(block *blockchain.Block) {
+	n.syncMu.Lock()
+	defer n.syncMu.Unlock()
+
+	n.orphans[hex.EncodeToString(block.PrevHash)] = block
+}
+
+// connectOrphans adds the blocks that were waiting for the block, and their
+// own children, to the chain.
+func (n *Node) connectOrphans(from *peer, block *blockchain.Block) {
+	for {
+		n.syncMu.Lock()
+		key := hex.EncodeToString(block.Hash)
+		child, ok := n.orphans[key]
+		delete(n.orphans, key)
+		n.syncMu.Unlock()
+
+		if !ok {
+			return
+		}
+
+		tipChanged, err := n.processBlock(child)
+		if err != nil && !errors.Is(err, blockchain.ErrBlockKnown) {
+			log.Printf("Rejected block %x: %v", child.Hash, err)
+			return
+		}
+		if tipChanged {
+			n.blockConnected(from, child)
+		}
+
+		block = child
+	}
+}
+
+// syncLoop requests again the blocks that took too long to arrive.
+func (n *Node) syncLoop(ctx context.Context) {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.forgetRequests(nil)
+			n.refreshMissing()
+			n.requestBlocks()
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package rpc
+
+import (
+	"errors"
+	"go-blockchain/blockchain"
+	"go-blockchain/wallet"
+)
+
+// Error codes of the responses. The first ones are defined by JSON-RPC 2.0,
+// the others tell the failures of the methods apart like the exit codes of
+// the command line.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+
+	CodeInvalidAddress = -32001
+	CodeNotFound       = -32002
+	CodeNotEnoughFunds = -32003
+	CodeRejected       = -32004
+)
+
+// Error is the error object of a response.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+var (
+	errParse          = &Error{CodeParseError, "parse error"}
+	errInvalidRequest = &Error{CodeInvalidRequest, "invalid request"}
+	errMethodNotFound = &Error{CodeMethodNotFound, "method not found"}
+)
+
+func invalidParams(err error) *Error {
+	return &Error{CodeInvalidParams, "invalid params: " + err.Error()}
+}
+
+// errorFor returns the error object telling err.
+func errorFor(err error) *Error {
+	var rpcErr *Error
+	var txErr *blockchain.TxValidationError
+	var chainErr *blockchain.ChainVerifyError
+
+	code := CodeInternalError
+
+	switch {
+	case errors.As(err, &rpcErr):
+		return rpcErr
+	case errors.Is(err, wallet.ErrInvalidAddress):
+		code = CodeInvalidAddress
+	case errors.Is(err, blockchain.ErrNotEnoughFunds):
+		code = CodeNotEnoughFunds
+	case errors.Is(err, blockchain.ErrTxNotFound),
+		errors.Is(err, blockchain.ErrBlockNotFound),
+		errors.Is(err, wallet.ErrWalletNotFound):
+		code = CodeNotFound
+	case errors.As(err, &txErr), errors.As(err, &chainErr),
+		errors.Is(err, blockchain.ErrAlreadyPending), errors.Is(err, blockchain.ErrMempoolConflict),
+		errors.Is(err, blockchain.ErrSignerOutOfTurn), errors.Is(err, blockchain.ErrUnknownSigner):
+		code = CodeRejected
+	}
+
+	return &Error{code, err.Error()}
+}
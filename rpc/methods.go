@@ -0,0 +1,293 @@
+package rpc
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"go-blockchain/blockchain"
+	"go-blockchain/wallet"
+	"os"
+	"sort"
+)
+
+// method is a method of the server. Params given by position are named by
+// params, in order.
+type method struct {
+	params []string
+	call   func(ctx context.Context, params []byte) (interface{}, error)
+}
+
+func (s *Server) methodTable() map[string]method {
+	return map[string]method{
+		"getbalance":     {[]string{"address"}, s.getBalance},
+		"send":           {[]string{"from", "to", "amount", "fee", "nomine"}, s.send},
+		"createwallet":   {nil, s.createWallet},
+		"listaddresses":  {nil, s.listAddresses},
+		"printchain":     {nil, s.printChain},
+		"getblock":       {[]string{"height", "hash"}, s.getBlock},
+		"gettransaction": {[]string{"id"}, s.getTransaction},
+	}
+}
+
+func (s *Server) addressVersion() byte {
+	return s.chain.Params.AddressVersion
+}
+
+func decodeHash(name, value string) ([]byte, error) {
+	hash, err := hex.DecodeString(value)
+	if err != nil || len(hash) == 0 {
+		return nil, invalidParams(errors.New(name + " is not a valid hex hash"))
+	}
+	return hash, nil
+}
+
+func (s *Server) getBalance(ctx context.Context, raw []byte) (interface{}, error) {
+	var params struct {
+		Address string `json:"address"`
+	}
+	err := decodeParams(raw, &params)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKeyHash, err := wallet.AddressPubKeyHash(params.Address, s.addressVersion())
+	if err != nil {
+		return nil, err
+	}
+
+	UTXOSet := blockchain.UTXOSet{Blockchain: s.chain}
+	UTXOs, err := UTXOSet.FindUTXO(pubKeyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	balance := 0
+	for _, out := range UTXOs {
+		balance += out.Value
+	}
+
+	return BalanceResult{params.Address, balance}, nil
+}
+
+// send pays from a wallet of the server. The transaction is handed to
+// Options.Submit when set, otherwise it is mined at once unless nomine
+// leaves it in the mempool.
+func (s *Server) send(ctx context.Context, raw []byte) (interface{}, error) {
+	var params struct {
+		From   string `json:"from"`
+		To     string `json:"to"`
+		Amount int    `json:"amount"`
+		Fee    int    `json:"fee"`
+		NoMine bool   `json:"nomine"`
+	}
+	err := decodeParams(raw, &params)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Amount <= 0 || params.Fee < 0 {
+		return nil, invalidParams(errors.New("amount must be positive and fee not negative"))
+	}
+
+	for _, address := range []string{params.From, params.To} {
+		_, err := wallet.AddressPubKeyHash(address, s.addressVersion())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wallets, err := wallet.CreateWallets(s.opts.Wallets)
+	if os.IsNotExist(err) {
+		return nil, wallet.ErrWalletNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := wallets.GetWallet(params.From)
+	if err != nil {
+		return nil, err
+	}
+
+	UTXOSet := blockchain.UTXOSet{Blockchain: s.chain}
+	tx, err := blockchain.NewTransaction(&w, params.To, params.Amount, params.Fee, &UTXOSet)
+	if err != nil {
+		return nil, err
+	}
+
+	result := SendResult{TxID: hex.EncodeToString(tx.ID)}
+
+	switch {
+	case s.opts.Submit != nil:
+		err = s.opts.Submit(tx)
+	case params.NoMine:
+		err = blockchain.Mempool{Blockchain: s.chain}.Add(tx)
+	default:
+		// The key of the sender seals the block under proof of authority.
+		var block *blockchain.Block
+		block, err = s.chain.MineBlockSignedBy(ctx, &w.PrivateKey, params.From, []*blockchain.Transaction{tx})
+		if err == nil {
+			result.Block = hex.EncodeToString(block.Hash)
+			result.Height = block.Height
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *Server) createWallet(ctx context.Context, raw []byte) (interface{}, error) {
+	err := decodeParams(raw, &struct{}{})
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wallets, err := wallet.CreateWallets(s.opts.Wallets)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	address, err := wallets.AddWallet()
+	if err != nil {
+		return nil, err
+	}
+
+	err = wallets.SaveFile()
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := wallets.GetWallet(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return WalletResult{address, hex.EncodeToString(w.PublicKey)}, nil
+}
+
+// listAddresses lists the addresses of the wallets, none when the wallet
+// file does not exist yet.
+func (s *Server) listAddresses(ctx context.Context, raw []byte) (interface{}, error) {
+	err := decodeParams(raw, &struct{}{})
+	if err != nil {
+		return nil, err
+	}
+
+	wallets, err := wallet.CreateWallets(s.opts.Wallets)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := append([]string{}, wallets.GetAllAddresses()...)
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+// printChain returns the blocks of the active chain, the tip first. The
+// chain is followed from the tip stored in the database by the previous
+// hashes, so a block added meanwhile does not mix two branches.
+func (s *Server) printChain(ctx context.Context, raw []byte) (interface{}, error) {
+	err := decodeParams(raw, &struct{}{})
+	if err != nil {
+		return nil, err
+	}
+
+	iter, err := s.chain.TipIterator()
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := []Block{}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		blocks = append(blocks, NewBlock(block, s.addressVersion()))
+		if len(block.PrevHash) == 0 {
+			return blocks, nil
+		}
+	}
+}
+
+func (s *Server) getBlock(ctx context.Context, raw []byte) (interface{}, error) {
+	var params struct {
+		Height *int   `json:"height"`
+		Hash   string `json:"hash"`
+	}
+	err := decodeParams(raw, &params)
+	if err != nil {
+		return nil, err
+	}
+
+	var block *blockchain.Block
+
+	switch {
+	case params.Hash != "":
+		hash, err := decodeHash("hash", params.Hash)
+		if err != nil {
+			return nil, err
+		}
+		block, err = s.chain.GetBlock(hash)
+		if err != nil {
+			return nil, err
+		}
+	case params.Height != nil:
+		block, err = s.chain.GetBlockByHeight(*params.Height)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, invalidParams(errors.New("height or hash is required"))
+	}
+
+	return NewBlock(block, s.addressVersion()), nil
+}
+
+func (s *Server) getTransaction(ctx context.Context, raw []byte) (interface{}, error) {
+	var params struct {
+		ID string `json:"id"`
+	}
+	err := decodeParams(raw, &params)
+	if err != nil {
+		return nil, err
+	}
+
+	ID, err := decodeHash("id", params.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	loc, err := s.chain.FindTransactionLocation(ID)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := s.chain.GetBlock(loc.BlockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return TransactionResult{
+		Block:       hex.EncodeToString(block.Hash),
+		Height:      block.Height,
+		Position:    loc.Index,
+		Transaction: NewTransaction(block.Transactions[loc.Index], s.addressVersion()),
+	}, nil
+}
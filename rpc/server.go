@@ -0,0 +1,305 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"go-blockchain/blockchain"
+	"go-blockchain/wallet"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAddr only accepts local clients.
+	DefaultAddr = "127.0.0.1:8332"
+
+	maxRequestSize  = 1 << 20
+	shutdownTimeout = 10 * time.Second
+)
+
+// Options configures a Server.
+type Options struct {
+	// Addr is where the server listens, like "127.0.0.1:8332".
+	Addr string
+	// User and Password, when either is set, must be given by clients with
+	// HTTP basic auth.
+	User     string
+	Password string
+	// Wallets locates the wallet file used by createwallet, listaddresses
+	// and send.
+	Wallets wallet.Options
+	// Submit, when set, takes the transactions of send in place of the
+	// mempool and the miner, like a node relaying them to its peers.
+	Submit func(*blockchain.Transaction) error
+}
+
+// Server answers JSON-RPC 2.0 requests over HTTP with the operations of the
+// command line on a chain.
+type Server struct {
+	chain   *blockchain.BlockChain
+	opts    Options
+	methods map[string]method
+
+	// mu serializes the methods that write: send and createwallet.
+	mu sync.Mutex
+}
+
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	// ID is nil for a notification, which gets no response.
+	ID json.RawMessage `json:"id"`
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+func NewServer(chain *blockchain.BlockChain, opts Options) *Server {
+	if opts.Addr == "" {
+		opts.Addr = DefaultAddr
+	}
+
+	s := &Server{chain: chain, opts: opts}
+	s.methods = s.methodTable()
+	return s
+}
+
+// Run serves requests until ctx is done. The requests in progress are
+// cancelled with it.
+func (s *Server) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.opts.Addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("RPC server listening on %s", listener.Addr())
+
+	if s.opts.User == "" && s.opts.Password == "" {
+		log.Println("RPC server has no authentication, every client can use the wallets")
+	}
+
+	server := &http.Server{
+		Handler:     s,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	err = server.Serve(listener)
+	if err == http.ErrServerClosed {
+		<-done
+		return nil
+	}
+	return err
+}
+
+// authorized compares hashes of the credentials in constant time, so the
+// time taken tells nothing about them.
+func (s *Server) authorized(r *http.Request) bool {
+	if s.opts.User == "" && s.opts.Password == "" {
+		return true
+	}
+
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	userHash := sha256.Sum256([]byte(user))
+	wantUser := sha256.Sum256([]byte(s.opts.User))
+	passwordHash := sha256.Sum256([]byte(password))
+	wantPassword := sha256.Sum256([]byte(s.opts.Password))
+
+	userOK := subtle.ConstantTimeCompare(userHash[:], wantUser[:])
+	passwordOK := subtle.ConstantTimeCompare(passwordHash[:], wantPassword[:])
+	return userOK&passwordOK == 1
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="go-blockchain"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var reply interface{}
+
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		reply = s.handleBatch(r.Context(), body)
+	} else {
+		reply = s.handleSingle(r.Context(), body)
+	}
+
+	// Notifications get no response.
+	if reply == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+// handleSingle returns the response to the request, nil for a notification.
+func (s *Server) handleSingle(ctx context.Context, body []byte) interface{} {
+	if !json.Valid(body) {
+		return errorResponse(nil, errParse)
+	}
+
+	var req request
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(nil, errInvalidRequest)
+	}
+
+	resp := s.handle(ctx, req)
+	if resp == nil {
+		return nil
+	}
+	return resp
+}
+
+// handleBatch returns the responses to the requests of the batch, nil when
+// they are all notifications.
+func (s *Server) handleBatch(ctx context.Context, body []byte) interface{} {
+	var batch []json.RawMessage
+	err := json.Unmarshal(body, &batch)
+	if err != nil {
+		return errorResponse(nil, errParse)
+	}
+	if len(batch) == 0 {
+		return errorResponse(nil, errInvalidRequest)
+	}
+
+	var responses []*response
+	for _, raw := range batch {
+		var req request
+		err := json.Unmarshal(raw, &req)
+		if err != nil {
+			responses = append(responses, errorResponse(nil, errInvalidRequest))
+			continue
+		}
+
+		resp := s.handle(ctx, req)
+		if resp != nil {
+			responses = append(responses, resp)
+		}
+	}
+
+	if len(responses) == 0 {
+		return nil
+	}
+	return responses
+}
+
+func (s *Server) handle(ctx context.Context, req request) *response {
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return errorResponse(req.ID, errInvalidRequest)
+	}
+
+	m, ok := s.methods[req.Method]
+	if !ok {
+		if req.ID == nil {
+			return nil
+		}
+		return errorResponse(req.ID, errMethodNotFound)
+	}
+
+	result, err := s.call(ctx, m, req.Params)
+	if req.ID == nil {
+		return nil
+	}
+	if err != nil {
+		return errorResponse(req.ID, err)
+	}
+	return &response{JSONRPC: "2.0", Result: result, ID: req.ID}
+}
+
+func (s *Server) call(ctx context.Context, m method, raw json.RawMessage) (interface{}, error) {
+	params, err := namedParams(raw, m.params)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.call(ctx, params)
+}
+
+// namedParams turns params given by position into an object with the names
+// of the method, so every method decodes an object.
+func namedParams(raw json.RawMessage, names []string) (json.RawMessage, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return json.RawMessage("{}"), nil
+	}
+	if raw[0] != '[' {
+		return raw, nil
+	}
+
+	var values []json.RawMessage
+	err := json.Unmarshal(raw, &values)
+	if err != nil {
+		return nil, invalidParams(err)
+	}
+	if len(values) > len(names) {
+		return nil, invalidParams(errors.New("too many params"))
+	}
+
+	object := make(map[string]json.RawMessage)
+	for i, value := range values {
+		object[names[i]] = value
+	}
+
+	return json.Marshal(object)
+}
+
+// decodeParams decodes the params object into v, refusing unknown names.
+func decodeParams(params json.RawMessage, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(params))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(v)
+	if err != nil {
+		return invalidParams(err)
+	}
+	return nil
+}
+
+func errorResponse(id json.RawMessage, err error) *response {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &response{JSONRPC: "2.0", Error: errorFor(err), ID: id}
+}
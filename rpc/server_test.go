@@ -0,0 +1,308 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"go-blockchain/blockchain"
+	"go-blockchain/wallet"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const (
+	testUser     = "user"
+	testPassword = "secret"
+)
+
+// newTestServer serves a regtest chain whose genesis block pays the
+// returned address, with basic auth.
+func newTestServer(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+
+	w, err := wallet.MakeWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := string(w.Address(blockchain.RegtestChainParams.AddressVersion))
+
+	opts := blockchain.Regtest.Options(t.TempDir())
+	opts.Genesis.Address = ""
+	chain, err := blockchain.InitBlockChain(address, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { chain.Database.Close() })
+
+	server := NewServer(chain, Options{
+		User:     testUser,
+		Password: testPassword,
+		Wallets:  wallet.Options{DataDir: t.TempDir(), AddressVersion: blockchain.RegtestChainParams.AddressVersion},
+	})
+
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+	return ts, address
+}
+
+// post sends the body with the credentials and returns the status and the
+// body of the reply.
+func post(t *testing.T, ts *httptest.Server, user, password, body string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if user != "" || password != "" {
+		req.SetBasicAuth(user, password)
+	}
+
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	reply, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(reply)
+}
+
+// call sends the request and decodes its response.
+func call(t *testing.T, ts *httptest.Server, body string) response {
+	t.Helper()
+
+	status, reply := post(t, ts, testUser, testPassword, body)
+	if status != http.StatusOK {
+		t.Fatalf("status %d, want %d: %s", status, http.StatusOK, reply)
+	}
+
+	var resp response
+	err := json.Unmarshal([]byte(reply), &resp)
+	if err != nil {
+		t.Fatalf("decoding %s: %v", reply, err)
+	}
+	return resp
+}
+
+func TestAuthentication(t *testing.T) {
+	ts, _ := newTestServer(t)
+	body := `{"jsonrpc": "2.0", "method": "listaddresses", "id": 1}`
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		want     int
+	}{
+		{"no credentials", "", "", http.StatusUnauthorized},
+		{"wrong password", testUser, "wrong", http.StatusUnauthorized},
+		{"wrong user", "wrong", testPassword, http.StatusUnauthorized},
+		{"empty password", testUser, "", http.StatusUnauthorized},
+		{"right credentials", testUser, testPassword, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, reply := post(t, ts, test.user, test.password, body)
+			if status != test.want {
+				t.Errorf("status %d, want %d: %s", status, test.want, reply)
+			}
+			if status == http.StatusUnauthorized && strings.Contains(reply, "jsonrpc") {
+				t.Errorf("unauthorized request answered: %s", reply)
+			}
+		})
+	}
+
+	resp, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET status %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestNotificationsGetNoResponse(t *testing.T) {
+	ts, address := newTestServer(t)
+
+	bodies := []string{
+		fmt.Sprintf(`{"jsonrpc": "2.0", "method": "getbalance", "params": [%q]}`, address),
+		`{"jsonrpc": "2.0", "method": "getbalance", "params": ["invalid"]}`,
+		`{"jsonrpc": "2.0", "method": "nosuchmethod"}`,
+		`[{"jsonrpc": "2.0", "method": "listaddresses"}, {"jsonrpc": "2.0", "method": "nosuchmethod"}]`,
+	}
+
+	for _, body := range bodies {
+		status, reply := post(t, ts, testUser, testPassword, body)
+		if status != http.StatusNoContent || reply != "" {
+			t.Errorf("%s: status %d with %q, want %d without a body", body, status, reply, http.StatusNoContent)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	ts, address := newTestServer(t)
+
+	body := fmt.Sprintf(`[
+		{"jsonrpc": "2.0", "method": "getbalance", "params": [%q], "id": 1},
+		{"jsonrpc": "2.0", "method": "listaddresses"},
+		{"jsonrpc": "2.0", "method": "nosuchmethod", "id": "two"},
+		1,
+		{"jsonrpc": "2.0", "method": "getblock", "params": {"height": 0}, "id": 3}
+	]`, address)
+
+	status, reply := post(t, ts, testUser, testPassword, body)
+	if status != http.StatusOK {
+		t.Fatalf("status %d, want %d: %s", status, http.StatusOK, reply)
+	}
+
+	var responses []struct {
+		Result json.RawMessage `json:"result"`
+		Error  *Error          `json:"error"`
+		ID     json.RawMessage `json:"id"`
+	}
+	err := json.Unmarshal([]byte(reply), &responses)
+	if err != nil {
+		t.Fatalf("decoding %s: %v", reply, err)
+	}
+
+	// The notification gets no response, the others one each, in order.
+	want := []struct {
+		id   string
+		code int
+	}{
+		{"1", 0},
+		{`"two"`, CodeMethodNotFound},
+		{"null", CodeInvalidRequest},
+		{"3", 0},
+	}
+	if len(responses) != len(want) {
+		t.Fatalf("%d responses, want %d: %s", len(responses), len(want), reply)
+	}
+
+	for i, resp := range responses {
+		if string(resp.ID) != want[i].id {
+			t.Errorf("response %d has id %s, want %s", i, resp.ID, want[i].id)
+		}
+
+		code := 0
+		if resp.Error != nil {
+			code = resp.Error.Code
+		}
+		if code != want[i].code {
+			t.Errorf("response %d has code %d, want %d", i, code, want[i].code)
+		}
+	}
+
+	var balance BalanceResult
+	err = json.Unmarshal(responses[0].Result, &balance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Address != address || balance.Balance != blockchain.RegtestChainParams.Subsidy(0) {
+		t.Errorf("getbalance = %+v, want the genesis subsidy", balance)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	ts, address := newTestServer(t)
+	unknown := strings.Repeat("ab", 32)
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"parse error", `{"jsonrpc": "2.0", "method"`, CodeParseError},
+		{"empty batch", `[]`, CodeInvalidRequest},
+		{"wrong version", `{"jsonrpc": "1.0", "method": "listaddresses", "id": 1}`, CodeInvalidRequest},
+		{"no method", `{"jsonrpc": "2.0", "id": 1}`, CodeInvalidRequest},
+		{"unknown method", `{"jsonrpc": "2.0", "method": "nosuchmethod", "id": 1}`, CodeMethodNotFound},
+		{"unknown param", `{"jsonrpc": "2.0", "method": "listaddresses", "params": {"all": true}, "id": 1}`, CodeInvalidParams},
+		{"too many params", `{"jsonrpc": "2.0", "method": "gettransaction", "params": ["ab", "cd"], "id": 1}`, CodeInvalidParams},
+		{"invalid hash", `{"jsonrpc": "2.0", "method": "gettransaction", "params": ["xyz"], "id": 1}`, CodeInvalidParams},
+		{"invalid address", `{"jsonrpc": "2.0", "method": "getbalance", "params": ["invalid"], "id": 1}`, CodeInvalidAddress},
+		{
+			"address of another network",
+			fmt.Sprintf(`{"jsonrpc": "2.0", "method": "getbalance", "params": [%q], "id": 1}`, blockchain.UnspendableAddress(blockchain.DefaultChainParams.AddressVersion)),
+			CodeInvalidAddress,
+		},
+		{"unknown transaction", fmt.Sprintf(`{"jsonrpc": "2.0", "method": "gettransaction", "params": [%q], "id": 1}`, unknown), CodeNotFound},
+		{"unknown block hash", fmt.Sprintf(`{"jsonrpc": "2.0", "method": "getblock", "params": {"hash": %q}, "id": 1}`, unknown), CodeNotFound},
+		{"block above the tip", `{"jsonrpc": "2.0", "method": "getblock", "params": {"height": 5}, "id": 1}`, CodeNotFound},
+		{
+			"send from an unknown wallet",
+			fmt.Sprintf(`{"jsonrpc": "2.0", "method": "send", "params": [%q, %q, 10], "id": 1}`, address, address),
+			CodeNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := call(t, ts, test.body)
+			if resp.Error == nil {
+				t.Fatalf("result %v, want error %d", resp.Result, test.want)
+			}
+			if resp.Error.Code != test.want {
+				t.Errorf("error %d %q, want %d", resp.Error.Code, resp.Error.Message, test.want)
+			}
+		})
+	}
+}
+
+func TestErrorFor(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{wallet.ErrInvalidAddress, CodeInvalidAddress},
+		{fmt.Errorf("from: %w", wallet.ErrInvalidAddress), CodeInvalidAddress},
+		{blockchain.ErrTxNotFound, CodeNotFound},
+		{blockchain.ErrBlockNotFound, CodeNotFound},
+		{wallet.ErrWalletNotFound, CodeNotFound},
+		{blockchain.ErrNotEnoughFunds, CodeNotEnoughFunds},
+		{&blockchain.TxValidationError{TxID: []byte{1}, Err: blockchain.ErrDoubleSpend}, CodeRejected},
+		{&blockchain.ChainVerifyError{BlockHash: []byte{1}, Err: blockchain.ErrInvalidTxRoot}, CodeRejected},
+		{blockchain.ErrAlreadyPending, CodeRejected},
+		{blockchain.ErrMempoolConflict, CodeRejected},
+		{blockchain.ErrSignerOutOfTurn, CodeRejected},
+		{blockchain.ErrUnknownSigner, CodeRejected},
+		{invalidParams(fmt.Errorf("bad")), CodeInvalidParams},
+		{fmt.Errorf("disk full"), CodeInternalError},
+	}
+
+	for _, test := range tests {
+		got := errorFor(test.err)
+		if got.Code != test.want {
+			t.Errorf("errorFor(%v) = %d, want %d", test.err, got.Code, test.want)
+		}
+		if got.Message != test.err.Error() {
+			t.Errorf("errorFor(%v) has message %q", test.err, got.Message)
+		}
+	}
+}
+
+func TestPrintChain(t *testing.T) {
+	ts, _ := newTestServer(t)
+
+	resp := call(t, ts, `{"jsonrpc": "2.0", "method": "printchain", "id": 1}`)
+	if resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+
+	blocks, ok := resp.Result.([]interface{})
+	if !ok || len(blocks) != 1 {
+		t.Fatalf("printchain = %v, want the genesis block", resp.Result)
+	}
+	if height := blocks[0].(map[string]interface{})["height"]; height != 0.0 {
+		t.Errorf("block at height %v, want 0", height)
+	}
+}
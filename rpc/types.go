@@ -0,0 +1,125 @@
+package rpc
+
+import (
+	"encoding/hex"
+	"fmt"
+	"go-blockchain/blockchain"
+	"go-blockchain/wallet"
+)
+
+// Block is a block as returned by the server, with hashes in hex.
+type Block struct {
+	Hash         string        `json:"hash"`
+	PrevHash     string        `json:"prevHash"`
+	Height       int           `json:"height"`
+	Version      int           `json:"version"`
+	Timestamp    int64         `json:"timestamp"`
+	Target       string        `json:"target"`
+	TxRoot       string        `json:"txRoot"`
+	Nonce        uint32        `json:"nonce"`
+	Signature    string        `json:"signature,omitempty"`
+	Transactions []Transaction `json:"transactions"`
+}
+
+type Transaction struct {
+	ID       string     `json:"id"`
+	Coinbase bool       `json:"coinbase"`
+	Inputs   []TxInput  `json:"inputs"`
+	Outputs  []TxOutput `json:"outputs"`
+}
+
+type TxInput struct {
+	// TxID and Out point to the spent output, empty in a coinbase.
+	TxID       string `json:"txid"`
+	Out        int    `json:"out"`
+	Signature  string `json:"signature"`
+	PubKey     string `json:"pubKey"`
+	ExtraNonce uint64 `json:"extraNonce,omitempty"`
+}
+
+type TxOutput struct {
+	Value      int    `json:"value"`
+	PubKeyHash string `json:"pubKeyHash"`
+	// Address is the address of the public key hash on the network.
+	Address string `json:"address"`
+}
+
+// NewBlock converts a block of the chain, whose outputs pay addresses with
+// the version.
+func NewBlock(block *blockchain.Block, version byte) Block {
+	result := Block{
+		Hash:         hex.EncodeToString(block.Hash),
+		PrevHash:     hex.EncodeToString(block.PrevHash),
+		Height:       block.Height,
+		Version:      block.Version,
+		Timestamp:    block.Timestamp,
+		Target:       fmt.Sprintf("%064x", block.TargetInt()),
+		TxRoot:       hex.EncodeToString(block.TxRoot),
+		Nonce:        block.Nonce,
+		Signature:    hex.EncodeToString(block.Signature),
+		Transactions: []Transaction{},
+	}
+
+	for _, tx := range block.Transactions {
+		result.Transactions = append(result.Transactions, NewTransaction(tx, version))
+	}
+
+	return result
+}
+
+// NewTransaction converts a transaction, whose outputs pay addresses with
+// the version.
+func NewTransaction(tx *blockchain.Transaction, version byte) Transaction {
+	result := Transaction{
+		ID:       hex.EncodeToString(tx.ID),
+		Coinbase: tx.IsCoinbase(),
+		Inputs:   []TxInput{},
+		Outputs:  []TxOutput{},
+	}
+
+	for _, in := range tx.Inputs {
+		result.Inputs = append(result.Inputs, TxInput{
+			TxID:       hex.EncodeToString(in.ID),
+			Out:        in.Out,
+			Signature:  hex.EncodeToString(in.Signature),
+			PubKey:     hex.EncodeToString(in.PubKey),
+			ExtraNonce: in.ExtraNonce,
+		})
+	}
+
+	for _, out := range tx.Outputs {
+		result.Outputs = append(result.Outputs, TxOutput{
+			Value:      out.Value,
+			PubKeyHash: hex.EncodeToString(out.PubKeyHash),
+			Address:    wallet.PubKeyHashAddress(out.PubKeyHash, version),
+		})
+	}
+
+	return result
+}
+
+type BalanceResult struct {
+	Address string `json:"address"`
+	Balance int    `json:"balance"`
+}
+
+// SendResult tells the ID of the sent transaction and, when it was mined
+// at once, its block.
+type SendResult struct {
+	TxID   string `json:"txid"`
+	Block  string `json:"block,omitempty"`
+	Height int    `json:"height,omitempty"`
+}
+
+type WalletResult struct {
+	Address   string `json:"address"`
+	PublicKey string `json:"publicKey"`
+}
+
+// TransactionResult is a confirmed transaction with its place in the chain.
+type TransactionResult struct {
+	Block       string      `json:"block"`
+	Height      int         `json:"height"`
+	Position    int         `json:"position"`
+	Transaction Transaction `json:"transaction"`
+}
@@ -2,19 +2,14 @@ package wallet
 
 import (
 	"github.com/mr-tron/base58"
-	"log"
 )
 
-func Base58Encode(input []byte)[]byte {
+func Base58Encode(input []byte) []byte {
 	encode := base58.Encode(input)
 
 	return []byte(encode)
 }
 
-func Base58Decode(input []byte) []byte {
-	decode, err := base58.Decode(string(input[:]))
-	if err != nil {
-		log.Panicln("base58.Decode failed on Base58Decode:", err)
-	}
-	return decode
+func Base58Decode(input []byte) ([]byte, error) {
+	return base58.Decode(string(input[:]))
 }
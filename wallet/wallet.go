@@ -6,13 +6,24 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
+	"fmt"
 	"golang.org/x/crypto/ripemd160"
-	"log"
 )
 
+const checksumLength = 4
+
+// Address versions, the first byte of an encoded address. Every network has
+// its own, so addresses of one network are rejected on the others.
 const (
-	checksumLength = 4
-	version        = byte(0x00)
+	MainnetVersion = byte(0x00)
+	TestnetVersion = byte(0x41)
+	RegtestVersion = byte(0x6f)
+)
+
+var (
+	ErrInvalidAddress = errors.New("address is not valid")
+	ErrWrongNetwork   = fmt.Errorf("%w: it belongs to another network", ErrInvalidAddress)
 )
 
 type Wallet struct {
@@ -20,57 +31,86 @@ type Wallet struct {
 	PublicKey  []byte
 }
 
-func (w Wallet) Address() []byte {
-	pubHash := PublicKeyHash(w.PublicKey)
-	versionedHash := append([]byte{version}, pubHash...)
+func (w Wallet) Address(version byte) []byte {
+	return []byte(PubKeyHashAddress(PublicKeyHash(w.PublicKey), version))
+}
+
+// PubKeyHashAddress encodes the public key hash of an output as an address
+// with the version.
+func PubKeyHashAddress(pubKeyHash []byte, version byte) string {
+	versionedHash := append([]byte{version}, pubKeyHash...)
 	checksum := Checksum(versionedHash)
 
 	fullHash := append(versionedHash, checksum...)
-	address := Base58Encode(fullHash)
+	return string(Base58Encode(fullHash))
+}
 
-	return address
+func ValidateAddress(address string, version byte) bool {
+	_, err := AddressPubKeyHash(address, version)
+	return err == nil
 }
 
-func ValidateAddress(address string) bool {
-	pubKeyHash := Base58Decode([]byte(address))
-	actualChecksum := pubKeyHash[len(pubKeyHash)-checksumLength:]
-	version := pubKeyHash[0]
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-checksumLength]
-	targetChecksum := Checksum(append([]byte{version}, pubKeyHash...))
+// AddressPubKeyHash checks the address and returns the public key hash it
+// encodes, or ErrInvalidAddress. Addresses with another version are rejected
+// with ErrWrongNetwork.
+func AddressPubKeyHash(address string, version byte) ([]byte, error) {
+	fullHash, err := Base58Decode([]byte(address))
+	if err != nil || len(fullHash) <= 1+checksumLength {
+		return nil, ErrInvalidAddress
+	}
+
+	versionedHash := fullHash[:len(fullHash)-checksumLength]
+	actualChecksum := fullHash[len(fullHash)-checksumLength:]
+
+	if !bytes.Equal(actualChecksum, Checksum(versionedHash)) {
+		return nil, ErrInvalidAddress
+	}
+
+	if versionedHash[0] != version {
+		return nil, ErrWrongNetwork
+	}
 
-	return bytes.Compare(actualChecksum, targetChecksum) == 0
+	return versionedHash[1:], nil
 }
 
-func NewKeyPair() (ecdsa.PrivateKey, []byte) {
+func NewKeyPair() (ecdsa.PrivateKey, []byte, error) {
 	curve := elliptic.P256()
 
 	private, err := ecdsa.GenerateKey(curve, rand.Reader)
 	if err != nil {
-		log.Panicln("ecdsa.GenerateKey failed on NewKeyPair:", err)
+		return ecdsa.PrivateKey{}, nil, err
 	}
 
-	pub := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	return *private, PublicKeyBytes(private.PublicKey), nil
+}
 
-	return *private, pub
+// PublicKeyBytes encodes the key as its X and Y coordinates, 32 bytes each,
+// so it splits back in halves even when a coordinate starts with zeros.
+func PublicKeyBytes(key ecdsa.PublicKey) []byte {
+	pub := make([]byte, 64)
+	key.X.FillBytes(pub[:32])
+	key.Y.FillBytes(pub[32:])
+	return pub
 }
 
-func MakeWallet() *Wallet {
-	private, public := NewKeyPair()
+func MakeWallet() (*Wallet, error) {
+	private, public, err := NewKeyPair()
+	if err != nil {
+		return nil, err
+	}
 
 	return &Wallet{
 		PrivateKey: private,
 		PublicKey:  public,
-	}
+	}, nil
 }
 
 func PublicKeyHash(pubKey []byte) []byte {
 	pubHash := sha256.Sum256(pubKey)
 
+	// Writing to a hash never returns an error.
 	hasher := ripemd160.New()
-	_, err := hasher.Write(pubHash[:])
-	if err != nil {
-		log.Panicln("hasher.Write failed on PublicKeyHash:", err)
-	}
+	hasher.Write(pubHash[:])
 
 	return hasher.Sum(nil)
 }
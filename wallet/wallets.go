@@ -4,37 +4,64 @@ import (
 	"bytes"
 	"crypto/elliptic"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
+	"path/filepath"
 )
 
-const walletFile = "./tmp/wallets.data"
+const (
+	defaultDataDir = "./tmp"
+	walletFileName = "wallets.data"
+)
+
+var ErrWalletNotFound = errors.New("wallet not found")
+
+// Options configures where the wallets are stored and how their addresses
+// are encoded.
+type Options struct {
+	// DataDir holds the wallet file.
+	DataDir        string
+	AddressVersion byte
+}
+
+func DefaultOptions() Options {
+	return Options{DataDir: defaultDataDir, AddressVersion: MainnetVersion}
+}
+
+func (opts Options) walletFile() string {
+	return filepath.Join(opts.DataDir, walletFileName)
+}
 
 type Wallets struct {
 	Wallets map[string]*Wallet
+	opts    Options
 }
 
-func CreateWallets() (*Wallets, error) {
+func CreateWallets(opts Options) (*Wallets, error) {
 	wallets := Wallets{}
 	wallets.Wallets = make(map[string]*Wallet)
+	wallets.opts = opts
 
 	err := wallets.LoadFile()
 
 	return &wallets, err
 }
 
-func(ws *Wallets) AddWallet() string {
-	wallet := MakeWallet()
-	address := fmt.Sprintf("%s", wallet.Address())
+func (ws *Wallets) AddWallet() (string, error) {
+	wallet, err := MakeWallet()
+	if err != nil {
+		return "", err
+	}
+	address := fmt.Sprintf("%s", wallet.Address(ws.opts.AddressVersion))
 
 	ws.Wallets[address] = wallet
 
-	return address
+	return address, nil
 }
 
-func(ws *Wallets) GetAllAddresses() []string {
+func (ws *Wallets) GetAllAddresses() []string {
 	var addresses []string
 
 	for address := range ws.Wallets {
@@ -44,11 +71,17 @@ func(ws *Wallets) GetAllAddresses() []string {
 	return addresses
 }
 
-func(ws *Wallets) GetWallet(address string) Wallet {
-	return *ws.Wallets[address]
+func (ws *Wallets) GetWallet(address string) (Wallet, error) {
+	wallet, ok := ws.Wallets[address]
+	if !ok {
+		return Wallet{}, ErrWalletNotFound
+	}
+	return *wallet, nil
 }
 
-func(ws *Wallets) LoadFile() error {
+func (ws *Wallets) LoadFile() error {
+	walletFile := ws.opts.walletFile()
+
 	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
 		return err
 	}
@@ -72,7 +105,7 @@ func(ws *Wallets) LoadFile() error {
 	return nil
 }
 
-func(ws *Wallets) SaveFile() {
+func (ws *Wallets) SaveFile() error {
 	var content bytes.Buffer
 
 	gob.Register(elliptic.P256())
@@ -80,8 +113,13 @@ func(ws *Wallets) SaveFile() {
 	encoder := gob.NewEncoder(&content)
 	err := encoder.Encode(ws)
 	if err != nil {
-		log.Panicln("encoder.Encode failed on SaveFile:", err)
+		return err
+	}
+
+	err = os.MkdirAll(ws.opts.DataDir, 0755)
+	if err != nil {
+		return err
 	}
 
-	err = ioutil.WriteFile(walletFile, content.Bytes(), 0644)
+	return ioutil.WriteFile(ws.opts.walletFile(), content.Bytes(), 0644)
 }
\ No newline at end of file